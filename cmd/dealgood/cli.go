@@ -2,63 +2,125 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"math"
 	"os"
+	"sort"
+	"strings"
 	"text/tabwriter"
 	"time"
-)
 
-func nogui(ctx context.Context, source RequestSource, exp *Experiment, printHeader bool, printTimings bool, printFailures bool, interactive bool) error {
-	timings := make(chan *RequestTiming, 10000)
-	defer func() {
-		close(timings)
-	}()
+	"github.com/probe-lab/thunderdome/pkg/loadgen"
+)
 
-	coll, err := NewCollector(timings, 100*time.Millisecond)
+func nogui(ctx context.Context, source loadgen.RequestSource, exp *loadgen.Experiment, printHeader bool, printTimings bool, printFailures bool, interactive bool, interval time.Duration, intervalOut *loadgen.IntervalWriter, failures *loadgen.FailureStore) error {
+	r, err := loadgen.NewRunner(exp,
+		loadgen.WithSource(source),
+		loadgen.WithFailures(failures),
+		loadgen.WithPrintFailures(printFailures),
+		loadgen.WithInterval(interval),
+	)
 	if err != nil {
-		return fmt.Errorf("new collector: %w", err)
+		return fmt.Errorf("new runner: %w", err)
+	}
+	coll := r.Collector()
+
+	intervalsWritten := make(chan struct{})
+	if intervalOut != nil {
+		intervals := coll.Intervals()
+		go func() {
+			defer close(intervalsWritten)
+			for samples := range intervals {
+				if err := intervalOut.Write(samples); err != nil {
+					fmt.Fprintf(os.Stderr, "write intervals: %v\n", err)
+				}
+			}
+		}()
+	} else {
+		close(intervalsWritten)
 	}
-	go coll.Run(ctx)
 
 	if printHeader {
 		fmt.Printf("Time: %s\n", time.Now().Format(time.RFC1123Z))
 		fmt.Printf("Experiment: %s\n", exp.Name)
-		fmt.Printf("Duration: %s\n", durationDesc(exp.Duration))
+		fmt.Printf("Duration: %s\n", loadgen.DurationDesc(exp.Duration))
+		if exp.WarmUp > 0 {
+			fmt.Printf("Warm up: %s\n", loadgen.DurationDesc(exp.WarmUp))
+		}
 		fmt.Printf("Request rate: %d\n", exp.Rate)
 		fmt.Printf("Request concurrency: %d\n", exp.Concurrency)
 		fmt.Printf("Request source: %s\n", source.Name())
+		fmt.Printf("Routing: %s\n", exp.Router.Mode())
+		fmt.Printf("Dispatch: %s\n", exp.Dispatch)
+		if exp.Discovery != nil {
+			fmt.Printf("Discovery: %s (every %s)\n", exp.Discovery.Provider.Name(), exp.Discovery.Interval)
+		}
+		if exp.Baseline != "" {
+			fmt.Printf("Baseline: %s\n", exp.Baseline)
+		}
+		if seq := exp.Sequential; seq != nil {
+			fmt.Printf("Sequential test: %s against %s (alpha %g, min effect %g, %s windows)", seq.Metric, seq.Baseline, seq.Alpha, seq.MinEffect, seq.Window)
+			if seq.Stop {
+				fmt.Printf(", stopping when decided")
+			}
+			fmt.Println()
+		}
 		fmt.Println("Targets:")
 		for _, t := range exp.Targets {
-			fmt.Printf("  %s (%s://%s)\n", t.Name, t.URLScheme, t.HostPort())
+			fmt.Printf("  %s (%s://%s) %s\n", t.Name, t.URLScheme, strings.Join(t.Addrs(), ","), t.Role)
 		}
 		fmt.Println("")
 	}
 
+	printCtx, printCancel := context.WithCancel(ctx)
+	defer printCancel()
 	if printTimings {
-		go printCollectedTimings(ctx, coll, exp, interactive)
+		go printCollectedTimings(printCtx, coll, exp, interactive)
 	}
 
-	l, err := NewLoader(exp.Name, exp.Targets, source, timings, exp.Rate, exp.Concurrency, exp.Duration)
+	result, err := r.Run(ctx)
 	if err != nil {
-		return fmt.Errorf("new loader: %w", err)
+		fmt.Fprintf(os.Stderr, "loader stopped: %v\n", err)
 	}
-	l.PrintFailures = printFailures
-
-	if err := l.Send(ctx); err != nil {
-		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-			fmt.Fprintf(os.Stderr, "loader stopped: %v", err)
-		}
+	if result == nil {
+		return err
 	}
+	<-intervalsWritten
 
-	latest := coll.Latest()
-	printSampleTimings(ctx, latest, exp)
+	printCancel()
+	// report on every target that was sent requests, including discovered ones
+	exp.Targets = result.Targets
+	printSampleTimings(ctx, result.Stats, exp)
+	if printHeader {
+		printDispatchSkew(result.DispatchSkew)
+		printBaselineComparison(result.Stats, exp)
+		printGroupSummary(result.Groups, exp)
+		printSequentialResults(result.Sequential)
+	}
+	if failures != nil && printHeader {
+		printFailureSummary(failures)
+	}
 	fmt.Fprintf(os.Stderr, "Stopping\n")
 
 	return nil
 }
 
-func printCollectedTimings(ctx context.Context, coll *Collector, exp *Experiment, interactive bool) {
+// A StatsProvider provides the latest statistics for each target.
+type StatsProvider interface {
+	Latest() map[string]loadgen.MetricSample
+}
+
+// An IntervalProvider provides the statistics for each target at the end of every interval.
+type IntervalProvider interface {
+	Intervals() <-chan []loadgen.IntervalSample
+}
+
+func printCollectedTimings(ctx context.Context, coll StatsProvider, exp *loadgen.Experiment, interactive bool) {
+	if ip, ok := coll.(IntervalProvider); ok {
+		printIntervalTimings(ctx, ip.Intervals())
+		return
+	}
+
 	timingInterval := 300 * time.Second
 	if interactive {
 		timingInterval = 1 * time.Second
@@ -69,7 +131,7 @@ func printCollectedTimings(ctx context.Context, coll *Collector, exp *Experiment
 	defer t.Stop()
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.AlignRight|tabwriter.Debug)
-	fmt.Fprintln(w, "time\ttarget\trequests\tconn errs\tdropped\t5xx errs\tTTFB P50\tTTFB P90\tTTFB P90")
+	fmt.Fprintln(w, "time\ttarget\trequests\tconn errs\tdropped\t5xx errs\tTTFB P50\tTTFB P90\tTTFB P99")
 	w.Flush()
 	for {
 		select {
@@ -93,13 +155,37 @@ func printCollectedTimings(ctx context.Context, coll *Collector, exp *Experiment
 	}
 }
 
-func printSampleTimings(ctx context.Context, sample map[string]MetricSample, exp *Experiment) {
+// printIntervalTimings prints the statistics for each target as each interval completes.
+func printIntervalTimings(ctx context.Context, intervals <-chan []loadgen.IntervalSample) {
+	start := time.Now()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.AlignRight|tabwriter.Debug)
+	fmt.Fprintln(w, "time\ttarget\trequests\tconn errs\tdropped\t5xx errs\tTTFB P50\tTTFB P90\tTTFB P99")
+	w.Flush()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case samples, ok := <-intervals:
+			if !ok {
+				return
+			}
+			for _, st := range samples {
+				fmt.Fprintf(w, "% 5d\t%12s\t% 9d\t% 9d\t% 9d\t% 9d\t%9.3f\t%9.3f\t%9.3f\n", st.End.Sub(start)/time.Second, st.TargetName, st.TotalRequests, st.TotalConnectErrors, st.TotalDropped, st.TotalHttp5XX, loadgen.Finite(st.TTFB.P50)*1000, loadgen.Finite(st.TTFB.P90)*1000, loadgen.Finite(st.TTFB.P99)*1000)
+			}
+			w.Flush()
+		}
+	}
+}
+
+func printSampleTimings(ctx context.Context, sample map[string]loadgen.MetricSample, exp *loadgen.Experiment) {
 	for i, be := range exp.Targets {
 		if i > 0 {
 			fmt.Println()
 		}
 		fmt.Printf("Target:  %s\n", be.Name)
 		fmt.Printf("Base URL: %s\n", be.BaseURL)
+		fmt.Printf("Role:     %s (%s routing)\n", be.Role, exp.Router.Mode())
 		fmt.Printf("------------------------------\n")
 
 		st, ok := sample[be.Name]
@@ -109,18 +195,68 @@ func printSampleTimings(ctx context.Context, sample map[string]MetricSample, exp
 		}
 
 		connectedRequests := st.TotalRequests - st.TotalConnectErrors - st.TotalDropped
+		if exp.Health.ExcludeDown {
+			connectedRequests -= st.TotalWhileDown
+		}
 
 		fmt.Printf("Issued:          %9d\n", st.TotalRequests)
 		fmt.Printf("Connect Errors:  %9d (%6.2f%%)\n", st.TotalConnectErrors, 100*float64(st.TotalConnectErrors)/float64(st.TotalRequests))
 		fmt.Printf("Timeout Errors:  %9d (%6.2f%%)\n", st.TotalTimeoutErrors, 100*float64(st.TotalTimeoutErrors)/float64(st.TotalRequests))
 		fmt.Printf("Dropped:         %9d (%6.2f%%)\n", st.TotalDropped, 100*float64(st.TotalDropped)/float64(st.TotalRequests))
 		fmt.Printf("Connected:       %9d (%6.2f%%)\n", connectedRequests, 100*float64(connectedRequests)/float64(st.TotalRequests))
+		if st.TotalWarmUp > 0 {
+			fmt.Printf("Warm up:         %9d excluded from statistics\n", st.TotalWarmUp)
+		}
+		fmt.Printf("Sent while down: %9d (%6.2f%%)", st.TotalWhileDown, 100*float64(st.TotalWhileDown)/float64(st.TotalRequests))
+		if exp.Health.ExcludeDown {
+			fmt.Printf(" excluded from statistics")
+		}
+		fmt.Println()
+		fmt.Println()
+		if be.Health != nil {
+			fmt.Printf("Availability:    %9.2f%% (%s)\n", 100*be.Health.Availability(), be.Health.State())
+			for _, iv := range be.Health.DownIntervals() {
+				if iv.End.IsZero() {
+					fmt.Printf("  Down from %s, still down\n", iv.Start.Format(time.RFC3339))
+					continue
+				}
+				fmt.Printf("  Down from %s to %s (%s)\n", iv.Start.Format(time.RFC3339), iv.End.Format(time.RFC3339), iv.End.Sub(iv.Start).Round(time.Second))
+			}
+			fmt.Println()
+		}
+		fmt.Printf("Failures by cause\n")
+		for class := loadgen.ErrorNone + 1; class < loadgen.NumErrorClasses; class++ {
+			fmt.Printf("  %-20s %9d (%6.2f%%)\n", class.String()+":", st.ErrorCounts[class], 100*float64(st.ErrorCounts[class])/float64(st.TotalRequests))
+		}
 		fmt.Println()
 		fmt.Printf("HTTP 2XX Responses: %9d (%6.2f%%)\n", st.TotalHttp2XX, 100*float64(st.TotalHttp2XX)/float64(connectedRequests))
 		fmt.Printf("HTTP 3XX Responses: %9d (%6.2f%%)\n", st.TotalHttp3XX, 100*float64(st.TotalHttp3XX)/float64(connectedRequests))
 		fmt.Printf("HTTP 4XX Responses: %9d (%6.2f%%)\n", st.TotalHttp4XX, 100*float64(st.TotalHttp4XX)/float64(connectedRequests))
 		fmt.Printf("HTTP 5XX Responses: %9d (%6.2f%%)\n", st.TotalHttp5XX, 100*float64(st.TotalHttp5XX)/float64(connectedRequests))
 		fmt.Println()
+		if total := st.StatusAgreement.Total(); total > 0 {
+			fmt.Printf("Original gateway status (rows) vs target status (columns)\n")
+			fmt.Printf("      ")
+			for _, class := range loadgen.StatusClasses {
+				fmt.Printf(" %9s", class)
+			}
+			fmt.Println()
+			for i, class := range loadgen.StatusClasses[:loadgen.StatusClassError] {
+				fmt.Printf("  %-4s", class)
+				for j := range loadgen.StatusClasses {
+					fmt.Printf(" %9d", st.StatusAgreement[i][j])
+				}
+				fmt.Println()
+			}
+			fmt.Printf("Agreed:      %9d (%6.2f%%)\n", st.StatusAgreement.Agreed(), 100*float64(st.StatusAgreement.Agreed())/float64(total))
+			fmt.Printf("Regressions: %9d (%6.2f%%) served successfully by the original gateway but failed by the target\n", st.StatusAgreement.Regressions(), 100*float64(st.StatusAgreement.Regressions())/float64(total))
+			fmt.Println()
+		}
+		if st.DispatchLag.Count > 0 {
+			fmt.Printf("Time from dispatch until sent (%s dispatch)\n", exp.Dispatch)
+			printLatencyRow("dispatch lag", st.DispatchLag)
+			fmt.Println()
+		}
 		fmt.Printf("Time to connect\n")
 		fmt.Printf("  Mean: %9.3fms\n", st.ConnectTime.Mean*1000)
 		fmt.Printf("  Min:  %9.3fms\n", st.ConnectTime.Min*1000)
@@ -139,6 +275,13 @@ func printSampleTimings(ctx context.Context, sample map[string]MetricSample, exp
 		fmt.Printf("  P95:  %9.3fms\n", st.TTFB.P95*1000)
 		fmt.Printf("  P99:  %9.3fms\n", st.TTFB.P99*1000)
 		fmt.Println()
+		if len(st.Windows) > 0 {
+			fmt.Printf("Recent time to first byte\n")
+			for _, win := range st.Windows {
+				fmt.Printf("  Last %-4s %9d requests  P50: %9.3fms  P90: %9.3fms  P99: %9.3fms\n", loadgen.DurationDesc(int(win.Window/time.Second))+":", win.TotalRequests, loadgen.Finite(win.TTFB.P50)*1000, loadgen.Finite(win.TTFB.P90)*1000, loadgen.Finite(win.TTFB.P99)*1000)
+			}
+			fmt.Println()
+		}
 		fmt.Printf("Total request time\n")
 		fmt.Printf("  Mean: %9.3fms\n", st.TotalTime.Mean*1000)
 		fmt.Printf("  Min:  %9.3fms\n", st.TotalTime.Min*1000)
@@ -147,5 +290,217 @@ func printSampleTimings(ctx context.Context, sample map[string]MetricSample, exp
 		fmt.Printf("  P90:  %9.3fms\n", st.TotalTime.P90*1000)
 		fmt.Printf("  P95:  %9.3fms\n", st.TotalTime.P95*1000)
 		fmt.Printf("  P99:  %9.3fms\n", st.TotalTime.P99*1000)
+		fmt.Println()
+		fmt.Printf("Transfer\n")
+		fmt.Printf("  Bytes received:  %12d\n", st.TransferBytes)
+		if st.TransferSeconds > 0 {
+			fmt.Printf("  Mean rate:       %12.3f MiB/s\n", float64(st.TransferBytes)/st.TransferSeconds/(1<<20))
+		}
+		fmt.Printf("  Stalled:         %12d (%6.2f%%) paused for %s or longer\n", st.TotalStalled, 100*float64(st.TotalStalled)/float64(connectedRequests), exp.Stall)
+		fmt.Printf("  Truncated:       %12d (%6.2f%%) exceeded the body size or transfer time limit\n", st.TotalTruncated, 100*float64(st.TotalTruncated)/float64(connectedRequests))
+		printLatencyRow("longest stall", st.LongestStall)
+		for i, name := range loadgen.TransferMarkNames {
+			printLatencyRow("time to "+name, st.TimeToMark[i])
+		}
+		ranged := 0
+		for _, n := range st.RangeOutcomes[loadgen.RangeNone+1:] {
+			ranged += n
+		}
+		if ranged > 0 {
+			fmt.Println()
+			fmt.Printf("Range responses: %12d\n", ranged)
+			for outcome := loadgen.RangeNone + 1; outcome < loadgen.NumRangeOutcomes; outcome++ {
+				fmt.Printf("  %-20s %9d (%6.2f%%)\n", outcome.String()+":", st.RangeOutcomes[outcome], 100*float64(st.RangeOutcomes[outcome])/float64(ranged))
+			}
+		}
+		if len(st.Backends) > 1 {
+			backends := make([]string, 0, len(st.Backends))
+			for backend := range st.Backends {
+				backends = append(backends, backend)
+			}
+			sort.Strings(backends)
+
+			fmt.Println()
+			fmt.Printf("Requests by backend\n")
+			for _, backend := range backends {
+				bs := st.Backends[backend]
+				fmt.Printf("  %-24s %9d  Errors: %9d  5XX: %9d  TTFB P50: %9.3fms  P90: %9.3fms  P99: %9.3fms\n", backend+":", bs.Requests, bs.Errors, bs.Http5XX, loadgen.Finite(bs.TTFB.P50)*1000, loadgen.Finite(bs.TTFB.P90)*1000, loadgen.Finite(bs.TTFB.P99)*1000)
+			}
+		}
+		if len(st.RPC) > 0 {
+			methods := make([]string, 0, len(st.RPC))
+			for method := range st.RPC {
+				methods = append(methods, method)
+			}
+			sort.Strings(methods)
+
+			fmt.Println()
+			fmt.Printf("RPC requests by command\n")
+			for _, method := range methods {
+				rs := st.RPC[method]
+				total := rs.Total()
+				fmt.Printf("  %-20s %9d  OK: %6.2f%%  Invalid: %9d  Failed: %9d  Errors: %9d\n", method+":", total, 100*float64(rs.Outcomes[loadgen.RPCOK])/float64(total), rs.Outcomes[loadgen.RPCInvalid], rs.Outcomes[loadgen.RPCFailed], rs.Outcomes[loadgen.RPCError])
+			}
+			fmt.Println()
+			fmt.Printf("RPC request time by command\n")
+			for _, method := range methods {
+				printLatencyRow(method, st.RPC[method].Time)
+			}
+		}
+		fmt.Println()
+		fmt.Printf("Time by request phase\n")
+		for phase := loadgen.Phase(0); phase < loadgen.NumPhases; phase++ {
+			printLatencyRow(phase.String(), st.PhaseTime[phase])
+		}
+		fmt.Println()
+		fmt.Printf("Time to first byte by status\n")
+		for i, class := range loadgen.StatusClasses[:loadgen.StatusClassError] {
+			printLatencyRow(class, st.StatusTTFB[i])
+		}
+		fmt.Println()
+		fmt.Printf("Total request time by status\n")
+		for i, class := range loadgen.StatusClasses[:loadgen.StatusClassError] {
+			printLatencyRow(class, st.StatusTotalTime[i])
+		}
+		failed := 0
+		for _, n := range st.ErrorCounts {
+			failed += n
+		}
+		if failed > 0 {
+			fmt.Println()
+			fmt.Printf("Time to fail by cause\n")
+			for class := loadgen.ErrorNone + 1; class < loadgen.NumErrorClasses; class++ {
+				printLatencyRow(class.String(), st.ErrorTime[class])
+			}
+		}
+	}
+}
+
+// printDispatchSkew prints a summary of the difference between the earliest and latest
+// times each request was sent to its targets.
+func printDispatchSkew(skew loadgen.MetricValues) {
+	if skew.Count == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Printf("Dispatch skew between targets\n")
+	printLatencyRow("skew", skew)
+}
+
+// printBaselineComparison prints how each target compares with the experiment's baseline.
+func printBaselineComparison(sample map[string]loadgen.MetricSample, exp *loadgen.Experiment) {
+	base, ok := sample[exp.Baseline]
+	if exp.Baseline == "" || !ok {
+		return
+	}
+	fmt.Println()
+	fmt.Printf("Relative to baseline %s\n", exp.Baseline)
+	for _, t := range exp.Targets {
+		st, ok := sample[t.Name]
+		if t.Name == exp.Baseline || !ok {
+			continue
+		}
+		fmt.Printf("  %s\n", t.Name)
+		for _, c := range loadgen.CompareWithBaseline(st, base, exp.Health.ExcludeDown) {
+			ratio := "-"
+			if !math.IsNaN(c.Ratio) {
+				ratio = fmt.Sprintf("%.3fx", c.Ratio)
+			}
+			if c.IsRate {
+				fmt.Printf("    %-16s %9.4f    Baseline: %9.4f    Difference: %+9.4f    Ratio: %8s\n", c.Metric+":", c.Value, c.Baseline, c.Difference, ratio)
+				continue
+			}
+			fmt.Printf("    %-16s %9.3fms  Baseline: %9.3fms  Difference: %+9.3fms  Ratio: %8s\n", c.Metric+":", c.Value*1000, c.Baseline*1000, c.Difference*1000, ratio)
+		}
+	}
+}
+
+// printGroupSummary prints the statistics of each group of replicas and how much each metric
+// varies between replicas, then compares each group with the group of the experiment's
+// baseline.
+func printGroupSummary(groups map[string]loadgen.GroupSample, exp *loadgen.Experiment) {
+	if len(groups) == 0 {
+		return
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println()
+	fmt.Println("Replica groups")
+	for _, name := range names {
+		gs := groups[name]
+		fmt.Printf("  %s (%d replicas: %s)\n", name, len(gs.Replicas), strings.Join(gs.Replicas, ", "))
+		for _, rs := range gs.Spread {
+			if rs.IsRate {
+				fmt.Printf("    %-16s Pooled: %9.4f    Replica mean: %9.4f    Std dev: %9.4f    Range: %9.4f to %9.4f\n", rs.Metric+":", rs.Pooled, rs.Mean, loadgen.Finite(rs.StdDev), rs.Min, rs.Max)
+				continue
+			}
+			cv := "-"
+			if c := rs.CV(); !math.IsNaN(c) {
+				cv = fmt.Sprintf("%.1f%%", c*100)
+			}
+			fmt.Printf("    %-16s Pooled: %9.3fms  Replica mean: %9.3fms  Std dev: %9.3fms (%6s)  Range: %9.3fms to %9.3fms\n", rs.Metric+":", rs.Pooled*1000, rs.Mean*1000, loadgen.Finite(rs.StdDev)*1000, cv, rs.Min*1000, rs.Max*1000)
+		}
+	}
+
+	baseline := exp.TargetGroups()[exp.Baseline]
+	base, ok := groups[baseline]
+	if !ok {
+		return
+	}
+	fmt.Println()
+	fmt.Printf("Relative to baseline group %s (t is the difference in units of between-replica noise)\n", baseline)
+	for _, name := range names {
+		if name == baseline {
+			continue
+		}
+		fmt.Printf("  %s\n", name)
+		for _, c := range loadgen.CompareGroups(groups[name], base) {
+			t := "-"
+			if !math.IsNaN(c.T) {
+				t = fmt.Sprintf("%+.2f", c.T)
+			}
+			if c.IsRate {
+				fmt.Printf("    %-16s %9.4f    Baseline: %9.4f    Difference: %+9.4f    Std error: %9.4f    t: %7s\n", c.Metric+":", c.Value, c.Baseline, c.Difference, loadgen.Finite(c.StdErr), t)
+				continue
+			}
+			fmt.Printf("    %-16s %9.3fms  Baseline: %9.3fms  Difference: %+9.3fms  Std error: %9.3fms  t: %7s\n", c.Metric+":", c.Value*1000, c.Baseline*1000, c.Difference*1000, loadgen.Finite(c.StdErr)*1000, t)
+		}
+	}
+}
+
+// printSequentialResults prints the verdict of the sequential test for each target.
+func printSequentialResults(results []loadgen.SequentialResult) {
+	if len(results) == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Printf("Sequential test of %s against %s\n", results[0].Metric, results[0].Baseline)
+	for _, r := range results {
+		fmt.Printf("  %-20s %-10s  Windows: %6d  Difference: %+9.4f  Interval: %+9.4f to %+9.4f\n", r.Target+":", r.Verdict, r.Windows, r.Difference, loadgen.Finite(r.Lower), loadgen.Finite(r.Upper))
+	}
+}
+
+// printFailureSummary prints the number of failures captured for each target.
+func printFailureSummary(failures *loadgen.FailureStore) {
+	lines := failures.Summary()
+	if len(lines) == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Printf("Captured failures\n")
+	for _, line := range lines {
+		fmt.Printf("  %s\n", line)
+	}
+}
+
+// printLatencyRow prints a single line summary of a latency metric if it has any values.
+func printLatencyRow(name string, v loadgen.MetricValues) {
+	if v.Count == 0 {
+		return
 	}
+	fmt.Printf("  %-20s %9d  Mean: %9.3fms  P50: %9.3fms  P90: %9.3fms  P99: %9.3fms  Max: %9.3fms\n", name+":", v.Count, v.Mean*1000, v.P50*1000, v.P90*1000, v.P99*1000, v.Max*1000)
 }
@@ -0,0 +1,857 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/probe-lab/thunderdome/pkg/loadgen"
+	"github.com/probe-lab/thunderdome/pkg/request"
+)
+
+// Distributed load generation splits an experiment across a group of dealgood processes.
+// A coordinator reads the request source and forwards requests to workers over a
+// websocket. Each worker sends requests to the targets it has been assigned and
+// periodically reports its accumulated statistics back to the coordinator which merges
+// them into a single summary and set of metrics.
+
+const (
+	ShardByTargets  = "targets"  // each worker is assigned a subset of targets and receives every request
+	ShardByRequests = "requests" // each worker is assigned every target and receives a share of the requests
+)
+
+const (
+	msgAssign  = "assign"  // coordinator to worker: the worker's share of the experiment
+	msgReady   = "ready"   // worker to coordinator: the worker's targets are ready
+	msgRequest = "request" // coordinator to worker: a request to be sent to targets
+	msgStats   = "stats"   // worker to coordinator: statistics accumulated by the worker
+	msgStop    = "stop"    // coordinator to worker: no more requests will be sent
+)
+
+const (
+	distribPath          = "/worker"
+	distribStatsInterval = 5 * time.Second
+	distribQueueSize     = 10000
+	distribStopTimeout   = 60 * time.Second
+	distribReadyGrace    = 30 * time.Second // allowance on top of the workers' ready timeout for them to connect to targets and report back
+)
+
+type distribMessage struct {
+	Type       string                                  `json:"type"`
+	Assignment *distribAssignment                      `json:"assignment,omitempty"`
+	Request    *request.Request                        `json:"request,omitempty"`
+	Stats      map[string]*loadgen.TargetStatsSnapshot `json:"stats,omitempty"`
+}
+
+type distribAssignment struct {
+	Worker     int                     `json:"worker"`
+	Workers    int                     `json:"workers"`
+	Experiment *loadgen.ExperimentJSON `json:"experiment"`
+}
+
+// shardExperiment divides an experiment into one experiment per worker.
+func shardExperiment(expjson *loadgen.ExperimentJSON, shardBy string, workers int) ([]*loadgen.ExperimentJSON, error) {
+	if workers <= 0 {
+		return nil, fmt.Errorf("number of workers must be greater than zero")
+	}
+
+	shards := make([]*loadgen.ExperimentJSON, workers)
+	for i := range shards {
+		shard := *expjson
+		shard.Duration = -1 // the coordinator decides when the experiment ends
+		shard.Targets = nil
+		shards[i] = &shard
+	}
+
+	switch shardBy {
+	case ShardByTargets:
+		if len(expjson.Targets) < workers {
+			return nil, fmt.Errorf("cannot shard %d targets across %d workers", len(expjson.Targets), workers)
+		}
+		if expjson.Routing != nil && expjson.Routing.Mode != "" && expjson.Routing.Mode != loadgen.RoutingBroadcast {
+			return nil, fmt.Errorf("sharding by targets requires broadcast routing")
+		}
+		for i, tj := range expjson.Targets {
+			shards[i%workers].Targets = append(shards[i%workers].Targets, tj)
+		}
+		// workers do not have every target so only the coordinator compares them with
+		// the baseline
+		for _, shard := range shards {
+			shard.Baseline = ""
+		}
+	case ShardByRequests:
+		rate := (expjson.MaxRequestRate + workers - 1) / workers
+		for _, shard := range shards {
+			shard.MaxRequestRate = rate
+			shard.Targets = expjson.Targets
+		}
+	default:
+		return nil, fmt.Errorf("unsupported shard mode: %q", shardBy)
+	}
+
+	return shards, nil
+}
+
+// wsConn serializes writes to a websocket connection.
+type wsConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex // guards writes to conn
+}
+
+func (c *wsConn) Send(msg *distribMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteJSON(msg)
+}
+
+func (c *wsConn) Receive() (*distribMessage, error) {
+	var msg distribMessage
+	if err := c.conn.ReadJSON(&msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// Coordinator distributes requests from a request source to a group of workers.
+type Coordinator struct {
+	Addr    string // network address to listen for workers on
+	Workers int    // number of workers to wait for
+	ShardBy string // how the experiment is divided between workers
+
+	// ReadyTimeout is how long to wait for every worker to report that its targets are
+	// ready once all have connected, zero waits forever.
+	ReadyTimeout time.Duration
+
+	workersGauge   *prometheus.GaugeVec
+	droppedCounter *prometheus.CounterVec
+}
+
+func NewCoordinator(addr string, workers int, shardBy string) (*Coordinator, error) {
+	c := &Coordinator{
+		Addr:    addr,
+		Workers: workers,
+		ShardBy: shardBy,
+	}
+
+	var err error
+	c.workersGauge, err = loadgen.NewGaugeMetric(
+		"distrib_workers",
+		"The number of workers connected to the coordinator.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	c.droppedCounter, err = loadgen.NewCounterMetric(
+		"distrib_dropped_total",
+		"The number of requests the coordinator could not forward because the worker was falling behind.",
+		[]string{"experiment", "worker"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	return c, nil
+}
+
+type coordinatorWorker struct {
+	index int
+	conn  *wsConn
+	queue chan *request.Request
+	done  chan struct{}
+}
+
+// Run waits for all workers to connect, assigns them their share of the experiment and
+// forwards requests to them until the duration has passed or the context is canceled.
+func (c *Coordinator) Run(ctx context.Context, source loadgen.RequestSource, exp *loadgen.Experiment, expjson *loadgen.ExperimentJSON, merged *MergedStats, quiet bool) error {
+	shards, err := shardExperiment(expjson, c.ShardBy, c.Workers)
+	if err != nil {
+		return fmt.Errorf("shard experiment: %w", err)
+	}
+
+	conns := make(chan *wsConn)
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(distribPath, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		select {
+		case conns <- &wsConn{conn: conn}:
+		case <-ctx.Done():
+			conn.Close()
+		}
+	})
+
+	ln, err := net.Listen("tcp", c.Addr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	defer server.Close()
+
+	if !quiet {
+		fmt.Printf("waiting for %d workers to connect to %s\n", c.Workers, ln.Addr())
+	}
+
+	workers := make([]*coordinatorWorker, 0, c.Workers)
+	defer func() {
+		for _, w := range workers {
+			w.conn.Close()
+		}
+	}()
+
+	ready := make(chan int, c.Workers)
+	for len(workers) < c.Workers {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case conn := <-conns:
+			w := &coordinatorWorker{
+				index: len(workers),
+				conn:  conn,
+				queue: make(chan *request.Request, distribQueueSize),
+				done:  make(chan struct{}),
+			}
+			if err := conn.Send(&distribMessage{
+				Type: msgAssign,
+				Assignment: &distribAssignment{
+					Worker:     w.index,
+					Workers:    c.Workers,
+					Experiment: shards[w.index],
+				},
+			}); err != nil {
+				conn.Close()
+				continue
+			}
+			workers = append(workers, w)
+			c.workersGauge.WithLabelValues(exp.Name).Set(float64(len(workers)))
+			if !quiet {
+				fmt.Printf("worker %d connected from %s\n", w.index, conn.conn.RemoteAddr())
+			}
+			go c.receive(w, merged, ready)
+		}
+	}
+
+	if err := c.waitReady(ctx, workers, ready); err != nil {
+		return err
+	}
+	if !quiet {
+		fmt.Printf("all workers ready\n")
+	}
+
+	for _, w := range workers {
+		go c.send(w)
+	}
+
+	if err := c.forward(ctx, source, exp, workers); err != nil {
+		return err
+	}
+
+	// Wait for workers to send their final statistics
+	timeout := time.NewTimer(distribStopTimeout)
+	defer timeout.Stop()
+	for _, w := range workers {
+		select {
+		case <-w.done:
+		case <-timeout.C:
+			return fmt.Errorf("timed out waiting for workers to stop")
+		}
+	}
+
+	return nil
+}
+
+// waitReady waits for every worker to report that its targets are ready, failing if a
+// worker disconnects first or the ready timeout passes.
+func (c *Coordinator) waitReady(ctx context.Context, workers []*coordinatorWorker, ready <-chan int) error {
+	gone := make(chan int, len(workers))
+	for _, w := range workers {
+		go func(w *coordinatorWorker) {
+			<-w.done
+			gone <- w.index
+		}(w)
+	}
+
+	var timeout <-chan time.Time
+	if c.ReadyTimeout > 0 {
+		timer := time.NewTimer(c.ReadyTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	pending := make(map[int]bool, len(workers))
+	for _, w := range workers {
+		pending[w.index] = true
+	}
+	for len(pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case idx := <-ready:
+			delete(pending, idx)
+		case idx := <-gone:
+			if pending[idx] {
+				return fmt.Errorf("worker %d disconnected before it was ready", idx)
+			}
+		case <-timeout:
+			return fmt.Errorf("timed out waiting for %d workers to be ready", len(pending))
+		}
+	}
+	return nil
+}
+
+func (c *Coordinator) forward(ctx context.Context, source loadgen.RequestSource, exp *loadgen.Experiment, workers []*coordinatorWorker) error {
+	if exp.Duration > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(exp.Duration+exp.WarmUp)*time.Second)
+		defer cancel()
+	}
+	defer func() {
+		for _, w := range workers {
+			close(w.queue)
+		}
+	}()
+
+	if err := source.Start(); err != nil {
+		return fmt.Errorf("start source: %w", err)
+	}
+
+	// Requests are read from the source at the experiment's rate, as the loader would
+	requestInterval := time.Duration(float64(time.Second) / float64(exp.Rate))
+	tick := time.NewTicker(requestInterval)
+	defer tick.Stop()
+
+	next := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+
+		var req request.Request
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return nil
+		case req, ok = <-source.Chan():
+		}
+		if !ok {
+			if err := source.Err(); err != nil {
+				return fmt.Errorf("source: %w", err)
+			}
+			return nil
+		}
+
+		switch c.ShardBy {
+		case ShardByTargets:
+			for _, w := range workers {
+				c.enqueue(exp, w, req)
+			}
+		case ShardByRequests:
+			c.enqueue(exp, workers[next], req)
+			next = (next + 1) % len(workers)
+		}
+	}
+}
+
+func (c *Coordinator) enqueue(exp *loadgen.Experiment, w *coordinatorWorker, req request.Request) {
+	select {
+	case w.queue <- &req:
+	default:
+		c.droppedCounter.WithLabelValues(exp.Name, strconv.Itoa(w.index)).Add(1)
+	}
+}
+
+// send writes queued requests to the worker, followed by a stop message when the queue is closed.
+func (c *Coordinator) send(w *coordinatorWorker) {
+	for req := range w.queue {
+		if err := w.conn.Send(&distribMessage{Type: msgRequest, Request: req}); err != nil {
+			fmt.Fprintf(os.Stderr, "worker %d send failed: %v\n", w.index, err)
+			// keep draining the queue so the forwarder is not blocked
+			for range w.queue {
+			}
+			return
+		}
+	}
+	w.conn.Send(&distribMessage{Type: msgStop})
+}
+
+// receive reads messages from the worker until the connection is closed.
+func (c *Coordinator) receive(w *coordinatorWorker, merged *MergedStats, ready chan<- int) {
+	defer close(w.done)
+	for {
+		msg, err := w.conn.Receive()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				fmt.Fprintf(os.Stderr, "worker %d receive failed: %v\n", w.index, err)
+			}
+			return
+		}
+		switch msg.Type {
+		case msgReady:
+			ready <- w.index
+		case msgStats:
+			if err := merged.Update(w.index, msg.Stats); err != nil {
+				fmt.Fprintf(os.Stderr, "worker %d stats: %v\n", w.index, err)
+			}
+		}
+	}
+}
+
+// runWorker connects to a coordinator and sends the requests it receives to the
+// targets it has been assigned.
+func runWorker(ctx context.Context, coordinatorURL string, printTimings bool, printFailures bool, quiet bool, interactive bool, preProbeWait int, readyTimeout int, interval time.Duration, failures *loadgen.FailureStore) error {
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, coordinatorURL, nil)
+	if err != nil {
+		return fmt.Errorf("dial coordinator: %w", err)
+	}
+	conn := &wsConn{conn: ws}
+	defer conn.Close()
+
+	msg, err := conn.Receive()
+	if err != nil {
+		return fmt.Errorf("receive assignment: %w", err)
+	}
+	if msg.Type != msgAssign || msg.Assignment == nil || msg.Assignment.Experiment == nil {
+		return fmt.Errorf("expected assignment from coordinator but got %q", msg.Type)
+	}
+
+	exp, err := loadgen.NewExperiment(msg.Assignment.Experiment)
+	if err != nil {
+		return fmt.Errorf("experiment: %w", err)
+	}
+
+	if !quiet {
+		fmt.Printf("Worker %d of %d\n", msg.Assignment.Worker+1, msg.Assignment.Workers)
+		fmt.Printf("Experiment: %s\n", exp.Name)
+		fmt.Printf("Request rate: %d\n", exp.Rate)
+		fmt.Printf("Request concurrency: %d\n", exp.Concurrency)
+		fmt.Println("Targets:")
+		for _, t := range exp.Targets {
+			fmt.Printf("  %s (%s://%s)\n", t.Name, t.URLScheme, strings.Join(t.Addrs(), ","))
+		}
+		fmt.Println("")
+	}
+
+	if err := loadgen.TargetsReady(ctx, exp.Targets, quiet, interactive, preProbeWait, readyTimeout); err != nil {
+		return fmt.Errorf("targets ready check: %w", err)
+	}
+
+	if err := conn.Send(&distribMessage{Type: msgReady}); err != nil {
+		return fmt.Errorf("send ready: %w", err)
+	}
+
+	source := &RemoteRequestSource{
+		ch:   make(chan request.Request),
+		done: make(chan struct{}),
+	}
+	go source.receive(conn)
+
+	timings := make(chan *loadgen.RequestTiming, 10000)
+
+	coll, err := loadgen.NewCollector(timings, 100*time.Millisecond)
+	if err != nil {
+		return fmt.Errorf("new collector: %w", err)
+	}
+	coll.ExcludeDown = exp.Health.ExcludeDown
+	coll.Interval = interval
+	coll.Baseline = exp.Baseline
+
+	// the collector stops once its timings are closed so the final statistics include
+	// every timing still queued when the loader stops
+	collDone := make(chan struct{})
+	go func() {
+		defer close(collDone)
+		coll.Run(context.Background())
+	}()
+
+	collCtx, collCancel := context.WithCancel(ctx)
+	defer collCancel()
+	if printTimings {
+		go printCollectedTimings(collCtx, coll, exp, interactive)
+	}
+
+	sendStats := func(ctx context.Context) error {
+		snaps, err := coll.Snapshot(ctx)
+		if err != nil {
+			return err
+		}
+		return conn.Send(&distribMessage{Type: msgStats, Stats: snaps})
+	}
+
+	statsDone := make(chan struct{})
+	go func() {
+		defer close(statsDone)
+		t := time.NewTicker(distribStatsInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-collCtx.Done():
+				return
+			case <-t.C:
+				if err := sendStats(collCtx); err != nil && !errors.Is(err, context.Canceled) {
+					fmt.Fprintf(os.Stderr, "send stats: %v\n", err)
+				}
+			}
+		}
+	}()
+
+	l, err := exp.NewLoader(source, timings)
+	if err != nil {
+		close(timings)
+		return fmt.Errorf("new loader: %w", err)
+	}
+	l.PrintFailures = printFailures
+	l.Failures = failures
+
+	if err := l.Send(ctx); err != nil {
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			fmt.Fprintf(os.Stderr, "loader stopped: %v\n", err)
+		}
+	}
+
+	close(timings)
+	<-collDone
+	collCancel()
+	<-statsDone
+
+	if err := sendStats(context.Background()); err != nil {
+		return fmt.Errorf("send final stats: %w", err)
+	}
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+
+	if !quiet {
+		printSampleTimings(ctx, coll.Latest(), exp)
+		printDispatchSkew(l.DispatchSkew())
+		if failures != nil {
+			printFailureSummary(failures)
+		}
+		fmt.Fprintf(os.Stderr, "Stopping\n")
+	}
+
+	return nil
+}
+
+// RemoteRequestSource is a request source that provides requests received from a coordinator.
+type RemoteRequestSource struct {
+	ch   chan request.Request
+	done chan struct{}
+
+	mu  sync.Mutex // guards following fields
+	err error
+}
+
+var _ loadgen.RequestSource = (*RemoteRequestSource)(nil)
+
+func (s *RemoteRequestSource) Name() string {
+	return "coordinator"
+}
+
+func (s *RemoteRequestSource) Chan() <-chan request.Request {
+	return s.ch
+}
+
+func (s *RemoteRequestSource) Start() error {
+	return nil
+}
+
+func (s *RemoteRequestSource) Stop() {
+	close(s.done)
+}
+
+func (s *RemoteRequestSource) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *RemoteRequestSource) receive(conn *wsConn) {
+	defer close(s.ch)
+	for {
+		msg, err := conn.Receive()
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			return
+		}
+		switch msg.Type {
+		case msgStop:
+			return
+		case msgRequest:
+			if msg.Request == nil {
+				continue
+			}
+			select {
+			case <-s.done:
+				return
+			case s.ch <- *msg.Request:
+			}
+		}
+	}
+}
+
+// MergedStats combines the statistics reported by each worker.
+type MergedStats struct {
+	GroupOf        map[string]string // group of each target that is a replica, keyed by target name
+	ExcludeDown    bool              // exclude requests sent while a target was down from the groups' error and drop rates
+	experimentName string
+	requestsGauge  *prometheus.GaugeVec
+	errorsGauge    *prometheus.GaugeVec
+	responsesGauge *prometheus.GaugeVec
+	timeGauge      *prometheus.GaugeVec
+	regressGauge   *prometheus.GaugeVec
+
+	mu      sync.Mutex // guards following fields
+	workers map[int]map[string]*loadgen.TargetStatsSnapshot
+	samples map[string]loadgen.MetricSample
+	groups  map[string]loadgen.GroupSample
+}
+
+func NewMergedStats(experimentName string) (*MergedStats, error) {
+	m := &MergedStats{
+		experimentName: experimentName,
+		workers:        map[int]map[string]*loadgen.TargetStatsSnapshot{},
+		samples:        map[string]loadgen.MetricSample{},
+	}
+
+	var err error
+	m.requestsGauge, err = loadgen.NewGaugeMetric(
+		"merged_requests",
+		"The total number of requests attempted by all workers.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	m.errorsGauge, err = loadgen.NewGaugeMetric(
+		"merged_errors",
+		"The total number of requests that failed or were dropped by all workers.",
+		[]string{"experiment", "target", "error"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	m.responsesGauge, err = loadgen.NewGaugeMetric(
+		"merged_responses",
+		"The total number of responses received by all workers.",
+		[]string{"experiment", "target", "class"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	m.timeGauge, err = loadgen.NewGaugeMetric(
+		"merged_time_seconds",
+		"Quantiles of request timings for successful gateway requests merged from all workers.",
+		[]string{"experiment", "target", "timing", "quantile"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	m.regressGauge, err = loadgen.NewGaugeMetric(
+		"merged_status_regressions",
+		"The total number of requests that the original gateway served successfully but the target failed to serve, from all workers.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	return m, nil
+}
+
+// Update replaces the statistics reported by a worker and recalculates the merged statistics.
+func (m *MergedStats) Update(worker int, snaps map[string]*loadgen.TargetStatsSnapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.workers[worker] = snaps
+
+	// Workers are merged in a consistent order
+	indexes := make([]int, 0, len(m.workers))
+	for idx := range m.workers {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	stats := map[string]*loadgen.TargetStats{}
+	groupStats := map[string]*loadgen.TargetStats{}
+	for _, idx := range indexes {
+		for name, snap := range m.workers[idx] {
+			st, ok := stats[name]
+			if !ok {
+				st = loadgen.NewTargetStats()
+				stats[name] = st
+			}
+			if err := st.Merge(snap); err != nil {
+				return fmt.Errorf("merge target %s from worker %d: %w", name, idx, err)
+			}
+
+			group := m.GroupOf[name]
+			if group == "" {
+				continue
+			}
+			gst, ok := groupStats[group]
+			if !ok {
+				gst = loadgen.NewTargetStats()
+				groupStats[group] = gst
+			}
+			if err := gst.Merge(snap); err != nil {
+				return fmt.Errorf("merge group %s from worker %d: %w", group, idx, err)
+			}
+		}
+	}
+
+	samples := make(map[string]loadgen.MetricSample, len(stats))
+	for name, st := range stats {
+		sample := st.Sample()
+		samples[name] = sample
+		m.report(name, sample)
+	}
+	m.samples = samples
+
+	groups := make(map[string]loadgen.GroupSample, len(groupStats))
+	for group, gst := range groupStats {
+		replicas := map[string]loadgen.MetricSample{}
+		for name, sample := range samples {
+			if m.GroupOf[name] == group {
+				replicas[name] = sample
+			}
+		}
+		groups[group] = loadgen.NewGroupSample(gst.Sample(), replicas, m.ExcludeDown)
+	}
+	m.groups = groups
+	return nil
+}
+
+func (m *MergedStats) report(target string, sample loadgen.MetricSample) {
+	m.requestsGauge.WithLabelValues(m.experimentName, target).Set(float64(sample.TotalRequests))
+	m.errorsGauge.WithLabelValues(m.experimentName, target, "connect").Set(float64(sample.TotalConnectErrors))
+	m.errorsGauge.WithLabelValues(m.experimentName, target, "timeout").Set(float64(sample.TotalTimeoutErrors))
+	m.errorsGauge.WithLabelValues(m.experimentName, target, "dropped").Set(float64(sample.TotalDropped))
+	for class := loadgen.ErrorNone + 1; class < loadgen.NumErrorClasses; class++ {
+		m.errorsGauge.WithLabelValues(m.experimentName, target, class.String()).Set(float64(sample.ErrorCounts[class]))
+	}
+	m.responsesGauge.WithLabelValues(m.experimentName, target, "2xx").Set(float64(sample.TotalHttp2XX))
+	m.responsesGauge.WithLabelValues(m.experimentName, target, "3xx").Set(float64(sample.TotalHttp3XX))
+	m.responsesGauge.WithLabelValues(m.experimentName, target, "4xx").Set(float64(sample.TotalHttp4XX))
+	m.responsesGauge.WithLabelValues(m.experimentName, target, "5xx").Set(float64(sample.TotalHttp5XX))
+	m.regressGauge.WithLabelValues(m.experimentName, target).Set(float64(sample.StatusAgreement.Regressions()))
+
+	for timing, v := range map[string]loadgen.MetricValues{"connect": sample.ConnectTime, "ttfb": sample.TTFB, "total": sample.TotalTime} {
+		m.timeGauge.WithLabelValues(m.experimentName, target, timing, "0.5").Set(v.P50)
+		m.timeGauge.WithLabelValues(m.experimentName, target, timing, "0.9").Set(v.P90)
+		m.timeGauge.WithLabelValues(m.experimentName, target, timing, "0.99").Set(v.P99)
+	}
+}
+
+// Latest returns the most recently merged statistics for each target.
+func (m *MergedStats) Latest() map[string]loadgen.MetricSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	samples := make(map[string]loadgen.MetricSample, len(m.samples))
+	for k, v := range m.samples {
+		samples[k] = v
+	}
+	return samples
+}
+
+// LatestGroups returns the most recently merged statistics for each group of replicas.
+func (m *MergedStats) LatestGroups() map[string]loadgen.GroupSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	groups := make(map[string]loadgen.GroupSample, len(m.groups))
+	for k, v := range m.groups {
+		groups[k] = v
+	}
+	return groups
+}
+
+// runCoordinator distributes the experiment across workers and reports the merged results.
+func runCoordinator(ctx context.Context, source loadgen.RequestSource, exp *loadgen.Experiment, expjson *loadgen.ExperimentJSON, addr string, workers int, shardBy string, readyTimeout time.Duration, printHeader bool, printTimings bool, interactive bool) error {
+	if exp.Discovery != nil {
+		return fmt.Errorf("target discovery is not supported with distributed workers")
+	}
+	if exp.Sequential != nil {
+		return fmt.Errorf("sequential testing is not supported with distributed workers")
+	}
+
+	coord, err := NewCoordinator(addr, workers, shardBy)
+	if err != nil {
+		return fmt.Errorf("new coordinator: %w", err)
+	}
+	coord.ReadyTimeout = readyTimeout
+
+	merged, err := NewMergedStats(exp.Name)
+	if err != nil {
+		return fmt.Errorf("new merged stats: %w", err)
+	}
+	merged.GroupOf = exp.TargetGroups()
+	merged.ExcludeDown = exp.Health.ExcludeDown
+
+	if printHeader {
+		fmt.Printf("Time: %s\n", time.Now().Format(time.RFC1123Z))
+		fmt.Printf("Experiment: %s\n", exp.Name)
+		fmt.Printf("Duration: %s\n", loadgen.DurationDesc(exp.Duration))
+		if exp.WarmUp > 0 {
+			fmt.Printf("Warm up: %s\n", loadgen.DurationDesc(exp.WarmUp))
+		}
+		fmt.Printf("Request rate: %d\n", exp.Rate)
+		fmt.Printf("Request concurrency: %d\n", exp.Concurrency)
+		fmt.Printf("Request source: %s\n", source.Name())
+		fmt.Printf("Workers: %d (sharded by %s)\n", workers, shardBy)
+		if exp.Baseline != "" {
+			fmt.Printf("Baseline: %s\n", exp.Baseline)
+		}
+		fmt.Println("Targets:")
+		for _, t := range exp.Targets {
+			fmt.Printf("  %s (%s://%s)\n", t.Name, t.URLScheme, strings.Join(t.Addrs(), ","))
+		}
+		fmt.Println("")
+	}
+
+	printCtx, printCancel := context.WithCancel(ctx)
+	defer printCancel()
+	if printTimings {
+		go printCollectedTimings(printCtx, merged, exp, interactive)
+	}
+
+	if err := coord.Run(ctx, source, exp, expjson, merged, !printHeader); err != nil {
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("coordinator: %w", err)
+		}
+	}
+
+	latest := merged.Latest()
+	printSampleTimings(ctx, latest, exp)
+	if printHeader {
+		printBaselineComparison(latest, exp)
+		printGroupSummary(merged.LatestGroups(), exp)
+	}
+	fmt.Fprintf(os.Stderr, "Stopping\n")
+
+	return nil
+}
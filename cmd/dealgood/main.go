@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -23,7 +22,9 @@ import (
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/trace"
 
+	schema "github.com/probe-lab/thunderdome/pkg/exp"
 	"github.com/probe-lab/thunderdome/pkg/filter"
+	"github.com/probe-lab/thunderdome/pkg/loadgen"
 	"github.com/probe-lab/thunderdome/pkg/loki"
 )
 
@@ -48,7 +49,7 @@ var app = &cli.App{
 		&cli.StringFlag{
 			Name:        "source",
 			Value:       "-",
-			Usage:       "Name of request source, use '-' to read JSONL from stdin, 'random' to use some builtin random requests, 'loki' to read from a Loki log stream",
+			Usage:       "Name of request source, use '-' to read JSONL from stdin, 'random' to use some builtin random requests, 'rpc' to generate requests to the kubo RPC API from templates in the JSON file named by --source-param or builtin templates, 'loki' to read from a Loki log stream",
 			Destination: &flags.source,
 			EnvVars:     []string{"DEALGOOD_SOURCE"},
 		},
@@ -71,6 +72,12 @@ var app = &cli.App{
 			Destination: &flags.targets,
 			EnvVars:     []string{"DEALGOOD_TARGETS"},
 		},
+		&cli.StringSliceFlag{
+			Name:        "groups",
+			Usage:       "Comma separated list assigning targets to groups of identical replicas that are reported on as a whole, each in the form 'target=group' (if not using an experiment file)",
+			Destination: &flags.groups,
+			EnvVars:     []string{"DEALGOOD_GROUPS"},
+		},
 		&cli.IntFlag{
 			Name:        "rate",
 			Usage:       "Number of requests per second to send (if not using an experiment file)",
@@ -92,6 +99,160 @@ var app = &cli.App{
 			Destination: &flags.duration,
 			EnvVars:     []string{"DEALGOOD_DURATION"},
 		},
+		&cli.StringFlag{
+			Name:        "routing",
+			Usage:       "How requests are distributed to targets: broadcast, hash, split or mirror (if not using an experiment file)",
+			Value:       loadgen.RoutingBroadcast,
+			Destination: &flags.routing,
+			EnvVars:     []string{"DEALGOOD_ROUTING"},
+		},
+		&cli.StringFlag{
+			Name:        "dispatch",
+			Usage:       "How each request is handed to its targets: random to hand it to targets in a random order or barrier to also release it to all targets at once (if not using an experiment file)",
+			Value:       loadgen.DispatchRandom,
+			Destination: &flags.dispatch,
+			EnvVars:     []string{"DEALGOOD_DISPATCH"},
+		},
+		&cli.IntFlag{
+			Name:        "resolve-interval",
+			Usage:       "Duration in seconds between refreshing the addresses each target's host resolves to, requests are balanced across all the addresses, -1 disables refreshing (if not using an experiment file)",
+			Value:       0,
+			Destination: &flags.resolveEvery,
+			EnvVars:     []string{"DEALGOOD_RESOLVE_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:        "discovery-file",
+			Usage:       "Path of a JSON file holding a list of targets that is watched so targets can be added and removed while running (if not using an experiment file)",
+			Value:       "",
+			Destination: &flags.discoveryFile,
+			EnvVars:     []string{"DEALGOOD_DISCOVERY_FILE"},
+		},
+		&cli.StringFlag{
+			Name:        "discovery-srv",
+			Usage:       "DNS name whose SRV records are watched so targets can be added and removed while running (if not using an experiment file)",
+			Value:       "",
+			Destination: &flags.discoverySRV,
+			EnvVars:     []string{"DEALGOOD_DISCOVERY_SRV"},
+		},
+		&cli.IntFlag{
+			Name:        "discovery-interval",
+			Usage:       "Duration in seconds between checking for changes to discovered targets, defaults to 10 (if not using an experiment file)",
+			Value:       0,
+			Destination: &flags.discoveryEvery,
+			EnvVars:     []string{"DEALGOOD_DISCOVERY_INTERVAL"},
+		},
+		&cli.IntFlag{
+			Name:        "warm-up",
+			Usage:       "Duration in seconds at the start of the experiment during which requests are sent but excluded from statistics, in addition to the experiment duration (if not using an experiment file)",
+			Value:       0,
+			Destination: &flags.warmUp,
+			EnvVars:     []string{"DEALGOOD_WARM_UP"},
+		},
+		&cli.IntFlag{
+			Name:        "stall",
+			Usage:       "Duration in seconds that reading a response body may pause before the transfer is considered stalled (if not using an experiment file)",
+			Value:       int(loadgen.DefaultStallThreshold / time.Second),
+			Destination: &flags.stall,
+			EnvVars:     []string{"DEALGOOD_STALL"},
+		},
+		&cli.Int64Flag{
+			Name:        "max-body-size",
+			Usage:       "Maximum number of bytes to read from each response body before aborting the request, 0 means no limit (if not using an experiment file)",
+			Value:       0,
+			Destination: &flags.maxBodySize,
+			EnvVars:     []string{"DEALGOOD_MAX_BODY_SIZE"},
+		},
+		&cli.IntFlag{
+			Name:        "max-transfer-time",
+			Usage:       "Maximum duration in seconds to spend reading each response body before aborting the request, 0 means no limit (if not using an experiment file)",
+			Value:       0,
+			Destination: &flags.maxTransfer,
+			EnvVars:     []string{"DEALGOOD_MAX_TRANSFER_TIME"},
+		},
+		&cli.Float64Flag{
+			Name:        "range-fraction",
+			Usage:       "Fraction of GET requests for /ipfs/ and /ipns/ paths that are given a randomly generated Range header (if not using an experiment file)",
+			Value:       0,
+			Destination: &flags.rangeFraction,
+			EnvVars:     []string{"DEALGOOD_RANGE_FRACTION"},
+		},
+		&cli.Float64Flag{
+			Name:        "range-verify",
+			Usage:       "Fraction of partial responses to range requests whose bytes are compared with a fetch of the full body (if not using an experiment file)",
+			Value:       0,
+			Destination: &flags.rangeVerify,
+			EnvVars:     []string{"DEALGOOD_RANGE_VERIFY"},
+		},
+		&cli.BoolFlag{
+			Name:        "exclude-down",
+			Usage:       "Exclude requests sent while a target is down from the target's statistics (if not using an experiment file)",
+			Value:       false,
+			Destination: &flags.excludeDown,
+			EnvVars:     []string{"DEALGOOD_EXCLUDE_DOWN"},
+		},
+		&cli.StringFlag{
+			Name:        "baseline",
+			Usage:       "Name of the target the others are compared with in live metrics and reports (if not using an experiment file)",
+			Value:       "",
+			Destination: &flags.baseline,
+			EnvVars:     []string{"DEALGOOD_BASELINE"},
+		},
+		&cli.StringFlag{
+			Name:        "sequential-metric",
+			Usage:       "Metric compared between each target and the baseline by a sequential test that declares a verdict once there is enough evidence: ttfb_p50, ttfb_p90, ttfb_p99, ttfb_mean, total_time_p50, total_time_p90, total_time_p99, total_time_mean or error_rate, empty disables the test (if not using an experiment file)",
+			Value:       "",
+			Destination: &flags.seqMetric,
+			EnvVars:     []string{"DEALGOOD_SEQUENTIAL_METRIC"},
+		},
+		&cli.StringFlag{
+			Name:        "sequential-baseline",
+			Usage:       "Name of the target the others are compared with by the sequential test, defaults to the first target (if not using an experiment file)",
+			Value:       "",
+			Destination: &flags.seqBaseline,
+			EnvVars:     []string{"DEALGOOD_SEQUENTIAL_BASELINE"},
+		},
+		&cli.Float64Flag{
+			Name:        "sequential-alpha",
+			Usage:       "Probability of the sequential test declaring a difference when there is none, defaults to 0.05 (if not using an experiment file)",
+			Value:       0,
+			Destination: &flags.seqAlpha,
+			EnvVars:     []string{"DEALGOOD_SEQUENTIAL_ALPHA"},
+		},
+		&cli.Float64Flag{
+			Name:        "sequential-min-effect",
+			Usage:       "Smallest difference from the baseline worth detecting, a fraction of the baseline for times and an absolute difference for error_rate, defaults to 0.05 and 0.01 (if not using an experiment file)",
+			Value:       0,
+			Destination: &flags.seqMinEffect,
+			EnvVars:     []string{"DEALGOOD_SEQUENTIAL_MIN_EFFECT"},
+		},
+		&cli.IntFlag{
+			Name:        "sequential-window",
+			Usage:       "Duration in seconds of requests summarised by each observation of the sequential test's metric, defaults to 60 (if not using an experiment file)",
+			Value:       0,
+			Destination: &flags.seqWindow,
+			EnvVars:     []string{"DEALGOOD_SEQUENTIAL_WINDOW"},
+		},
+		&cli.IntFlag{
+			Name:        "sequential-min-windows",
+			Usage:       "Number of windows the sequential test observes before it may declare a verdict, defaults to 5 (if not using an experiment file)",
+			Value:       0,
+			Destination: &flags.seqMinWindows,
+			EnvVars:     []string{"DEALGOOD_SEQUENTIAL_MIN_WINDOWS"},
+		},
+		&cli.IntFlag{
+			Name:        "sequential-min-requests",
+			Usage:       "Number of measurements of a target needed in a window for the sequential test to use it, defaults to 20 (if not using an experiment file)",
+			Value:       0,
+			Destination: &flags.seqMinRequests,
+			EnvVars:     []string{"DEALGOOD_SEQUENTIAL_MIN_REQUESTS"},
+		},
+		&cli.BoolFlag{
+			Name:        "sequential-stop",
+			Usage:       "Stop sending requests once the sequential test has declared a verdict for every target (if not using an experiment file)",
+			Value:       false,
+			Destination: &flags.seqStop,
+			EnvVars:     []string{"DEALGOOD_SEQUENTIAL_STOP"},
+		},
 		&cli.StringFlag{
 			Name:        "host",
 			Usage:       "Force a host header to be sent with each request (if not using an experiment file)",
@@ -113,6 +274,26 @@ var app = &cli.App{
 			Destination: &flags.failures,
 			EnvVars:     []string{"DEALGOOD_FAILURES"},
 		},
+		&cli.IntFlag{
+			Name:        "failure-samples",
+			Usage:       "Number of failed or anomalous requests to keep a random sample of for each target, available at /failures on the prometheus server address, 0 disables capture",
+			Value:       100,
+			Destination: &flags.failureSamples,
+			EnvVars:     []string{"DEALGOOD_FAILURE_SAMPLES"},
+		},
+		&cli.IntFlag{
+			Name:        "failure-body-size",
+			Usage:       "Number of bytes at the start of the response body to keep for each captured failure",
+			Value:       4096,
+			Destination: &flags.failureBodyLen,
+			EnvVars:     []string{"DEALGOOD_FAILURE_BODY_SIZE"},
+		},
+		&cli.StringFlag{
+			Name:        "failure-file",
+			Usage:       "Path of a file to write the captured failures to as JSON at the end of the run",
+			Destination: &flags.failureFile,
+			EnvVars:     []string{"DEALGOOD_FAILURE_FILE"},
+		},
 		&cli.BoolFlag{
 			Name:        "quiet",
 			Usage:       "Suppress all output, overriding timings and failures flags (not in gui mode)",
@@ -185,7 +366,7 @@ var app = &cli.App{
 		},
 		&cli.StringFlag{
 			Name:        "filter",
-			Usage:       "Filter to apply to requests from the request source (all, pathonly, validpathonly)",
+			Usage:       "Filter to apply to requests from the request source, either one of all, pathonly, validpathonly, rpconly or a filter expression such as 'method == \"GET\" && path ~ \"^/ipfs/\"'",
 			Value:       "pathonly",
 			Destination: &flags.filter,
 			EnvVars:     []string{"DEALGOOD_FILTER"},
@@ -197,6 +378,20 @@ var app = &cli.App{
 			Destination: &flags.sqsRegion,
 			EnvVars:     []string{"DEALGOOD_SQS_REGION"},
 		},
+		&cli.IntFlag{
+			Name:        "interval",
+			Usage:       "Length in seconds of each interval in the interval statistics that are printed with timings and written to the interval file.",
+			Value:       60,
+			Destination: &flags.interval,
+			EnvVars:     []string{"DEALGOOD_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:        "interval-file",
+			Usage:       "Path of a file to write the statistics for each interval to, as CSV if the name ends in .csv or JSON lines otherwise.",
+			Value:       "",
+			Destination: &flags.intervalFile,
+			EnvVars:     []string{"DEALGOOD_INTERVAL_FILE"},
+		},
 		&cli.IntFlag{
 			Name:        "pre-probe-wait",
 			Usage:       "Delay to wait (in seconds) before starting to probe targets. Set to 0 if targets are already started.",
@@ -204,6 +399,55 @@ var app = &cli.App{
 			Destination: &flags.preProbeWait,
 			EnvVars:     []string{"DEALGOOD_PRE_PROBE_WAIT"},
 		},
+		&cli.StringFlag{
+			Name:        "coordinator-addr",
+			Usage:       "Run as the coordinator of a group of distributed workers, listening for them on this network address (example: :7070)",
+			Value:       "",
+			Destination: &flags.coordinatorAddr,
+			EnvVars:     []string{"DEALGOOD_COORDINATOR_ADDR"},
+		},
+		&cli.IntFlag{
+			Name:        "workers",
+			Usage:       "Number of distributed workers the coordinator should wait for before starting the experiment.",
+			Value:       1,
+			Destination: &flags.workers,
+			EnvVars:     []string{"DEALGOOD_WORKERS"},
+		},
+		&cli.StringFlag{
+			Name:        "shard-by",
+			Usage:       "How the coordinator divides the experiment between workers: targets or requests.",
+			Value:       ShardByTargets,
+			Destination: &flags.shardBy,
+			EnvVars:     []string{"DEALGOOD_SHARD_BY"},
+		},
+		&cli.StringFlag{
+			Name:        "coordinator-url",
+			Usage:       "Run as a distributed worker, taking the experiment and requests from the coordinator at this URL (example: ws://coordinator:7070/worker)",
+			Value:       "",
+			Destination: &flags.coordinatorURL,
+			EnvVars:     []string{"DEALGOOD_COORDINATOR_URL"},
+		},
+		&cli.StringFlag{
+			Name:        "probe-path",
+			Usage:       "Path of the request used to probe targets to see if they are ready, such as a known CID (if not using an experiment file)",
+			Value:       "/",
+			Destination: &flags.probePath,
+			EnvVars:     []string{"DEALGOOD_PROBE_PATH"},
+		},
+		&cli.IntFlag{
+			Name:        "probe-status",
+			Usage:       "Status code a probe must receive for a target to be considered ready, 0 accepts any response (if not using an experiment file)",
+			Value:       0,
+			Destination: &flags.probeStatus,
+			EnvVars:     []string{"DEALGOOD_PROBE_STATUS"},
+		},
+		&cli.IntFlag{
+			Name:        "probe-successes",
+			Usage:       "Number of consecutive successful probes required before a target is considered ready (if not using an experiment file)",
+			Value:       1,
+			Destination: &flags.probeSuccesses,
+			EnvVars:     []string{"DEALGOOD_PROBE_SUCCESSES"},
+		},
 		&cli.IntFlag{
 			Name:        "ready-timeout",
 			Usage:       "Time to wait (in seconds) before giving up on probing targets to see if they are ready. Set to 0 to wait forever.",
@@ -220,12 +464,43 @@ var flags struct {
 	source         string
 	sourceParam    string
 	targets        cli.StringSlice
+	groups         cli.StringSlice
 	hostHeader     string
 	rate           int
 	concurrency    int
 	duration       int
+	routing        string
+	dispatch       string
+	resolveEvery   int
+	discoveryFile  string
+	discoverySRV   string
+	discoveryEvery int
+	excludeDown    bool
+	baseline       string
+	seqMetric      string
+	seqBaseline    string
+	seqAlpha       float64
+	seqMinEffect   float64
+	seqWindow      int
+	seqMinWindows  int
+	seqMinRequests int
+	seqStop        bool
+	warmUp         int
+	stall          int
+	maxBodySize    int64
+	maxTransfer    int
+	rangeFraction  float64
+	rangeVerify    float64
+	interval       int
+	intervalFile   string
+	probePath      string
+	probeStatus    int
+	probeSuccesses int
 	timings        bool
 	failures       bool
+	failureSamples int
+	failureBodyLen int
+	failureFile    string
 	quiet          bool
 	prometheusAddr string
 	cpuprofile     string
@@ -240,6 +515,11 @@ var flags struct {
 	filter         string
 	preProbeWait   int
 	readyTimeout   int
+
+	coordinatorAddr string
+	workers         int
+	shardBy         string
+	coordinatorURL  string
 }
 
 func main() {
@@ -262,19 +542,106 @@ func Run(cc *cli.Context) error {
 		flags.source = "stdin"
 	}
 
+	failures := loadgen.NewFailureStore(flags.failureSamples, flags.failureBodyLen)
+	if failures != nil && flags.failureFile != "" {
+		defer func() {
+			if err := failures.WriteFile(flags.failureFile); err != nil {
+				fmt.Fprintf(os.Stderr, "write failures: %v\n", err)
+			}
+		}()
+	}
+
+	if flags.prometheusAddr != "" {
+		if err := startPrometheusServer(flags.prometheusAddr, failures); err != nil {
+			return fmt.Errorf("start prometheus: %w", err)
+		}
+	}
+
+	if flags.cpuprofile != "" {
+		defer profile.Start(profile.CPUProfile, profile.ProfileFilename(flags.cpuprofile)).Stop()
+	}
+
+	if flags.memprofile != "" {
+		defer profile.Start(profile.MemProfile, profile.ProfileFilename(flags.memprofile)).Stop()
+	}
+
+	tc := propagation.TraceContext{}
+	otel.SetTextMapPropagator(tc)
+	if err := setTracerProvider(ctx); err != nil {
+		return fmt.Errorf("set tracer provider: %w", err)
+	}
+
+	// Workers take their experiment and requests from the coordinator
+	if flags.coordinatorURL != "" {
+		return runWorker(ctx, flags.coordinatorURL, flags.timings, flags.failures, flags.quiet, flags.interactive, flags.preProbeWait, flags.readyTimeout, intervalLength(cc), failures)
+	}
+
 	// Load the experiment definition or use a default one
-	var expjson ExperimentJSON
+	var expjson loadgen.ExperimentJSON
 	if flags.experimentFile != "" {
 		if err := readExperimentFile(flags.experimentFile, &expjson); err != nil {
 			return fmt.Errorf("read experiment file: %w", err)
 		}
+
+		// experiments written for thunderdome deploy their targets so the urls of
+		// locally run targets and the duration are supplied using flags
+		var urls []string
+		if cc.IsSet("targets") {
+			urls = flags.targets.Value()
+		}
+		if err := loadgen.SetTargetURLs(&expjson, urls); err != nil {
+			return fmt.Errorf("experiment file: %w", err)
+		}
+		if expjson.Duration == 0 {
+			expjson.Duration = flags.duration
+		}
 	} else {
 		expjson.Name = flags.experimentName
-		expjson.Rate = flags.rate
-		expjson.Concurrency = flags.concurrency
+		expjson.MaxRequestRate = flags.rate
+		expjson.MaxConcurrency = flags.concurrency
 		expjson.Duration = flags.duration
+		expjson.Routing = &loadgen.RoutingJSON{Mode: flags.routing}
+		expjson.Dispatch = flags.dispatch
+		expjson.Resolve = flags.resolveEvery
+		if flags.discoveryFile != "" || flags.discoverySRV != "" {
+			expjson.Discovery = &loadgen.DiscoveryJSON{
+				File:     flags.discoveryFile,
+				SRV:      flags.discoverySRV,
+				Interval: flags.discoveryEvery,
+			}
+		}
+		expjson.WarmUp = flags.warmUp
+		expjson.Stall = flags.stall
+		expjson.MaxBodySize = flags.maxBodySize
+		expjson.MaxTransfer = flags.maxTransfer
+		expjson.Ranges = &loadgen.RangesJSON{
+			Fraction: flags.rangeFraction,
+			Verify:   flags.rangeVerify,
+		}
+		if flags.excludeDown {
+			// targets that are down are probed so they are excluded for no longer than needed
+			expjson.Health = &loadgen.HealthJSON{ExcludeDown: true}
+		}
+		expjson.Baseline = flags.baseline
+		if flags.seqMetric != "" {
+			expjson.Sequential = &loadgen.SequentialJSON{
+				Metric:      flags.seqMetric,
+				Baseline:    flags.seqBaseline,
+				Alpha:       flags.seqAlpha,
+				MinEffect:   flags.seqMinEffect,
+				Window:      flags.seqWindow,
+				MinWindows:  flags.seqMinWindows,
+				MinRequests: flags.seqMinRequests,
+				Stop:        flags.seqStop,
+			}
+		}
+		expjson.Probe = &loadgen.ProbeJSON{
+			Path:         flags.probePath,
+			ExpectStatus: flags.probeStatus,
+			Successes:    flags.probeSuccesses,
+		}
 		for _, be := range flags.targets.Value() {
-			bej := &TargetJSON{
+			bej := &loadgen.TargetJSON{
 				BaseURL: be,
 				Host:    flags.hostHeader,
 			}
@@ -286,40 +653,42 @@ func Run(cc *cli.Context) error {
 			}
 			expjson.Targets = append(expjson.Targets, bej)
 		}
+		if err := setTargetGroups(expjson.Targets, flags.groups.Value()); err != nil {
+			return fmt.Errorf("groups: %w", err)
+		}
 	}
 
-	exp, err := newExperiment(&expjson)
+	exp, err := loadgen.NewExperiment(&expjson)
 	if err != nil {
 		return fmt.Errorf("experiment: %w", err)
 	}
 
-	var fltr filter.RequestFilter
-	switch flags.filter {
-	case "all":
-		fltr = filter.NullRequestFilter
-	case "pathonly":
-		fltr = filter.PathRequestFilter
-	case "validpathonly":
-		fltr = filter.ValidPathRequestFilter
-	default:
-		return fmt.Errorf("unsupported filter: %s", flags.filter)
+	// the experiment's filter is used unless one is given explicitly
+	filterSet := cc.IsSet("filter") || expjson.RequestFilter != ""
+	if !cc.IsSet("filter") && expjson.RequestFilter != "" {
+		flags.filter = expjson.RequestFilter
+	}
+
+	fltr, err := filter.New(flags.filter)
+	if err != nil {
+		return fmt.Errorf("filter: %w", err)
 	}
 
 	metricLabels := map[string]string{
 		"experiment": exp.Name,
 		"source":     flags.source,
 	}
-	metrics, err := NewRequestSourceMetrics(metricLabels)
+	metrics, err := loadgen.NewRequestSourceMetrics(metricLabels)
 	if err != nil {
 		return fmt.Errorf("new request source metrics: %w", err)
 	}
 
-	var source RequestSource
+	var source loadgen.RequestSource
 	switch flags.source {
 	case "random":
-		source = NewRandomRequestSource(fltr, metrics, sampleRequests())
+		source = loadgen.NewRandomRequestSource(fltr, metrics, loadgen.SampleRequests())
 	case "nginxlog":
-		source, err = NewNginxLogRequestSource(flags.sourceParam, fltr, metrics)
+		source, err = loadgen.NewNginxLogRequestSource(flags.sourceParam, fltr, metrics)
 		if err != nil {
 			return fmt.Errorf("nginx source: %w", err)
 		}
@@ -332,7 +701,7 @@ func Run(cc *cli.Context) error {
 			Query:    flags.lokiQuery,
 		}
 
-		source, err = NewLokiRequestSource(cfg, fltr, metrics, exp.Rate)
+		source, err = loadgen.NewLokiRequestSource(cfg, fltr, metrics, exp.Rate)
 		if err != nil {
 			return fmt.Errorf("loki source: %w", err)
 		}
@@ -346,62 +715,105 @@ func Run(cc *cli.Context) error {
 			Timeout: 10 * time.Second,
 		})
 
-		cfg := &SQSConfig{
+		cfg := &loadgen.SQSConfig{
 			AWSConfig: awscfg,
 			Queue:     flags.sqsQueue,
 		}
 
-		source, err = NewSQSRequestSource(cfg, fltr, metrics, exp.Rate)
+		source, err = loadgen.NewSQSRequestSource(cfg, fltr, metrics, exp.Rate)
 		if err != nil {
 			return fmt.Errorf("sqs source: %w", err)
 		}
+	case "rpc":
+		// the default filter only allows gateway requests
+		if !filterSet {
+			fltr = filter.RPCRequestFilter
+		}
+		source, err = loadgen.NewRPCRequestSource(flags.sourceParam, fltr, metrics)
+		if err != nil {
+			return fmt.Errorf("rpc source: %w", err)
+		}
 	case "stdin":
-		source = NewStdinRequestSource(fltr, metrics)
+		source = loadgen.NewStdinRequestSource(fltr, metrics)
 	default:
 		return fmt.Errorf("unsupported source: %s", flags.source)
 	}
 
-	if flags.prometheusAddr != "" {
-		if err := startPrometheusServer(flags.prometheusAddr); err != nil {
-			return fmt.Errorf("start prometheus: %w", err)
+	if flags.coordinatorAddr != "" {
+		// workers wait for their targets using the same ready timeout, so the coordinator
+		// allows them that long plus a grace period
+		var readyTimeout time.Duration
+		if flags.readyTimeout > 0 {
+			readyTimeout = time.Duration(flags.preProbeWait+flags.readyTimeout)*time.Second + distribReadyGrace
 		}
+		return runCoordinator(ctx, source, exp, &expjson, flags.coordinatorAddr, flags.workers, flags.shardBy, readyTimeout, !flags.quiet, flags.timings, flags.interactive)
 	}
 
-	if flags.cpuprofile != "" {
-		defer profile.Start(profile.CPUProfile, profile.ProfileFilename(flags.cpuprofile)).Stop()
+	if err := loadgen.TargetsReady(ctx, exp.Targets, flags.quiet, flags.interactive, flags.preProbeWait, flags.readyTimeout); err != nil {
+		return fmt.Errorf("targets ready check: %w", err)
 	}
 
-	if flags.memprofile != "" {
-		defer profile.Start(profile.MemProfile, profile.ProfileFilename(flags.memprofile)).Stop()
-	}
+	var intervalOut *loadgen.IntervalWriter
+	if flags.intervalFile != "" {
+		f, err := os.Create(flags.intervalFile)
+		if err != nil {
+			return fmt.Errorf("create interval file: %w", err)
+		}
+		defer f.Close()
 
-	tc := propagation.TraceContext{}
-	otel.SetTextMapPropagator(tc)
-	if err := setTracerProvider(ctx); err != nil {
-		return fmt.Errorf("set tracer provider: %w", err)
+		format := loadgen.IntervalFormatJSONL
+		if strings.HasSuffix(flags.intervalFile, ".csv") {
+			format = loadgen.IntervalFormatCSV
+		}
+		intervalOut, err = loadgen.NewIntervalWriter(f, format, exp.Name)
+		if err != nil {
+			return fmt.Errorf("interval writer: %w", err)
+		}
 	}
 
-	if err := targetsReady(ctx, exp.Targets, flags.quiet, flags.interactive, flags.preProbeWait, flags.readyTimeout); err != nil {
-		return fmt.Errorf("targets ready check: %w", err)
-	}
+	return nogui(ctx, source, exp, !flags.quiet, flags.timings, flags.failures, flags.interactive, intervalLength(cc), intervalOut, failures)
+}
 
-	return nogui(ctx, source, exp, !flags.quiet, flags.timings, flags.failures, flags.interactive)
+// intervalLength returns the length of each interval in the interval statistics, which
+// defaults to one second in interactive mode.
+func intervalLength(cc *cli.Context) time.Duration {
+	if flags.interactive && !cc.IsSet("interval") {
+		return time.Second
+	}
+	return time.Duration(flags.interval) * time.Second
 }
 
-func readExperimentFile(fname string, exp *ExperimentJSON) error {
-	expf, err := os.Open(fname)
-	if err != nil {
-		return fmt.Errorf("open: %w", err)
+// setTargetGroups assigns targets to the groups given as 'target=group' pairs.
+func setTargetGroups(targets []*loadgen.TargetJSON, groups []string) error {
+	for _, g := range groups {
+		name, group, found := strings.Cut(g, "=")
+		if !found || name == "" || group == "" {
+			return fmt.Errorf("group must be given as target=group: %q", g)
+		}
+		found = false
+		for _, t := range targets {
+			if t.Name == name {
+				t.Group = group
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("target %q not found for group %q", name, group)
+		}
 	}
-	defer expf.Close()
+	return nil
+}
 
-	if err := json.NewDecoder(expf).Decode(exp); err != nil {
-		return fmt.Errorf("parse: %w", err)
+func readExperimentFile(fname string, exp *loadgen.ExperimentJSON) error {
+	ej, err := schema.ReadFile(fname)
+	if err != nil {
+		return err
 	}
+	*exp = *ej
 	return nil
 }
 
-func startPrometheusServer(addr string) error {
+func startPrometheusServer(addr string, failures *loadgen.FailureStore) error {
 	pe, err := prometheus.NewExporter(prometheus.Options{
 		Namespace:  appName,
 		Registerer: prom.DefaultRegisterer,
@@ -417,6 +829,9 @@ func startPrometheusServer(addr string) error {
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", pe)
+	if failures != nil {
+		mux.Handle("/failures", failures)
+	}
 	go func() {
 		http.ListenAndServe(addr, mux)
 	}()
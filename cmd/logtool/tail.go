@@ -61,7 +61,7 @@ var TailCommand = &cli.Command{
 		},
 		&cli.StringFlag{
 			Name:        "filter",
-			Usage:       "Filter to apply to requests from the request source (all, pathonly, validpathonly)",
+			Usage:       "Filter to apply to requests from the request source, either one of all, pathonly, validpathonly, rpconly or a filter expression such as 'method == \"GET\" && path ~ \"^/ipfs/\"'",
 			Value:       "pathonly",
 			Destination: &tailOpts.filter,
 			EnvVars:     []string{"LOGTOOL_FILTER"},
@@ -97,16 +97,9 @@ var tailOpts struct {
 func Tail(cc *cli.Context) error {
 	ctx := cc.Context
 
-	var fltr filter.RequestFilter
-	switch tailOpts.filter {
-	case "all":
-		fltr = filter.NullRequestFilter
-	case "pathonly":
-		fltr = filter.PathRequestFilter
-	case "validpathonly":
-		fltr = filter.ValidPathRequestFilter
-	default:
-		return fmt.Errorf("unsupported filter: %s", tailOpts.filter)
+	fltr, err := filter.New(tailOpts.filter)
+	if err != nil {
+		return fmt.Errorf("filter: %w", err)
 	}
 
 	var output io.Writer
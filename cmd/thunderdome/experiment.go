@@ -2,71 +2,18 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 
 	"github.com/probe-lab/thunderdome/pkg/exp"
+	"github.com/probe-lab/thunderdome/pkg/filter"
 )
 
-type ExperimentJSON struct {
-	Name           string        `json:"name"`
-	Description    string        `json:"description"`
-	MaxRequestRate int           `json:"max_request_rate"` // maximum number of requests per second to send to targets
-	MaxConcurrency int           `json:"max_concurrency"`  // maximum number of concurrent requests to have in flight for each target
-	RequestFilter  string        `json:"request_filter"`   // filter to apply to incoming requests: "none", "pathonly", "validpathonly"
-	Targets        []TargetJSON  `json:"targets"`
-	Shared         *SharedJSON   `json:"shared"` // environment variables and init commands provided to all targets
-	Defaults       *DefaultsJSON `json:"defaults"`
-}
-
-type NVJSON struct {
-	Name  string `json:"name"`
-	Value string `json:"value"`
-}
-
-type TargetJSON struct {
-	Name         string   `json:"name"`
-	Description  string   `json:"description"`
-	InstanceType string   `json:"instance_type,omitempty"` // instance type to use. If empty, DefaultInstanceType will be used instead
-	Environment  []NVJSON `json:"environment,omitempty"`   // additional environment variables
-
-	BaseImage    string       `json:"base_image,omitempty"`
-	BuildFromGit *GitSpecJSON `json:"build_from_git,omitempty"`
-	// Commands that should be added to the container's container.init.d directory
-	// for example: ipfs config --json Swarm.ConnMgr.GracePeriod '"2m"'
-	InitCommands     []string `json:"init_commands,omitempty"`
-	InitCommandsFrom string   `json:"init_commands_from,omitempty"`
-
-	UseImage string `json:"use_image,omitempty"` // docker image to use. If empty, DefaultImage will be used instead. Must be pre-configured for thunderdome.
-}
-
-type DefaultsJSON struct {
-	InstanceType     string       `json:"instance_type,omitempty"` // instance type to use. If empty, DefaultInstanceType will be used instead
-	Environment      []NVJSON     `json:"environment,omitempty"`   // additional environment variables
-	BaseImage        string       `json:"base_image,omitempty"`
-	BuildFromGit     *GitSpecJSON `json:"build_from_git,omitempty"`
-	InitCommands     []string     `json:"init_commands,omitempty"`
-	InitCommandsFrom string       `json:"init_commands_from,omitempty"`
-	UseImage         string       `json:"use_image,omitempty"` // docker image to use. If empty, DefaultImage will be used instead. Must be pre-configured for thunderdome.
-}
-
-type SharedJSON struct {
-	Environment      []NVJSON `json:"environment,omitempty"`
-	InitCommands     []string `json:"init_commands,omitempty"`
-	InitCommandsFrom string   `json:"init_commands_from,omitempty"`
-}
-
-type GitSpecJSON struct {
-	Repo   string `json:"repo,omitempty"`
-	Commit string `json:"commit,omitempty"`
-	Tag    string `json:"tag,omitempty"`
-	Branch string `json:"branch,omitempty"`
-}
-
 // Target name must contain only lowercase letters, numbers and hyphens and must start with a letter
 var reTargetName = regexp.MustCompile(`^[a-z][a-z0-9-]+$`)
 
@@ -91,13 +38,9 @@ func LoadExperiment(ctx context.Context, filename string) (*exp.Experiment, erro
 }
 
 func ParseExperiment(ctx context.Context, r io.Reader, baseDir string) (*exp.Experiment, error) {
-	ej := new(ExperimentJSON)
-
-	dec := json.NewDecoder(r)
-	dec.DisallowUnknownFields()
-
-	if err := dec.Decode(ej); err != nil {
-		return nil, fmt.Errorf("json decode: %w", err)
+	ej, err := exp.Decode(r)
+	if err != nil {
+		return nil, err
 	}
 
 	if !reExperimentName.MatchString(ej.Name) {
@@ -120,14 +63,16 @@ func ParseExperiment(ctx context.Context, r io.Reader, baseDir string) (*exp.Exp
 		return nil, fmt.Errorf("max concurrency must be a positive number")
 	}
 
-	switch ej.RequestFilter {
-	case "none", "pathonly", "validpathonly":
-		e.RequestFilter = ej.RequestFilter
-	default:
-		return nil, fmt.Errorf("unsupported request filter")
+	if _, err := filter.New(ej.RequestFilter); err != nil {
+		return nil, fmt.Errorf("unsupported request filter: %w", err)
+	}
+	e.RequestFilter = ej.RequestFilter
+
+	if err := checkDealgoodOnlyFields(ej); err != nil {
+		return nil, err
 	}
 
-	if ej.Shared.InitCommandsFrom != "" {
+	if ej.Shared != nil && ej.Shared.InitCommandsFrom != "" {
 		if len(ej.Shared.InitCommands) > 0 {
 			return nil, fmt.Errorf("cannot specify both init_commands and init_commands_from for target shared config")
 		}
@@ -140,7 +85,7 @@ func ParseExperiment(ctx context.Context, r io.Reader, baseDir string) (*exp.Exp
 		ej.Shared.InitCommands = []string{string(content)}
 	}
 
-	if ej.Defaults.InitCommandsFrom != "" {
+	if ej.Defaults != nil && ej.Defaults.InitCommandsFrom != "" {
 		if len(ej.Defaults.InitCommands) > 0 {
 			return nil, fmt.Errorf("cannot specify both init_commands and init_commands_from for target default config")
 		}
@@ -162,6 +107,7 @@ func ParseExperiment(ctx context.Context, r io.Reader, baseDir string) (*exp.Exp
 		} else {
 			return nil, fmt.Errorf("name must be supplied for target %d", i+1)
 		}
+		t.Group = tj.Group
 
 		if tj.InitCommandsFrom != "" {
 			if len(tj.InitCommands) > 0 {
@@ -184,6 +130,10 @@ func ParseExperiment(ctx context.Context, r io.Reader, baseDir string) (*exp.Exp
 			return nil, fmt.Errorf("target name must start with a letter and contain only lowercase letters, numbers and hyphens: %q", t.Name)
 		}
 
+		if t.Group != "" && !reTargetName.MatchString(t.Group) {
+			return nil, fmt.Errorf("target group must start with a letter and contain only lowercase letters, numbers and hyphens: %q", t.Group)
+		}
+
 		if tj.InstanceType != "" {
 			t.InstanceType = tj.InstanceType
 		} else if ej.Defaults != nil && ej.Defaults.InstanceType != "" {
@@ -283,9 +233,71 @@ func ParseExperiment(ctx context.Context, r io.Reader, baseDir string) (*exp.Exp
 		e.Targets = append(e.Targets, t)
 	}
 
+	if ej.Baseline != "" {
+		if !uniqueNames[ej.Baseline] {
+			return nil, fmt.Errorf("baseline %q is not the name of a target", ej.Baseline)
+		}
+		e.Baseline = ej.Baseline
+	}
+
+	if ej.Sequential != nil {
+		if !slices.Contains(exp.SequentialMetrics, ej.Sequential.Metric) {
+			return nil, fmt.Errorf("unsupported sequential test metric %q", ej.Sequential.Metric)
+		}
+		if ej.Sequential.Baseline != "" && !uniqueNames[ej.Sequential.Baseline] {
+			return nil, fmt.Errorf("sequential test baseline %q is not the name of a target", ej.Sequential.Baseline)
+		}
+		e.Sequential = ej.Sequential
+	}
+
 	return e, nil
 }
 
+// checkDealgoodOnlyFields rejects experiment fields that are only understood by dealgood
+// when it is given the experiment file directly. The dealgood deployed by thunderdome is
+// configured using environment variables that do not carry these settings, so they would
+// otherwise be silently ignored.
+func checkDealgoodOnlyFields(ej *exp.ExperimentJSON) error {
+	set := map[string]bool{
+		"warm_up":           ej.WarmUp != 0,
+		"stall":             ej.Stall != 0,
+		"max_body_size":     ej.MaxBodySize != 0,
+		"max_transfer_time": ej.MaxTransfer != 0,
+		"ranges":            ej.Ranges != nil,
+		"rewrite":           len(ej.Rewrite) > 0,
+		"routing":           ej.Routing != nil,
+		"dispatch":          ej.Dispatch != "",
+		"health":            ej.Health != nil,
+		"probe":             ej.Probe != nil,
+		"resolve_interval":  ej.Resolve != 0,
+		"discovery":         ej.Discovery != nil,
+	}
+	for _, name := range slices.Sorted(maps.Keys(set)) {
+		if set[name] {
+			return fmt.Errorf("%s is only supported when running dealgood with the experiment file and is not supported by thunderdome", name)
+		}
+	}
+
+	for i, tj := range ej.Targets {
+		set := map[string]bool{
+			"base_url": tj.BaseURL != "",
+			"host":     tj.Host != "",
+			"rewrite":  len(tj.Rewrite) > 0,
+			"weight":   tj.Weight != 0,
+			"probe":    tj.Probe != nil,
+			"headers":  len(tj.Headers) > 0,
+			"auth":     tj.Auth != nil,
+			"tls":      tj.TLS != nil,
+		}
+		for _, name := range slices.Sorted(maps.Keys(set)) {
+			if set[name] {
+				return fmt.Errorf("%s in target %d is only supported when running dealgood with the experiment file and is not supported by thunderdome", name, i+1)
+			}
+		}
+	}
+	return nil
+}
+
 // nonEmptyCount returns the number the passed strings that are not empty
 func nonEmptyCount(strs ...string) int {
 	nonEmpty := 0
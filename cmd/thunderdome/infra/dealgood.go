@@ -16,6 +16,7 @@ import (
 	"golang.org/x/exp/slog"
 
 	"github.com/probe-lab/thunderdome/cmd/ironbar/api"
+	"github.com/probe-lab/thunderdome/pkg/exp"
 )
 
 type Dealgood struct {
@@ -86,6 +87,43 @@ func (d *Dealgood) WithRequestFilter(v string) *Dealgood {
 	return d
 }
 
+func (d *Dealgood) WithBaseline(v string) *Dealgood {
+	d.environment["DEALGOOD_BASELINE"] = v
+	return d
+}
+
+// WithSequential configures dealgood to run a sequential test comparing the targets
+// with a baseline. A nil test leaves it disabled.
+func (d *Dealgood) WithSequential(sj *exp.SequentialJSON) *Dealgood {
+	if sj == nil {
+		return d
+	}
+	d.environment["DEALGOOD_SEQUENTIAL_METRIC"] = sj.Metric
+	d.environment["DEALGOOD_SEQUENTIAL_BASELINE"] = sj.Baseline
+	d.environment["DEALGOOD_SEQUENTIAL_ALPHA"] = strconv.FormatFloat(sj.Alpha, 'g', -1, 64)
+	d.environment["DEALGOOD_SEQUENTIAL_MIN_EFFECT"] = strconv.FormatFloat(sj.MinEffect, 'g', -1, 64)
+	d.environment["DEALGOOD_SEQUENTIAL_WINDOW"] = strconv.Itoa(sj.Window)
+	d.environment["DEALGOOD_SEQUENTIAL_MIN_WINDOWS"] = strconv.Itoa(sj.MinWindows)
+	d.environment["DEALGOOD_SEQUENTIAL_MIN_REQUESTS"] = strconv.Itoa(sj.MinRequests)
+	d.environment["DEALGOOD_SEQUENTIAL_STOP"] = strconv.FormatBool(sj.Stop)
+	return d
+}
+
+// WithGroups tells dealgood which replica group each target belongs to so it can report
+// statistics for each group. Targets without a group are left out.
+func (d *Dealgood) WithGroups(specs []*exp.TargetSpec) *Dealgood {
+	groups := make([]string, 0, len(specs))
+	for _, t := range specs {
+		if t.Group != "" {
+			groups = append(groups, t.Name+"="+t.Group)
+		}
+	}
+	if len(groups) > 0 {
+		d.environment["DEALGOOD_GROUPS"] = strings.Join(groups, ",")
+	}
+	return d
+}
+
 func (d *Dealgood) WithTargets(targets []*Target) *Dealgood {
 	targetURLs := make([]string, len(targets))
 	for i := range targets {
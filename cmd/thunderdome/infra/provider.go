@@ -80,9 +80,12 @@ func (p *Provider) Deploy(ctx context.Context, e *exp.Experiment, forceBuild boo
 
 	d := NewDealgood(e.Name, base).
 		WithTargets(targets).
+		WithGroups(e.Targets).
 		WithMaxRequestRate(e.MaxRequestRate).
 		WithMaxConcurrency(e.MaxConcurrency).
-		WithRequestFilter(e.RequestFilter)
+		WithRequestFilter(e.RequestFilter).
+		WithBaseline(e.Baseline).
+		WithSequential(e.Sequential)
 
 	if err := d.Setup(ctx); err != nil {
 		return fmt.Errorf("failed to setup dealgood: %w", err)
@@ -47,10 +47,30 @@ func Validate(cc *cli.Context) error {
 	fmt.Printf("Maximum request rate:        %d\n", e.MaxRequestRate)
 	fmt.Printf("Maximum concurrent requests: %d\n", e.MaxConcurrency)
 	fmt.Printf("Request filter:              %s\n", e.RequestFilter)
+	if e.Baseline != "" {
+		fmt.Printf("Baseline:                    %s\n", e.Baseline)
+	}
+	if seq := e.Sequential; seq != nil {
+		baseline := seq.Baseline
+		if baseline == "" {
+			baseline = e.Baseline
+		}
+		if baseline == "" && len(e.Targets) > 0 {
+			baseline = e.Targets[0].Name
+		}
+		fmt.Printf("Sequential test:             %s against %s", seq.Metric, baseline)
+		if seq.Stop {
+			fmt.Printf(", stopping dealgood when decided")
+		}
+		fmt.Println()
+	}
 
 	for _, t := range e.Targets {
 		fmt.Println()
 		fmt.Printf("Target %q\n", t.Name)
+		if t.Group != "" {
+			fmt.Printf("  Group:         %s\n", t.Group)
+		}
 		fmt.Printf("  Instance type: %s\n", t.InstanceType)
 
 		if t.Image != "" {
@@ -15,12 +15,15 @@ type Experiment struct {
 	MaxRequestRate int
 	MaxConcurrency int
 	RequestFilter  string
+	Baseline       string          // name of the target the others are compared with, empty if there is none
+	Sequential     *SequentialJSON // sequential test run by dealgood, nil if disabled
 
 	Targets []*TargetSpec
 }
 
 type TargetSpec struct {
 	Name         string
+	Group        string // name of the group of identical replicas the target belongs to, empty if it is not a replica
 	Image        string
 	ImageSpec    *ImageSpec
 	InstanceType string
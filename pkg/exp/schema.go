@@ -0,0 +1,231 @@
+package exp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SchemaVersion is the current version of the experiment file schema. Files that do not
+// specify a version are treated as being the current version.
+const SchemaVersion = 1
+
+// ExperimentJSON is the experiment file schema read by both thunderdome and dealgood. Thunderdome
+// uses the image and instance settings of targets to deploy them while dealgood uses the
+// load settings and the base URL of each target to send requests to them.
+type ExperimentJSON struct {
+	Version        int    `json:"version,omitempty"` // version of the schema the file was written for
+	Name           string `json:"name"`
+	Description    string `json:"description,omitempty"`
+	MaxRequestRate int    `json:"max_request_rate"`         // maximum number of requests per second to send to targets
+	MaxConcurrency int    `json:"max_concurrency"`          // maximum number of concurrent requests to have in flight for each target
+	RequestFilter  string `json:"request_filter,omitempty"` // filter to apply to incoming requests: "none", "pathonly", "validpathonly", "rpconly" or a filter expression
+	Duration       int    `json:"duration,omitempty"`       // suggested duration of the experiment in seconds
+
+	Rate        int `json:"rate,omitempty"`        // deprecated name for max_request_rate used by earlier dealgood experiment files
+	Concurrency int `json:"concurrency,omitempty"` // deprecated name for max_concurrency used by earlier dealgood experiment files
+
+	WarmUp      int                `json:"warm_up,omitempty"`           // seconds at the start of the experiment during which requests are sent but excluded from statistics, in addition to the duration
+	Stall       int                `json:"stall,omitempty"`             // seconds that reading a response body may pause before the transfer is considered stalled, defaults to 5
+	MaxBodySize int64              `json:"max_body_size,omitempty"`     // maximum number of bytes to read from each response body before aborting the request, defaults to no limit
+	MaxTransfer int                `json:"max_transfer_time,omitempty"` // maximum seconds to spend reading each response body before aborting the request, defaults to no limit
+	Ranges      *RangesJSON        `json:"ranges,omitempty"`            // how Range headers are added to requests, defaults to never
+	Rewrite     []*RewriteRuleJSON `json:"rewrite,omitempty"`           // rules used to modify requests before they are sent to any target
+	Routing     *RoutingJSON       `json:"routing,omitempty"`           // how requests are distributed to targets, defaults to sending every request to every target
+	Dispatch    string             `json:"dispatch,omitempty"`          // how each request is handed to its targets: random or barrier, defaults to random
+	Health      *HealthJSON        `json:"health,omitempty"`            // how target health is tracked
+	Probe       *ProbeJSON         `json:"probe,omitempty"`             // how targets are probed to check they are ready, defaults to expecting any response to a request for /
+	Resolve     int                `json:"resolve_interval,omitempty"`  // seconds between refreshing the addresses each target's host resolves to, defaults to 60, -1 disables refreshing
+	Discovery   *DiscoveryJSON     `json:"discovery,omitempty"`         // how targets are added and removed while the experiment runs, defaults to fixed targets
+	Baseline    string             `json:"baseline,omitempty"`          // name of the target the others are compared with in live metrics and reports, its group is the baseline for comparing replica groups
+	Sequential  *SequentialJSON    `json:"sequential,omitempty"`        // sequential test comparing each target with a baseline, which can end the experiment early
+
+	Targets  []*TargetJSON `json:"targets"`
+	Shared   *SharedJSON   `json:"shared,omitempty"` // environment variables and init commands provided to all targets
+	Defaults *DefaultsJSON `json:"defaults,omitempty"`
+}
+
+type TargetJSON struct {
+	Name        string `json:"name"`                  // short name of the target to be used in reports
+	Description string `json:"description,omitempty"` // free form description of the target
+	Group       string `json:"group,omitempty"`       // name of the group of identical replicas the target belongs to, used to report statistics for the group as a whole
+
+	InstanceType string   `json:"instance_type,omitempty"` // instance type to use. If empty, DefaultInstanceType will be used instead
+	Environment  []NVJSON `json:"environment,omitempty"`   // additional environment variables
+
+	BaseImage    string       `json:"base_image,omitempty"`
+	BuildFromGit *GitSpecJSON `json:"build_from_git,omitempty"`
+	// Commands that should be added to the container's container.init.d directory
+	// for example: ipfs config --json Swarm.ConnMgr.GracePeriod '"2m"'
+	InitCommands     []string `json:"init_commands,omitempty"`
+	InitCommandsFrom string   `json:"init_commands_from,omitempty"`
+
+	UseImage string `json:"use_image,omitempty"` // docker image to use. If empty, DefaultImage will be used instead. Must be pre-configured for thunderdome.
+
+	BaseURL string             `json:"base_url,omitempty"` // base URL of the target, any path is used as a prefix for the path of every request
+	Host    string             `json:"host,omitempty"`     // An optional hostname to be sent as a Host header in requests
+	Rewrite []*RewriteRuleJSON `json:"rewrite,omitempty"`  // rules used to modify requests sent to this target, applied after the experiment's rules
+	Weight  int                `json:"weight,omitempty"`   // relative share of requests the target receives when using hash or split routing, defaults to 1
+	Probe   *ProbeJSON         `json:"probe,omitempty"`    // overrides the experiment's probe for this target
+	Headers map[string]string  `json:"headers,omitempty"`  // extra headers sent with every request to the target
+	Auth    *AuthJSON          `json:"auth,omitempty"`     // credentials sent with every request to the target
+	TLS     *TLSJSON           `json:"tls,omitempty"`      // how connections to the target are secured when using https
+}
+
+type NVJSON struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type DefaultsJSON struct {
+	InstanceType     string       `json:"instance_type,omitempty"` // instance type to use. If empty, DefaultInstanceType will be used instead
+	Environment      []NVJSON     `json:"environment,omitempty"`   // additional environment variables
+	BaseImage        string       `json:"base_image,omitempty"`
+	BuildFromGit     *GitSpecJSON `json:"build_from_git,omitempty"`
+	InitCommands     []string     `json:"init_commands,omitempty"`
+	InitCommandsFrom string       `json:"init_commands_from,omitempty"`
+	UseImage         string       `json:"use_image,omitempty"` // docker image to use. If empty, DefaultImage will be used instead. Must be pre-configured for thunderdome.
+}
+
+type SharedJSON struct {
+	Environment      []NVJSON `json:"environment,omitempty"`
+	InitCommands     []string `json:"init_commands,omitempty"`
+	InitCommandsFrom string   `json:"init_commands_from,omitempty"`
+}
+
+type GitSpecJSON struct {
+	Repo   string `json:"repo,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+	Branch string `json:"branch,omitempty"`
+}
+
+type RangesJSON struct {
+	Fraction  float64 `json:"fraction"`             // fraction of GET requests for /ipfs/ and /ipns/ paths that are given a Range header
+	Single    int     `json:"single,omitempty"`     // relative weight of single ranges such as bytes=100-199
+	Suffix    int     `json:"suffix,omitempty"`     // relative weight of suffix ranges such as bytes=-500
+	Multi     int     `json:"multi,omitempty"`      // relative weight of multiple ranges such as bytes=0-99,200-299, the weights default to being equal
+	MaxOffset int64   `json:"max_offset,omitempty"` // largest offset that a generated range starts at, defaults to 1MiB
+	MaxLength int64   `json:"max_length,omitempty"` // largest length of each generated range, defaults to 256KiB
+	Verify    float64 `json:"verify,omitempty"`     // fraction of partial responses whose bytes are compared with a fetch of the full body
+}
+
+type RewriteRuleJSON struct {
+	Action  string `json:"action"`            // one of set_header, add_header, remove_header, rewrite_path, set_query, add_query, remove_query, map_host
+	Name    string `json:"name,omitempty"`    // name of the header or query parameter
+	Value   string `json:"value,omitempty"`   // value of the header or query parameter, or the new host for map_host
+	Match   string `json:"match,omitempty"`   // regular expression to match against the path for rewrite_path, or the host to be replaced for map_host (empty matches any host)
+	Replace string `json:"replace,omitempty"` // replacement for the matched path, may refer to submatches using $1 etc
+}
+
+type RoutingJSON struct {
+	Mode       string  `json:"mode"`                  // broadcast (default), hash, split or mirror
+	Replicas   int     `json:"replicas,omitempty"`    // number of targets each request is sent to when using hash routing, defaults to 1
+	Primary    string  `json:"primary,omitempty"`     // name of the primary target when using mirror routing, defaults to the first target
+	MirrorRate float64 `json:"mirror_rate,omitempty"` // fraction of requests that are mirrored to shadows when using mirror routing, defaults to 1
+}
+
+type HealthJSON struct {
+	FailingAfter  int  `json:"failing_after,omitempty"`  // number of consecutive failures before a target is considered failing, defaults to 3
+	DownAfter     int  `json:"down_after,omitempty"`     // number of consecutive failures before a target is considered down, defaults to 20
+	RecoverAfter  int  `json:"recover_after,omitempty"`  // number of consecutive successes before a recovering target is considered healthy, defaults to 5
+	ProbeInterval int  `json:"probe_interval,omitempty"` // seconds between active probes of targets that are not healthy, defaults to 5, targets are only probed when health is given
+	ExcludeDown   bool `json:"exclude_down,omitempty"`   // exclude requests sent while a target is down from the target's statistics
+}
+
+type ProbeJSON struct {
+	Path         string `json:"path,omitempty"`          // path and query of the request used to probe targets, defaults to /
+	ExpectStatus int    `json:"expect_status,omitempty"` // status code a probe must receive to succeed, defaults to accepting any response
+	Successes    int    `json:"successes,omitempty"`     // number of consecutive successful probes before a target is considered ready, defaults to 1
+	Timeout      int    `json:"timeout,omitempty"`       // seconds to wait for a response to a probe, defaults to 2
+	Interval     int    `json:"interval,omitempty"`      // seconds between probes while waiting for targets to be ready, defaults to 5
+}
+
+type DiscoveryJSON struct {
+	File     string `json:"file,omitempty"`     // path of a JSON file holding a list of targets, checked for changes at every interval
+	SRV      string `json:"srv,omitempty"`      // DNS name whose SRV records give the host and port of each target
+	Scheme   string `json:"scheme,omitempty"`   // URL scheme used for targets discovered from SRV records, defaults to http
+	Interval int    `json:"interval,omitempty"` // seconds between checking for changes to the targets, defaults to 10
+}
+
+// SequentialMetrics are the metrics that may be compared by a sequential test.
+var SequentialMetrics = []string{
+	"ttfb_p50", "ttfb_p90", "ttfb_p99", "ttfb_mean",
+	"total_time_p50", "total_time_p90", "total_time_p99", "total_time_mean",
+	"error_rate",
+}
+
+type SequentialJSON struct {
+	Metric      string  `json:"metric"`                 // metric compared with the baseline: ttfb_p50, ttfb_p90, ttfb_p99, ttfb_mean, total_time_p50, total_time_p90, total_time_p99, total_time_mean or error_rate
+	Baseline    string  `json:"baseline,omitempty"`     // name of the target the others are compared with, defaults to the experiment's baseline or the first target
+	Alpha       float64 `json:"alpha,omitempty"`        // probability of declaring a difference when there is none, defaults to 0.05
+	MinEffect   float64 `json:"min_effect,omitempty"`   // smallest difference worth detecting, a fraction of the baseline for times and an absolute difference for error_rate, defaults to 0.05 and 0.01
+	Window      int     `json:"window,omitempty"`       // seconds of requests summarised by each observation of the metric, defaults to 60
+	MinWindows  int     `json:"min_windows,omitempty"`  // number of windows observed before a verdict may be declared, defaults to 5
+	MinRequests int     `json:"min_requests,omitempty"` // number of measurements of a target needed in a window for it to be used, defaults to 20
+	Stop        bool    `json:"stop,omitempty"`         // stop sending requests once every target has a verdict
+}
+
+// Values of auth settings and extra headers have environment variables expanded so
+// that secrets need not be written into experiment files.
+
+type AuthJSON struct {
+	Bearer   string `json:"bearer,omitempty"`   // token sent in the Authorization header as a bearer token
+	Username string `json:"username,omitempty"` // user name sent in the Authorization header using basic authentication
+	Password string `json:"password,omitempty"` // password sent in the Authorization header using basic authentication
+}
+
+type TLSJSON struct {
+	Verify     bool   `json:"verify,omitempty"`      // verify the certificate presented by the target, defaults to false since targets commonly use self-signed certificates
+	CAFile     string `json:"ca_file,omitempty"`     // PEM file of the CA certificates used to verify the target's certificate, implies verify
+	CertFile   string `json:"cert_file,omitempty"`   // PEM file of the client certificate presented to the target
+	KeyFile    string `json:"key_file,omitempty"`    // PEM file of the private key of the client certificate
+	ServerName string `json:"server_name,omitempty"` // name sent using SNI and used to verify the target's certificate, defaults to the target's host name
+}
+
+// Decode reads an experiment definition, rejecting any unknown fields. The deprecated
+// rate and concurrency fields are moved to max_request_rate and max_concurrency.
+func Decode(r io.Reader) (*ExperimentJSON, error) {
+	ej := new(ExperimentJSON)
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(ej); err != nil {
+		return nil, fmt.Errorf("json decode: %w", err)
+	}
+
+	if ej.Version < 0 || ej.Version > SchemaVersion {
+		return nil, fmt.Errorf("unsupported schema version %d, this version of thunderdome supports up to version %d", ej.Version, SchemaVersion)
+	}
+	ej.Version = SchemaVersion
+
+	if ej.Rate != 0 {
+		if ej.MaxRequestRate != 0 {
+			return nil, fmt.Errorf("must not specify both rate and max_request_rate")
+		}
+		ej.MaxRequestRate = ej.Rate
+		ej.Rate = 0
+	}
+	if ej.Concurrency != 0 {
+		if ej.MaxConcurrency != 0 {
+			return nil, fmt.Errorf("must not specify both concurrency and max_concurrency")
+		}
+		ej.MaxConcurrency = ej.Concurrency
+		ej.Concurrency = 0
+	}
+
+	return ej, nil
+}
+
+// ReadFile reads an experiment definition from the named file.
+func ReadFile(fname string) (*ExperimentJSON, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	return Decode(f)
+}
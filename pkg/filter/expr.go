@@ -0,0 +1,387 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/probe-lab/thunderdome/pkg/request"
+)
+
+// namedFilters are the predefined filters that may be referred to by name, either
+// on their own or as terms within a filter expression.
+var namedFilters = map[string]RequestFilter{
+	"all":           NullRequestFilter,
+	"none":          NullRequestFilter, // alias used by experiment files
+	"pathonly":      PathRequestFilter,
+	"validpathonly": ValidPathRequestFilter,
+	"rpconly":       RPCRequestFilter,
+}
+
+// New returns a RequestFilter for the given specification which may be the name of
+// one of the predefined filters (all, none, pathonly, validpathonly, rpconly) or a filter expression.
+//
+// A filter expression is made up of comparisons combined with the boolean operators
+// && (and), || (or) and ! (not). Parentheses may be used for grouping. A comparison
+// has the form field op value where field is one of:
+//
+//	method, uri, path, query, status, agent, referer, remote_addr, header.<Name>
+//
+// and op is one of == and != for exact comparison, ~ and !~ for regular expression
+// matching or <, <=, > and >= for numeric comparison against the status field.
+// String values must be double quoted, status values are integers. The names of the
+// predefined filters may also be used as terms. For example:
+//
+//	method == "GET" && path ~ "^/ipfs/" && status == 200 && !agent ~ "bot"
+func New(spec string) (RequestFilter, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, fmt.Errorf("empty filter")
+	}
+	if f, ok := namedFilters[spec]; ok {
+		return f, nil
+	}
+
+	p := &parser{lex: &lexer{input: spec}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", p.tok, p.tok.pos)
+	}
+	return f, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of filter"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+type lexer struct {
+	input string
+	pos   int
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) {
+		l.pos++
+	}
+	if l.pos >= len(l.input) {
+		return token{kind: tokEOF, pos: l.pos}, nil
+	}
+
+	start := l.pos
+	c := l.input[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return token{kind: tokLParen, text: "(", pos: start}, nil
+	case c == ')':
+		l.pos++
+		return token{kind: tokRParen, text: ")", pos: start}, nil
+	case c == '"':
+		l.pos++
+		var sb strings.Builder
+		for l.pos < len(l.input) {
+			c := l.input[l.pos]
+			switch c {
+			case '\\':
+				if l.pos+1 >= len(l.input) {
+					return token{}, fmt.Errorf("unterminated string at position %d", start)
+				}
+				sb.WriteByte(l.input[l.pos+1])
+				l.pos += 2
+			case '"':
+				l.pos++
+				return token{kind: tokString, text: sb.String(), pos: start}, nil
+			default:
+				sb.WriteByte(c)
+				l.pos++
+			}
+		}
+		return token{}, fmt.Errorf("unterminated string at position %d", start)
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.input) && l.input[l.pos] >= '0' && l.input[l.pos] <= '9' {
+			l.pos++
+		}
+		return token{kind: tokNumber, text: l.input[start:l.pos], pos: start}, nil
+	case isIdentStart(c):
+		for l.pos < len(l.input) && isIdentPart(l.input[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.input[start:l.pos], pos: start}, nil
+	}
+
+	for _, op := range []string{"&&", "||", "==", "!=", "!~", "<=", ">=", "~", "!", "<", ">"} {
+		if strings.HasPrefix(l.input[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, pos: start}, nil
+		}
+	}
+
+	return token{}, fmt.Errorf("unexpected character %q at position %d", c, start)
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9') || c == '.' || c == '-'
+}
+
+type parser struct {
+	lex *lexer
+	tok token
+}
+
+func (p *parser) next() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) isOp(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+func (p *parser) parseOr() (RequestFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(req *request.Request) bool {
+			return l(req) || right(req)
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (RequestFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(req *request.Request) bool {
+			return l(req) && right(req)
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (RequestFilter, error) {
+	if p.isOp("!") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(req *request.Request) bool {
+			return !f(req)
+		}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (RequestFilter, error) {
+	switch p.tok.kind {
+	case tokLParen:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, fmt.Errorf("expected \")\" but found %s at position %d", p.tok, p.tok.pos)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		return f, nil
+	case tokIdent:
+		return p.parseComparison()
+	default:
+		return nil, fmt.Errorf("unexpected %s at position %d", p.tok, p.tok.pos)
+	}
+}
+
+func (p *parser) parseComparison() (RequestFilter, error) {
+	field := p.tok
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokOp || p.isOp("&&") || p.isOp("||") || p.isOp("!") {
+		// A bare identifier must refer to one of the predefined filters
+		if f, ok := namedFilters[field.text]; ok {
+			return f, nil
+		}
+		return nil, fmt.Errorf("expected comparison operator after %s at position %d", field, field.pos)
+	}
+	op := p.tok
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	value := p.tok
+	if value.kind != tokString && value.kind != tokNumber {
+		return nil, fmt.Errorf("expected value after %s but found %s at position %d", op, value, value.pos)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if field.text == "status" {
+		return numericComparison(field, op, value)
+	}
+
+	getter, err := stringField(field)
+	if err != nil {
+		return nil, err
+	}
+	return stringComparison(getter, op, value)
+}
+
+func stringField(field token) (func(*request.Request) string, error) {
+	switch field.text {
+	case "method":
+		return func(req *request.Request) string { return req.Method }, nil
+	case "uri":
+		return func(req *request.Request) string { return req.URI }, nil
+	case "path":
+		return func(req *request.Request) string {
+			path, _, _ := strings.Cut(req.URI, "?")
+			return path
+		}, nil
+	case "query":
+		return func(req *request.Request) string {
+			_, query, _ := strings.Cut(req.URI, "?")
+			return query
+		}, nil
+	case "agent":
+		return func(req *request.Request) string { return req.UserAgent }, nil
+	case "referer":
+		return func(req *request.Request) string { return req.Referer }, nil
+	case "remote_addr":
+		return func(req *request.Request) string { return req.RemoteAddr }, nil
+	}
+
+	if name, ok := strings.CutPrefix(field.text, "header."); ok && name != "" {
+		return func(req *request.Request) string {
+			for k, v := range req.Header {
+				if strings.EqualFold(k, name) {
+					return v
+				}
+			}
+			return ""
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown field %s at position %d", field, field.pos)
+}
+
+func stringComparison(getter func(*request.Request) string, op token, value token) (RequestFilter, error) {
+	if value.kind != tokString {
+		return nil, fmt.Errorf("expected string value but found %s at position %d", value, value.pos)
+	}
+	s := value.text
+
+	switch op.text {
+	case "==":
+		return func(req *request.Request) bool { return getter(req) == s }, nil
+	case "!=":
+		return func(req *request.Request) bool { return getter(req) != s }, nil
+	case "~", "!~":
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression at position %d: %w", value.pos, err)
+		}
+		if op.text == "!~" {
+			return func(req *request.Request) bool { return !re.MatchString(getter(req)) }, nil
+		}
+		return func(req *request.Request) bool { return re.MatchString(getter(req)) }, nil
+	default:
+		return nil, fmt.Errorf("operator %s at position %d is not supported for string fields", op, op.pos)
+	}
+}
+
+func numericComparison(field token, op token, value token) (RequestFilter, error) {
+	if value.kind != tokNumber {
+		return nil, fmt.Errorf("expected numeric value for %s but found %s at position %d", field, value, value.pos)
+	}
+	n, err := strconv.Atoi(value.text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number at position %d: %w", value.pos, err)
+	}
+
+	switch op.text {
+	case "==":
+		return func(req *request.Request) bool { return req.Status == n }, nil
+	case "!=":
+		return func(req *request.Request) bool { return req.Status != n }, nil
+	case "<":
+		return func(req *request.Request) bool { return req.Status < n }, nil
+	case "<=":
+		return func(req *request.Request) bool { return req.Status <= n }, nil
+	case ">":
+		return func(req *request.Request) bool { return req.Status > n }, nil
+	case ">=":
+		return func(req *request.Request) bool { return req.Status >= n }, nil
+	default:
+		return nil, fmt.Errorf("operator %s at position %d is not supported for numeric fields", op, op.pos)
+	}
+}
@@ -0,0 +1,143 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/probe-lab/thunderdome/pkg/request"
+)
+
+const testCID = "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"
+
+func TestNew(t *testing.T) {
+	get := &request.Request{
+		Method:     "GET",
+		URI:        "/ipfs/" + testCID + "/readme.txt?format=raw",
+		Status:     200,
+		UserAgent:  "Mozilla/5.0",
+		Referer:    "https://example.com/",
+		RemoteAddr: "10.0.0.1",
+		Header:     map[string]string{"Accept": "application/vnd.ipld.raw", "X-Forwarded-For": "192.0.2.1"},
+	}
+	bot := &request.Request{
+		Method:    "GET",
+		URI:       "/ipns/example.com/",
+		Status:    404,
+		UserAgent: "Googlebot/2.1",
+	}
+	rpc := &request.Request{
+		Method: "POST",
+		URI:    "/api/v0/version",
+		Status: 500,
+	}
+	invalid := &request.Request{
+		Method: "GET",
+		URI:    "/ipfs/notacid",
+		Status: 400,
+	}
+	requests := []*request.Request{get, bot, rpc, invalid}
+
+	testCases := []struct {
+		name string
+		spec string
+		want []*request.Request // requests that pass the filter
+	}{
+		{name: "all", spec: "all", want: requests},
+		{name: "none alias", spec: "none", want: requests},
+		{name: "named with spaces", spec: "  pathonly  ", want: []*request.Request{get, bot, invalid}},
+		{name: "validpathonly", spec: "validpathonly", want: []*request.Request{get, bot}},
+		{name: "rpconly", spec: "rpconly", want: []*request.Request{rpc}},
+
+		{name: "method equal", spec: `method == "GET"`, want: []*request.Request{get, bot, invalid}},
+		{name: "method not equal", spec: `method != "GET"`, want: []*request.Request{rpc}},
+		{name: "uri", spec: `uri == "/api/v0/version"`, want: []*request.Request{rpc}},
+		{name: "path excludes query", spec: `path ~ "readme.txt$"`, want: []*request.Request{get}},
+		{name: "query", spec: `query == "format=raw"`, want: []*request.Request{get}},
+		{name: "empty query", spec: `query == ""`, want: []*request.Request{bot, rpc, invalid}},
+		{name: "agent regex", spec: `agent ~ "(?i)bot"`, want: []*request.Request{bot}},
+		{name: "agent not regex", spec: `agent !~ "bot"`, want: []*request.Request{get, rpc, invalid}},
+		{name: "referer", spec: `referer == "https://example.com/"`, want: []*request.Request{get}},
+		{name: "remote addr", spec: `remote_addr == "10.0.0.1"`, want: []*request.Request{get}},
+		{name: "escaped quote", spec: `agent != "say \"hi\""`, want: requests},
+
+		{name: "header", spec: `header.Accept == "application/vnd.ipld.raw"`, want: []*request.Request{get}},
+		{name: "header case insensitive", spec: `header.x-forwarded-for ~ "^192\\."`, want: []*request.Request{get}},
+		{name: "missing header is empty", spec: `header.Accept == ""`, want: []*request.Request{bot, rpc, invalid}},
+
+		{name: "status equal", spec: "status == 200", want: []*request.Request{get}},
+		{name: "status not equal", spec: "status != 200", want: []*request.Request{bot, rpc, invalid}},
+		{name: "status less", spec: "status < 400", want: []*request.Request{get}},
+		{name: "status less or equal", spec: "status <= 400", want: []*request.Request{get, invalid}},
+		{name: "status greater", spec: "status > 404", want: []*request.Request{rpc}},
+		{name: "status greater or equal", spec: "status >= 404", want: []*request.Request{bot, rpc}},
+
+		{name: "and binds tighter than or", spec: `method == "POST" || method == "GET" && status == 200`, want: []*request.Request{get, rpc}},
+		{name: "and binds tighter than or on the right", spec: `status == 200 && method == "GET" || method == "POST"`, want: []*request.Request{get, rpc}},
+		{name: "parentheses", spec: `(method == "POST" || method == "GET") && status >= 400`, want: []*request.Request{bot, rpc, invalid}},
+		{name: "negation binds tighter than and", spec: `!method == "POST" && status >= 400`, want: []*request.Request{bot, invalid}},
+		{name: "negated group", spec: `!(method == "POST" || status == 200)`, want: []*request.Request{bot, invalid}},
+		{name: "double negation", spec: `!!status == 200`, want: []*request.Request{get}},
+		{name: "negated regex", spec: `path ~ "^/ipfs/" && !agent ~ "bot"`, want: []*request.Request{get, invalid}},
+		{name: "named filter in expression", spec: `pathonly && status < 400`, want: []*request.Request{get}},
+		{name: "negated named filter", spec: `!validpathonly && method == "GET"`, want: []*request.Request{invalid}},
+		{name: "named filter after operator", spec: `status == 500 || validpathonly`, want: []*request.Request{get, bot, rpc}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := New(tc.spec)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, req := range requests {
+				want := false
+				for _, w := range tc.want {
+					if w == req {
+						want = true
+					}
+				}
+				if got := f(req); got != want {
+					t.Errorf("%s %s: got %v, wanted %v", req.Method, req.URI, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		spec string
+		want string // text expected in the error
+	}{
+		{name: "empty", spec: "   ", want: "empty filter"},
+		{name: "unknown named filter", spec: "someonly", want: "expected comparison operator"},
+		{name: "unknown field", spec: `host == "example.com"`, want: "unknown field"},
+		{name: "empty header name", spec: `header. == "x"`, want: "unknown field"},
+		{name: "invalid regex", spec: `path ~ "(unclosed"`, want: "invalid regular expression at position 7"},
+		{name: "invalid negated regex", spec: `agent !~ "[z-a]"`, want: "invalid regular expression"},
+		{name: "unterminated string", spec: `method == "GET`, want: "unterminated string at position 10"},
+		{name: "unquoted string value", spec: `method == GET`, want: "expected value"},
+		{name: "number for string field", spec: `method == 200`, want: "expected string value"},
+		{name: "string for status", spec: `status == "200"`, want: "expected numeric value"},
+		{name: "numeric operator on string field", spec: `method < "GET"`, want: "not supported for string fields"},
+		{name: "regex operator on status", spec: `status ~ 200`, want: "not supported for numeric fields"},
+		{name: "missing value", spec: `method ==`, want: "expected value"},
+		{name: "missing close paren", spec: `(status == 200`, want: `expected ")"`},
+		{name: "unbalanced close paren", spec: `status == 200)`, want: "unexpected"},
+		{name: "trailing operator", spec: `status == 200 &&`, want: "unexpected end of filter"},
+		{name: "unexpected character", spec: `status == 200 & status == 404`, want: "unexpected character"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(tc.spec)
+			if err == nil {
+				t.Fatalf("got no error, wanted one containing %q", tc.want)
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %q, wanted one containing %q", err, tc.want)
+			}
+		})
+	}
+}
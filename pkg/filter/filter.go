@@ -26,6 +26,11 @@ func PathRequestFilter(req *request.Request) bool {
 	return true
 }
 
+// An RPCRequestFilter only allows requests to the kubo RPC API to pass
+func RPCRequestFilter(req *request.Request) bool {
+	return req.Method == "POST" && strings.HasPrefix(req.URI, "/api/v0/")
+}
+
 // A ValidPathRequestFilter only allows valid path requests to pass
 func ValidPathRequestFilter(req *request.Request) bool {
 	if !PathRequestFilter(req) {
@@ -0,0 +1,89 @@
+package loadgen
+
+// StatusClasses are the classes of response compared in a StatusMatrix. Requests that
+// failed without receiving a response are counted in the error class.
+var StatusClasses = [...]string{"1xx", "2xx", "3xx", "4xx", "5xx", "error"}
+
+const StatusClassError = len(StatusClasses) - 1
+
+// StatusMatrix counts requests by the class of status returned by the original gateway
+// (the row) and the class of status returned by the target (the column).
+type StatusMatrix [len(StatusClasses)][len(StatusClasses)]int
+
+// statusClass returns the index of the class of an http status code in StatusClasses
+// or -1 if the code is not a valid status.
+func statusClass(code int) int {
+	if code < 100 || code > 599 {
+		return -1
+	}
+	return code/100 - 1
+}
+
+// Merge adds the counts from another matrix.
+func (m *StatusMatrix) Merge(o *StatusMatrix) {
+	for i := range m {
+		for j := range m[i] {
+			m[i][j] += o[i][j]
+		}
+	}
+}
+
+// Total returns the number of requests recorded in the matrix.
+func (m *StatusMatrix) Total() int {
+	total := 0
+	for i := range m {
+		for j := range m[i] {
+			total += m[i][j]
+		}
+	}
+	return total
+}
+
+// Agreed returns the number of requests where the target returned the same class of
+// status as the original gateway.
+func (m *StatusMatrix) Agreed() int {
+	agreed := 0
+	for i := range m {
+		agreed += m[i][i]
+	}
+	return agreed
+}
+
+// Regressions returns the number of requests that the original gateway served
+// successfully but the target failed.
+func (m *StatusMatrix) Regressions() int {
+	regressions := 0
+	for i := range m {
+		for j := range m[i] {
+			if isRegression(i, j) {
+				regressions += m[i][j]
+			}
+		}
+	}
+	return regressions
+}
+
+// isRegression reports whether the target failed with a client or server error or no
+// response when the original gateway served the request successfully.
+func isRegression(origin int, target int) bool {
+	return origin == statusClass(200) && (target == statusClass(400) || target == statusClass(500) || target == StatusClassError)
+}
+
+// agreementClasses returns the indexes of the classes of status returned by the original
+// gateway and the target for a request. It returns false if the request cannot be
+// compared.
+func agreementClasses(res *RequestTiming) (int, int, bool) {
+	origin := statusClass(res.OriginStatus)
+	if origin == -1 {
+		return 0, 0, false
+	}
+
+	response := StatusClassError
+	if !res.ConnectError && !res.TimeoutError {
+		response = statusClass(res.StatusCode)
+		if response == -1 {
+			return 0, 0, false
+		}
+	}
+	return origin, response, true
+}
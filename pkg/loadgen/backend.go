@@ -0,0 +1,66 @@
+package loadgen
+
+// BackendStats holds the statistics of requests sent to one of the addresses a target's
+// host resolved to.
+type BackendStats struct {
+	Requests int
+	Errors   int         // requests that failed without a response
+	Http5XX  int         // responses with a 5xx status
+	TTFB     *TimeMetric // time to first byte of successful responses
+}
+
+func NewBackendStats() *BackendStats {
+	return &BackendStats{TTFB: NewTimeMetric()}
+}
+
+func (b *BackendStats) Record(res *RequestTiming) {
+	b.Requests++
+	switch {
+	case res.ConnectError || res.TimeoutError:
+		b.Errors++
+	case res.StatusCode/100 == 5:
+		b.Http5XX++
+	case res.StatusCode/100 == 2 && res.ErrorClass == ErrorNone:
+		b.TTFB.Add(res.TTFB.Seconds())
+	}
+}
+
+func (b *BackendStats) Sample() BackendSample {
+	return BackendSample{
+		Requests: b.Requests,
+		Errors:   b.Errors,
+		Http5XX:  b.Http5XX,
+		TTFB:     b.TTFB.Values(),
+	}
+}
+
+func (b *BackendStats) Snapshot() *BackendStatsSnapshot {
+	return &BackendStatsSnapshot{
+		Requests: b.Requests,
+		Errors:   b.Errors,
+		Http5XX:  b.Http5XX,
+		TTFB:     b.TTFB.Snapshot(),
+	}
+}
+
+func (b *BackendStats) Merge(snap *BackendStatsSnapshot) error {
+	b.Requests += snap.Requests
+	b.Errors += snap.Errors
+	b.Http5XX += snap.Http5XX
+	return b.TTFB.Merge(snap.TTFB)
+}
+
+// BackendStatsSnapshot is a serializable copy of BackendStats
+type BackendStatsSnapshot struct {
+	Requests int                 `json:"requests"`
+	Errors   int                 `json:"errors"`
+	Http5XX  int                 `json:"http_5xx"`
+	TTFB     *TimeMetricSnapshot `json:"ttfb"`
+}
+
+type BackendSample struct {
+	Requests int
+	Errors   int
+	Http5XX  int
+	TTFB     MetricValues
+}
@@ -0,0 +1,182 @@
+package loadgen
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// baselineQuantiles are the quantiles of the time to first byte and total request time
+// that are compared with the baseline.
+var baselineQuantiles = []struct {
+	name  string
+	value func(v MetricValues) float64
+}{
+	{"p50", func(v MetricValues) float64 { return v.P50 }},
+	{"p90", func(v MetricValues) float64 { return v.P90 }},
+	{"p99", func(v MetricValues) float64 { return v.P99 }},
+}
+
+// A BaselineComparison compares a metric of a target with the same metric of the
+// baseline target.
+type BaselineComparison struct {
+	Metric     string  // ttfb_p50, ttfb_p90, ttfb_p99, total_time_p50, total_time_p90, total_time_p99, error_rate or drop_rate
+	Value      float64 // value of the metric for the target, in seconds for times
+	Baseline   float64 // value of the metric for the baseline
+	Ratio      float64 // value divided by the baseline's value, NaN if the baseline's value is zero
+	Difference float64 // value minus the baseline's value
+	IsRate     bool    // the metric is a rate rather than a time
+}
+
+// ErrorRate returns the fraction of requests that were not dropped that failed to
+// connect, timed out or received a 5xx response.
+func (s *MetricSample) ErrorRate(excludeDown bool) float64 {
+	sent := s.TotalRequests - s.TotalDropped
+	if excludeDown {
+		sent -= s.TotalWhileDown
+	}
+	if sent <= 0 {
+		return math.NaN()
+	}
+	return float64(s.TotalConnectErrors+s.TotalTimeoutErrors+s.TotalHttp5XX) / float64(sent)
+}
+
+// DropRate returns the fraction of requests that were dropped because too many
+// requests were already in flight.
+func (s *MetricSample) DropRate(excludeDown bool) float64 {
+	total := s.TotalRequests
+	if excludeDown {
+		total -= s.TotalWhileDown
+	}
+	if total <= 0 {
+		return math.NaN()
+	}
+	return float64(s.TotalDropped) / float64(total)
+}
+
+// A sampleMetric is the value of one of the metrics compared between targets.
+type sampleMetric struct {
+	name   string
+	value  float64 // NaN if the metric has not been measured
+	isRate bool
+}
+
+// sampleMetrics returns the values of the metrics of a sample that are compared between
+// targets, always in the same order.
+func sampleMetrics(s MetricSample, excludeDown bool) []sampleMetric {
+	ms := make([]sampleMetric, 0, 2*len(baselineQuantiles)+2)
+	times := []struct {
+		name string
+		v    MetricValues
+	}{
+		{"ttfb", s.TTFB},
+		{"total_time", s.TotalTime},
+	}
+	for _, t := range times {
+		for _, q := range baselineQuantiles {
+			v := math.NaN()
+			if t.v.Count > 0 {
+				v = q.value(t.v)
+			}
+			ms = append(ms, sampleMetric{name: t.name + "_" + q.name, value: v})
+		}
+	}
+	ms = append(ms,
+		sampleMetric{name: "error_rate", value: s.ErrorRate(excludeDown), isRate: true},
+		sampleMetric{name: "drop_rate", value: s.DropRate(excludeDown), isRate: true},
+	)
+	return ms
+}
+
+// CompareWithBaseline compares the metrics of a target with those of the baseline. Metrics
+// that have not been measured for both targets are omitted.
+func CompareWithBaseline(target, baseline MetricSample, excludeDown bool) []BaselineComparison {
+	tms := sampleMetrics(target, excludeDown)
+	bms := sampleMetrics(baseline, excludeDown)
+
+	comps := make([]BaselineComparison, 0, len(tms))
+	for i, tm := range tms {
+		v, b := tm.value, bms[i].value
+		if math.IsNaN(v) || math.IsNaN(b) {
+			continue
+		}
+		ratio := math.NaN()
+		if b != 0 {
+			ratio = v / b
+		}
+		comps = append(comps, BaselineComparison{
+			Metric:     tm.name,
+			Value:      v,
+			Baseline:   b,
+			Ratio:      ratio,
+			Difference: v - b,
+			IsRate:     tm.isRate,
+		})
+	}
+	return comps
+}
+
+// baselineMetrics exports the comparison of each target with the baseline as gauges.
+type baselineMetrics struct {
+	ratioGauge    *prometheus.GaugeVec
+	timeDiffGauge *prometheus.GaugeVec
+	rateDiffGauge *prometheus.GaugeVec
+}
+
+func newBaselineMetrics() (*baselineMetrics, error) {
+	bm := &baselineMetrics{}
+
+	var err error
+	bm.ratioGauge, err = NewGaugeMetric(
+		"baseline_ratio",
+		"The ratio of the target's metric to the baseline target's, for quantiles of the time to first byte and total request time and the error and drop rates. The window label is 1m, 5m or all for the whole experiment.",
+		[]string{"experiment", "target", "baseline", "metric", "window"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	bm.timeDiffGauge, err = NewGaugeMetric(
+		"baseline_difference_seconds",
+		"The difference between quantiles of the target's time to first byte and total request time and the baseline target's. The window label is 1m, 5m or all for the whole experiment.",
+		[]string{"experiment", "target", "baseline", "metric", "window"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	bm.rateDiffGauge, err = NewGaugeMetric(
+		"baseline_rate_difference",
+		"The difference between the target's error and drop rates and the baseline target's. The window label is 1m, 5m or all for the whole experiment.",
+		[]string{"experiment", "target", "baseline", "metric", "window"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	return bm, nil
+}
+
+// update sets the gauges comparing each target's sample with the baseline's for a window.
+func (bm *baselineMetrics) update(experimentName string, baseline string, window string, samples map[string]MetricSample, excludeDown bool) {
+	base, ok := samples[baseline]
+	if !ok {
+		return
+	}
+	for name, sample := range samples {
+		if name == baseline {
+			continue
+		}
+		for _, c := range CompareWithBaseline(sample, base, excludeDown) {
+			if !math.IsNaN(c.Ratio) {
+				bm.ratioGauge.WithLabelValues(experimentName, name, baseline, c.Metric, window).Set(c.Ratio)
+			}
+			if c.IsRate {
+				bm.rateDiffGauge.WithLabelValues(experimentName, name, baseline, c.Metric, window).Set(c.Difference)
+			} else {
+				bm.timeDiffGauge.WithLabelValues(experimentName, name, baseline, c.Metric, window).Set(c.Difference)
+			}
+		}
+	}
+}
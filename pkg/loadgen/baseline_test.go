@@ -0,0 +1,102 @@
+package loadgen
+
+import (
+	"math"
+	"testing"
+)
+
+func TestErrorAndDropRates(t *testing.T) {
+	s := MetricSample{
+		TotalRequests:      100,
+		TotalDropped:       20,
+		TotalWhileDown:     30,
+		TotalConnectErrors: 4,
+		TotalTimeoutErrors: 2,
+		TotalHttp5XX:       6,
+	}
+
+	testCases := []struct {
+		excludeDown bool
+		errorRate   float64
+		dropRate    float64
+	}{
+		{excludeDown: false, errorRate: 12.0 / 80, dropRate: 20.0 / 100},
+		{excludeDown: true, errorRate: 12.0 / 50, dropRate: 20.0 / 70},
+	}
+	for _, tc := range testCases {
+		if got := s.ErrorRate(tc.excludeDown); math.Abs(got-tc.errorRate) > 1e-12 {
+			t.Errorf("got error rate %g excluding down %v, wanted %g", got, tc.excludeDown, tc.errorRate)
+		}
+		if got := s.DropRate(tc.excludeDown); math.Abs(got-tc.dropRate) > 1e-12 {
+			t.Errorf("got drop rate %g excluding down %v, wanted %g", got, tc.excludeDown, tc.dropRate)
+		}
+	}
+
+	var empty MetricSample
+	if !math.IsNaN(empty.ErrorRate(false)) || !math.IsNaN(empty.DropRate(false)) {
+		t.Errorf("got rates %g and %g with no requests, wanted NaN", empty.ErrorRate(false), empty.DropRate(false))
+	}
+	allDropped := MetricSample{TotalRequests: 10, TotalDropped: 10}
+	if !math.IsNaN(allDropped.ErrorRate(false)) {
+		t.Errorf("got error rate %g when every request was dropped, wanted NaN", allDropped.ErrorRate(false))
+	}
+}
+
+func TestCompareWithBaseline(t *testing.T) {
+	target := MetricSample{
+		TotalRequests: 100,
+		TotalHttp5XX:  10,
+		TTFB:          MetricValues{Count: 90, P50: 0.3, P90: 0.6, P99: 1.2},
+	}
+	baseline := MetricSample{
+		TotalRequests: 100,
+		TotalHttp5XX:  5,
+		TTFB:          MetricValues{Count: 95, P50: 0.2, P90: 0.4, P99: 0},
+		TotalTime:     MetricValues{Count: 95, P50: 0.5, P90: 0.8, P99: 1.5},
+	}
+
+	comps := CompareWithBaseline(target, baseline, false)
+	byMetric := map[string]BaselineComparison{}
+	for _, c := range comps {
+		byMetric[c.Metric] = c
+	}
+
+	// the total time has not been measured for the target
+	for _, name := range []string{"total_time_p50", "total_time_p90", "total_time_p99"} {
+		if _, ok := byMetric[name]; ok {
+			t.Errorf("got comparison of %s, wanted it to be omitted", name)
+		}
+	}
+	if len(comps) != 5 {
+		t.Errorf("got %d comparisons, wanted 5", len(comps))
+	}
+
+	testCases := []struct {
+		metric     string
+		ratio      float64
+		difference float64
+		isRate     bool
+	}{
+		{metric: "ttfb_p50", ratio: 1.5, difference: 0.1},
+		{metric: "ttfb_p90", ratio: 1.5, difference: 0.2},
+		{metric: "ttfb_p99", ratio: math.NaN(), difference: 1.2},
+		{metric: "error_rate", ratio: 2, difference: 0.05, isRate: true},
+		{metric: "drop_rate", ratio: math.NaN(), difference: 0, isRate: true},
+	}
+	for _, tc := range testCases {
+		c, ok := byMetric[tc.metric]
+		if !ok {
+			t.Errorf("no comparison of %s", tc.metric)
+			continue
+		}
+		if math.IsNaN(tc.ratio) != math.IsNaN(c.Ratio) || (!math.IsNaN(tc.ratio) && math.Abs(c.Ratio-tc.ratio) > 1e-9) {
+			t.Errorf("%s: got ratio %g, wanted %g", tc.metric, c.Ratio, tc.ratio)
+		}
+		if math.Abs(c.Difference-tc.difference) > 1e-9 {
+			t.Errorf("%s: got difference %g, wanted %g", tc.metric, c.Difference, tc.difference)
+		}
+		if c.IsRate != tc.isRate {
+			t.Errorf("%s: got is rate %v, wanted %v", tc.metric, c.IsRate, tc.isRate)
+		}
+	}
+}
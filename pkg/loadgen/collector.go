@@ -0,0 +1,1468 @@
+package loadgen
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spenczar/tdigest"
+)
+
+type RequestTiming struct {
+	ExperimentName string
+	TargetName     string
+	TargetGroup    string // replica group of the target, empty if it is not in one
+	OriginStatus   int    // status returned by the original gateway, zero if not known
+	ConnectError   bool
+	TimeoutError   bool
+	ErrorClass     ErrorClass // probable cause of a failed request, including failures while reading the response body
+	Dropped        bool
+	TargetDown     bool // the target was considered down when the request was sent
+	WarmUp         bool // the request was sent during the experiment's warm up period
+	StatusCode     int
+	ConnectTime    time.Duration
+	TTFB           time.Duration
+	TotalTime      time.Duration // time until the response was complete or the request failed
+	Phases         PhaseTimes    // time spent in each phase of a completed request
+	Transfer       TransferStats // progress of reading the response body
+	Stalled        bool          // reading the response body paused for longer than the stall threshold
+	Range          RangeOutcome  // result of checking the response to a range request
+	RPCMethod      string        // rpc command requested if the request was to the kubo RPC API
+	RPCInvalid     bool          // the response to an rpc request failed validation
+	DispatchLag    time.Duration // time from the loader dispatching the request until the worker started sending it
+	Backend        string        // address of the backend the request was sent to, empty if the request was not sent
+}
+
+type Collector struct {
+	ExcludeDown         bool          // exclude requests sent while a target was down from statistics
+	Interval            time.Duration // length of each interval in the interval statistics, defaults to one minute
+	Baseline            string        // name of the target the others are compared with in the baseline metrics, empty if there is none
+	timings             chan *RequestTiming
+	sampleInterval      time.Duration
+	ttfbHist            *prometheus.HistogramVec
+	connectHist         *prometheus.HistogramVec
+	totalHist           *prometheus.HistogramVec
+	requestsCounter     *prometheus.CounterVec
+	droppedCounter      *prometheus.CounterVec
+	connectErrorCounter *prometheus.CounterVec
+	timeoutErrorCounter *prometheus.CounterVec
+	responsesCounter    *prometheus.CounterVec
+	agreementCounter    *prometheus.CounterVec
+	errorClassCounter   *prometheus.CounterVec
+	regressionCounter   *prometheus.CounterVec
+	warmUpCounter       *prometheus.CounterVec
+	statusTTFBHist      *prometheus.HistogramVec
+	statusTotalHist     *prometheus.HistogramVec
+	errorTimeHist       *prometheus.HistogramVec
+	phaseHist           *prometheus.HistogramVec
+	markHist            *prometheus.HistogramVec
+	stallHist           *prometheus.HistogramVec
+	stalledCounter      *prometheus.CounterVec
+	transferBytes       *prometheus.CounterVec
+	transferSeconds     *prometheus.CounterVec
+	truncatedCounter    *prometheus.CounterVec
+	rangeCounter        *prometheus.CounterVec
+	rpcCounter          *prometheus.CounterVec
+	rpcTimeHist         *prometheus.HistogramVec
+	dispatchLagHist     *prometheus.HistogramVec
+	backendCounter      *prometheus.CounterVec
+	backendTTFBHist     *prometheus.HistogramVec
+	warmUpTTFBHist      *prometheus.HistogramVec
+	baselineMetrics     *baselineMetrics
+	groupMetrics        *groupMetrics
+
+	snapshotReqs chan chan map[string]*TargetStatsSnapshot
+	finished     chan struct{} // closed once every timing has been collected
+
+	mu           sync.Mutex // guards access to samples, groups, intervalSubs and final
+	samples      map[string]MetricSample
+	groups       map[string]GroupSample
+	intervalSubs []chan []IntervalSample
+	final        map[string]*TargetStatsSnapshot // snapshot taken once every timing has been collected
+}
+
+func NewCollector(timings chan *RequestTiming, sampleInterval time.Duration) (*Collector, error) {
+	if sampleInterval <= 0 {
+		sampleInterval = 1 * time.Second
+	}
+
+	coll := &Collector{
+		timings:        timings,
+		sampleInterval: sampleInterval,
+		snapshotReqs:   make(chan chan map[string]*TargetStatsSnapshot),
+		finished:       make(chan struct{}),
+	}
+
+	var err error
+	coll.ttfbHist, err = NewHistogramMetric(
+		"ttfb_seconds",
+		"The time till the first byte is received for successful gateway requests.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+	coll.connectHist, err = NewHistogramMetric(
+		"connect_time_seconds",
+		"The time to connect to the target gateway.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+	coll.totalHist, err = NewHistogramMetric(
+		"request_time_seconds",
+		"The total time taken for successful gateway requests.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	coll.requestsCounter, err = NewCounterMetric(
+		"requests_total",
+		"The total number of requests attempted.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.droppedCounter, err = NewCounterMetric(
+		"dropped_total",
+		"The total number of requests that were dropped because there were too many requests already in-flight.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.connectErrorCounter, err = NewCounterMetric(
+		"connect_error_total",
+		"The total number of requests that were unable to connect to the target.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.responsesCounter, err = NewCounterMetric(
+		"responses_total",
+		"The total number of responses received.",
+		[]string{"experiment", "target", "code"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.timeoutErrorCounter, err = NewCounterMetric(
+		"timeout_error_total",
+		"The total number of requests that timed out waiting for a response from the target.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.errorClassCounter, err = NewCounterMetric(
+		"request_error_total",
+		"The total number of failed requests by probable cause of failure, including failures while reading the response body.",
+		[]string{"experiment", "target", "error"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.agreementCounter, err = NewCounterMetric(
+		"status_agreement_total",
+		"The total number of requests by the class of status returned by the original gateway and the class of status returned by the target.",
+		[]string{"experiment", "target", "origin", "response"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.regressionCounter, err = NewCounterMetric(
+		"status_regression_total",
+		"The total number of requests that the original gateway served successfully but the target failed to serve.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.statusTTFBHist, err = NewHistogramMetric(
+		"status_ttfb_seconds",
+		"The time till the first byte is received for all gateway responses, by class of status.",
+		[]string{"experiment", "target", "class"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	coll.statusTotalHist, err = NewHistogramMetric(
+		"status_request_time_seconds",
+		"The total time taken for all gateway responses, by class of status.",
+		[]string{"experiment", "target", "class"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	coll.errorTimeHist, err = NewHistogramMetric(
+		"error_time_seconds",
+		"The time taken for failed requests to fail, by probable cause of failure.",
+		[]string{"experiment", "target", "error"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	coll.phaseHist, err = NewHistogramMetric(
+		"phase_time_seconds",
+		"The time spent in each phase of completed gateway requests: connect, tls, write, server_wait and transfer.",
+		[]string{"experiment", "target", "phase"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	coll.markHist, err = NewHistogramMetric(
+		"time_to_bytes_seconds",
+		"The time from the start of a gateway request until an amount of the response body was received.",
+		[]string{"experiment", "target", "mark"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	coll.stallHist, err = NewHistogramMetric(
+		"transfer_longest_stall_seconds",
+		"The longest pause while reading the body of each gateway response.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	coll.stalledCounter, err = NewCounterMetric(
+		"transfer_stalled_total",
+		"The total number of responses whose body paused for longer than the stall threshold.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.transferBytes, err = NewCounterMetric(
+		"transfer_bytes_total",
+		"The total number of bytes of response bodies received.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.transferSeconds, err = NewCounterMetric(
+		"transfer_seconds_total",
+		"The total time spent reading response bodies, used with transfer_bytes_total to calculate the mean transfer rate.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.truncatedCounter, err = NewCounterMetric(
+		"transfer_truncated_total",
+		"The total number of responses whose body was not read completely because it exceeded the size or time limit.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.rangeCounter, err = NewCounterMetric(
+		"range_responses_total",
+		"The total number of responses to range requests by the outcome of checking them: partial, verified, ignored, unsatisfiable, invalid or mismatch.",
+		[]string{"experiment", "target", "outcome"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.rpcCounter, err = NewCounterMetric(
+		"rpc_requests_total",
+		"The total number of requests to the kubo RPC API by command and outcome: ok, invalid, failed or error.",
+		[]string{"experiment", "target", "method", "outcome"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.rpcTimeHist, err = NewHistogramMetric(
+		"rpc_request_time_seconds",
+		"The total time taken for successful requests to the kubo RPC API that passed validation, by command.",
+		[]string{"experiment", "target", "method"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	coll.dispatchLagHist, err = NewHistogramMetricWithBuckets(
+		"dispatch_lag_seconds",
+		"The time from a request being dispatched to targets until the target's worker started sending it.",
+		[]string{"experiment", "target"},
+		dispatchBuckets,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	coll.backendCounter, err = NewCounterMetric(
+		"backend_responses_total",
+		"The total number of responses received from each address a target's host resolved to. The code label is the response status or error.",
+		[]string{"experiment", "target", "backend", "code"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.backendTTFBHist, err = NewHistogramMetric(
+		"backend_ttfb_seconds",
+		"The time till the first byte is received for successful gateway requests, by the address of the backend that served them.",
+		[]string{"experiment", "target", "backend"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	coll.warmUpCounter, err = NewCounterMetric(
+		"warmup_requests_total",
+		"The total number of requests sent during the warm up period, which are excluded from all other statistics. The code label is the response status or error.",
+		[]string{"experiment", "target", "code"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.warmUpTTFBHist, err = NewHistogramMetric(
+		"warmup_ttfb_seconds",
+		"The time till the first byte is received for successful gateway requests sent during the warm up period.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	coll.baselineMetrics, err = newBaselineMetrics()
+	if err != nil {
+		return nil, fmt.Errorf("baseline metrics: %w", err)
+	}
+
+	coll.groupMetrics, err = newGroupMetrics()
+	if err != nil {
+		return nil, fmt.Errorf("group metrics: %w", err)
+	}
+
+	return coll, nil
+}
+
+func (c *Collector) Run(ctx context.Context) {
+	stats := make(map[string]*TargetStats)
+	intervalStats := make(map[string]*TargetStats)
+	intervalStart := time.Now()
+	rolling := make(map[string]*RollingStats)
+	windows := make(map[string][]WindowSample)
+	groupOf := make(map[string]string)          // group of each target that is a replica
+	groupStats := make(map[string]*TargetStats) // statistics of every replica in each group combined
+	experimentName := ""
+
+	defer c.closeIntervals()
+
+	sampleTicker := time.NewTicker(c.sampleInterval)
+	defer sampleTicker.Stop()
+
+	interval := c.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	intervalTicker := time.NewTicker(interval)
+	defer intervalTicker.Stop()
+
+	windowTicker := time.NewTicker(windowBucketWidth)
+	defer windowTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-c.timings:
+			if !ok {
+				c.updateSamples(stats, windows)
+				c.updateGroups(experimentName, stats, windows, groupOf, groupStats)
+				c.publishInterval(intervalStart, time.Now(), intervalStats)
+				c.finish(stats)
+				return
+			}
+
+			c.observe(res)
+			experimentName = res.ExperimentName
+
+			st, ok := stats[res.TargetName]
+			if !ok {
+				st = NewTargetStats()
+				stats[res.TargetName] = st
+			}
+			st.Record(res, c.ExcludeDown)
+
+			if res.TargetGroup != "" {
+				groupOf[res.TargetName] = res.TargetGroup
+				gst, ok := groupStats[res.TargetGroup]
+				if !ok {
+					gst = NewTargetStats()
+					groupStats[res.TargetGroup] = gst
+				}
+				gst.Record(res, c.ExcludeDown)
+			}
+
+			ist, ok := intervalStats[res.TargetName]
+			if !ok {
+				ist = NewTargetStats()
+				intervalStats[res.TargetName] = ist
+			}
+			ist.Record(res, c.ExcludeDown)
+
+			rs, ok := rolling[res.TargetName]
+			if !ok {
+				rs = NewRollingStats(windowBucketWidth, rollingWindows[len(rollingWindows)-1])
+				rolling[res.TargetName] = rs
+			}
+			rs.Current().Record(res, c.ExcludeDown)
+
+		case reply := <-c.snapshotReqs:
+			reply <- snapshotStats(stats)
+
+		case <-sampleTicker.C:
+			c.updateSamples(stats, windows)
+
+		case <-windowTicker.C:
+			for k, rs := range rolling {
+				rs.Rotate()
+				windows[k] = rs.Windows(rollingWindows)
+			}
+			c.compareWithBaseline(experimentName, stats, windows)
+			c.updateGroups(experimentName, stats, windows, groupOf, groupStats)
+
+		case now := <-intervalTicker.C:
+			c.publishInterval(intervalStart, now, intervalStats)
+			intervalStats = make(map[string]*TargetStats)
+			intervalStart = now
+		}
+	}
+}
+
+// updateSamples replaces the samples returned by Latest with ones taken from the current
+// statistics.
+func (c *Collector) updateSamples(stats map[string]*TargetStats, windows map[string][]WindowSample) {
+	samples := map[string]MetricSample{}
+	for k, v := range stats {
+		sample := v.Sample()
+		sample.Windows = windows[k]
+		samples[k] = sample
+	}
+	c.mu.Lock()
+	c.samples = samples
+	c.mu.Unlock()
+}
+
+// compareWithBaseline updates the metrics comparing each target with the baseline over
+// the whole experiment and each rolling window.
+func (c *Collector) compareWithBaseline(experimentName string, stats map[string]*TargetStats, windows map[string][]WindowSample) {
+	if c.Baseline == "" || stats[c.Baseline] == nil {
+		return
+	}
+
+	all := make(map[string]MetricSample, len(stats))
+	for k, v := range stats {
+		all[k] = v.Sample()
+	}
+	c.baselineMetrics.update(experimentName, c.Baseline, "all", all, c.ExcludeDown)
+
+	for i, span := range rollingWindows {
+		samples := make(map[string]MetricSample, len(windows))
+		for k, ws := range windows {
+			if i < len(ws) {
+				samples[k] = ws[i].MetricSample
+			}
+		}
+		c.baselineMetrics.update(experimentName, c.Baseline, DurationDesc(int(span/time.Second)), samples, c.ExcludeDown)
+	}
+}
+
+// updateGroups replaces the samples returned by LatestGroups and updates the metrics
+// describing each group of replicas over the whole experiment and each rolling window.
+func (c *Collector) updateGroups(experimentName string, stats map[string]*TargetStats, windows map[string][]WindowSample, groupOf map[string]string, groupStats map[string]*TargetStats) {
+	if len(groupStats) == 0 {
+		return
+	}
+
+	all := make(map[string]MetricSample, len(groupOf))
+	for k := range groupOf {
+		all[k] = stats[k].Sample()
+	}
+	groups := make(map[string]GroupSample, len(groupStats))
+	for group, replicas := range replicasByGroup(groupOf, all) {
+		groups[group] = NewGroupSample(groupStats[group].Sample(), replicas, c.ExcludeDown)
+	}
+	c.mu.Lock()
+	c.groups = groups
+	c.mu.Unlock()
+
+	baseline := groupOf[c.Baseline]
+	c.groupMetrics.update(experimentName, baseline, "all", groups)
+
+	for i, span := range rollingWindows {
+		samples := make(map[string]MetricSample, len(groupOf))
+		for k := range groupOf {
+			if ws := windows[k]; i < len(ws) {
+				samples[k] = ws[i].MetricSample
+			}
+		}
+		spans := make(map[string]GroupSample, len(groups))
+		for group, replicas := range replicasByGroup(groupOf, samples) {
+			spans[group] = GroupSample{Spread: replicaSpread(replicas, c.ExcludeDown)}
+		}
+		c.groupMetrics.update(experimentName, baseline, DurationDesc(int(span/time.Second)), spans)
+	}
+}
+
+// observe records a request timing in the prometheus metrics
+func (c *Collector) observe(res *RequestTiming) {
+	if res.WarmUp {
+		c.recordWarmUp(res)
+		return
+	}
+
+	c.requestsCounter.WithLabelValues(res.ExperimentName, res.TargetName).Add(1)
+	if res.TargetDown && c.ExcludeDown {
+		return
+	}
+	if !res.Dropped {
+		c.recordAgreement(res)
+	}
+	if res.ErrorClass != ErrorNone {
+		c.errorClassCounter.WithLabelValues(res.ExperimentName, res.TargetName, res.ErrorClass.String()).Add(1)
+		c.errorTimeHist.WithLabelValues(res.ExperimentName, res.TargetName, res.ErrorClass.String()).Observe(res.TotalTime.Seconds())
+	}
+	if res.Backend != "" {
+		c.observeBackend(res)
+	}
+	if res.RPCMethod != "" && !res.Dropped {
+		outcome := rpcOutcome(res)
+		c.rpcCounter.WithLabelValues(res.ExperimentName, res.TargetName, res.RPCMethod, outcome.String()).Add(1)
+		if outcome == RPCOK {
+			c.rpcTimeHist.WithLabelValues(res.ExperimentName, res.TargetName, res.RPCMethod).Observe(res.TotalTime.Seconds())
+		}
+	}
+	if res.ConnectError {
+		c.connectErrorCounter.WithLabelValues(res.ExperimentName, res.TargetName).Add(1)
+	} else if res.TimeoutError {
+		c.timeoutErrorCounter.WithLabelValues(res.ExperimentName, res.TargetName).Add(1)
+	} else if res.Dropped {
+		c.droppedCounter.WithLabelValues(res.ExperimentName, res.TargetName).Add(1)
+	} else {
+		c.connectHist.WithLabelValues(res.ExperimentName, res.TargetName).Observe(res.ConnectTime.Seconds())
+		c.dispatchLagHist.WithLabelValues(res.ExperimentName, res.TargetName).Observe(res.DispatchLag.Seconds())
+		c.responsesCounter.WithLabelValues(res.ExperimentName, res.TargetName, strconv.Itoa(res.StatusCode)).Add(1)
+		c.observeTransfer(res)
+		if res.Range != RangeNone {
+			c.rangeCounter.WithLabelValues(res.ExperimentName, res.TargetName, res.Range.String()).Add(1)
+		}
+		if res.ErrorClass == ErrorNone {
+			for phase, d := range res.Phases {
+				if d >= 0 && !(res.Transfer.Truncated && Phase(phase) == PhaseTransfer) {
+					c.phaseHist.WithLabelValues(res.ExperimentName, res.TargetName, Phase(phase).String()).Observe(d.Seconds())
+				}
+			}
+		}
+		if class := statusClass(res.StatusCode); class != -1 && res.ErrorClass == ErrorNone {
+			c.statusTTFBHist.WithLabelValues(res.ExperimentName, res.TargetName, StatusClasses[class]).Observe(res.TTFB.Seconds())
+			if !res.Transfer.Truncated {
+				c.statusTotalHist.WithLabelValues(res.ExperimentName, res.TargetName, StatusClasses[class]).Observe(res.TotalTime.Seconds())
+			}
+		}
+		if res.StatusCode/100 == 2 && res.ErrorClass == ErrorNone {
+			c.ttfbHist.WithLabelValues(res.ExperimentName, res.TargetName).Observe(res.TTFB.Seconds())
+			if !res.Transfer.Truncated {
+				c.totalHist.WithLabelValues(res.ExperimentName, res.TargetName).Observe(res.TotalTime.Seconds())
+			}
+		}
+	}
+}
+
+// observeBackend records a request in the prometheus metrics of the backend that served it
+func (c *Collector) observeBackend(res *RequestTiming) {
+	code := strconv.Itoa(res.StatusCode)
+	if res.ConnectError || res.TimeoutError {
+		code = res.ErrorClass.String()
+	}
+	c.backendCounter.WithLabelValues(res.ExperimentName, res.TargetName, res.Backend, code).Add(1)
+	if res.StatusCode/100 == 2 && res.ErrorClass == ErrorNone {
+		c.backendTTFBHist.WithLabelValues(res.ExperimentName, res.TargetName, res.Backend).Observe(res.TTFB.Seconds())
+	}
+}
+
+// observeTransfer records the progress of reading a response body in the prometheus metrics
+func (c *Collector) observeTransfer(res *RequestTiming) {
+	c.transferBytes.WithLabelValues(res.ExperimentName, res.TargetName).Add(float64(res.Transfer.Bytes))
+	c.transferSeconds.WithLabelValues(res.ExperimentName, res.TargetName).Add(res.Transfer.Duration.Seconds())
+	c.stallHist.WithLabelValues(res.ExperimentName, res.TargetName).Observe(res.Transfer.LongestStall.Seconds())
+	if res.Stalled {
+		c.stalledCounter.WithLabelValues(res.ExperimentName, res.TargetName).Add(1)
+	}
+	if res.Transfer.Truncated {
+		c.truncatedCounter.WithLabelValues(res.ExperimentName, res.TargetName).Add(1)
+	}
+	for i, d := range res.Transfer.MarkTimes {
+		if d >= 0 {
+			c.markHist.WithLabelValues(res.ExperimentName, res.TargetName, TransferMarkNames[i]).Observe(d.Seconds())
+		}
+	}
+}
+
+// recordWarmUp records a request sent during the warm up period in metrics kept
+// separately from the experiment's statistics.
+func (c *Collector) recordWarmUp(res *RequestTiming) {
+	code := "error"
+	switch {
+	case res.Dropped:
+		code = "dropped"
+	case res.ConnectError || res.TimeoutError:
+	default:
+		code = strconv.Itoa(res.StatusCode)
+		if res.StatusCode/100 == 2 && res.ErrorClass == ErrorNone {
+			c.warmUpTTFBHist.WithLabelValues(res.ExperimentName, res.TargetName).Observe(res.TTFB.Seconds())
+		}
+	}
+	c.warmUpCounter.WithLabelValues(res.ExperimentName, res.TargetName, code).Add(1)
+}
+
+// recordAgreement records how the target's response compared with the status returned by
+// the original gateway.
+func (c *Collector) recordAgreement(res *RequestTiming) {
+	origin, response, ok := agreementClasses(res)
+	if !ok {
+		return
+	}
+
+	c.agreementCounter.WithLabelValues(res.ExperimentName, res.TargetName, StatusClasses[origin], StatusClasses[response]).Add(1)
+	if isRegression(origin, response) {
+		c.regressionCounter.WithLabelValues(res.ExperimentName, res.TargetName).Add(1)
+	}
+}
+
+// Intervals returns a channel that receives the statistics for each target at the end of
+// every interval. Intervals are dropped if the receiver falls behind. The channel is
+// closed when the collector stops running.
+func (c *Collector) Intervals() <-chan []IntervalSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan []IntervalSample, 16)
+	c.intervalSubs = append(c.intervalSubs, ch)
+	return ch
+}
+
+func (c *Collector) publishInterval(start, end time.Time, stats map[string]*TargetStats) {
+	if len(stats) == 0 {
+		return
+	}
+	samples := make([]IntervalSample, 0, len(stats))
+	for k, v := range stats {
+		samples = append(samples, IntervalSample{
+			Start:        start,
+			End:          end,
+			TargetName:   k,
+			MetricSample: v.Sample(),
+		})
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].TargetName < samples[j].TargetName })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ch := range c.intervalSubs {
+		select {
+		case ch <- samples:
+		default:
+		}
+	}
+}
+
+// finish records the final snapshot of the statistics once every timing has been collected.
+func (c *Collector) finish(stats map[string]*TargetStats) {
+	c.mu.Lock()
+	c.final = snapshotStats(stats)
+	c.mu.Unlock()
+	close(c.finished)
+}
+
+func snapshotStats(stats map[string]*TargetStats) map[string]*TargetStatsSnapshot {
+	snaps := make(map[string]*TargetStatsSnapshot, len(stats))
+	for k, v := range stats {
+		snaps[k] = v.Snapshot()
+	}
+	return snaps
+}
+
+func (c *Collector) closeIntervals() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ch := range c.intervalSubs {
+		close(ch)
+	}
+	c.intervalSubs = nil
+}
+
+func (c *Collector) Latest() map[string]MetricSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.samples) == 0 {
+		return map[string]MetricSample{}
+	}
+	samples := map[string]MetricSample{}
+	for k, v := range c.samples {
+		samples[k] = v
+	}
+	return samples
+}
+
+// LatestGroups returns the most recent statistics of each group of replicas, keyed by the
+// name of the group.
+func (c *Collector) LatestGroups() map[string]GroupSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	groups := make(map[string]GroupSample, len(c.groups))
+	for k, v := range c.groups {
+		groups[k] = v
+	}
+	return groups
+}
+
+// Snapshot returns a serializable copy of the statistics accumulated so far for each target.
+// Once the collector's timings have been closed and collected it returns the final
+// statistics.
+func (c *Collector) Snapshot(ctx context.Context) (map[string]*TargetStatsSnapshot, error) {
+	reply := make(chan map[string]*TargetStatsSnapshot, 1)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.finished:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.final, nil
+	case c.snapshotReqs <- reply:
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case snaps := <-reply:
+		return snaps, nil
+	}
+}
+
+type TargetStats struct {
+	TotalRequests      int
+	TotalConnectErrors int
+	TotalTimeoutErrors int
+	TotalDropped       int
+	TotalWhileDown     int
+	TotalWarmUp        int
+	TotalHttp2XX       int
+	TotalHttp3XX       int
+	TotalHttp4XX       int
+	TotalHttp5XX       int
+	StatusAgreement    StatusMatrix
+	ErrorCounts        ErrorCounts
+	ConnectTime        *TimeMetric
+	TTFB               *TimeMetric
+	TotalTime          *TimeMetric
+	StatusTTFB         [StatusClassError]*TimeMetric // time to first byte of responses by class of status
+	StatusTotalTime    [StatusClassError]*TimeMetric // total time of responses by class of status
+	ErrorTime          [NumErrorClasses]*TimeMetric  // time taken for failed requests to fail by class of error
+	PhaseTime          [NumPhases]*TimeMetric        // time spent in each phase of completed requests
+	TotalStalled       int
+	TotalTruncated     int
+	RangeOutcomes      [NumRangeOutcomes]int
+	TransferBytes      int64
+	TransferSeconds    float64
+	LongestStall       *TimeMetric                     // longest pause while reading each response body
+	TimeToMark         [len(transferMarks)]*TimeMetric // time from the start of each request until each transfer mark was received
+	RPC                map[string]*RPCStats            // statistics of requests to the kubo RPC API by command
+	DispatchLag        *TimeMetric                     // time from each request being dispatched until it was sent
+	Backends           map[string]*BackendStats        // statistics of requests by the address of the backend they were sent to
+}
+
+func NewTargetStats() *TargetStats {
+	st := &TargetStats{
+		ConnectTime:  NewTimeMetric(),
+		TTFB:         NewTimeMetric(),
+		TotalTime:    NewTimeMetric(),
+		LongestStall: NewTimeMetric(),
+		RPC:          make(map[string]*RPCStats),
+		DispatchLag:  NewTimeMetric(),
+		Backends:     make(map[string]*BackendStats),
+	}
+	for i := range st.TimeToMark {
+		st.TimeToMark[i] = NewTimeMetric()
+	}
+	for i := range st.StatusTTFB {
+		st.StatusTTFB[i] = NewTimeMetric()
+		st.StatusTotalTime[i] = NewTimeMetric()
+	}
+	for i := range st.ErrorTime {
+		st.ErrorTime[i] = NewTimeMetric()
+	}
+	for i := range st.PhaseTime {
+		st.PhaseTime[i] = NewTimeMetric()
+	}
+	return st
+}
+
+// Record adds a request timing to the statistics. Requests sent while the target was down
+// are only counted if excludeDown is true.
+func (st *TargetStats) Record(res *RequestTiming, excludeDown bool) {
+	if res.WarmUp {
+		st.TotalWarmUp++
+		return
+	}
+
+	st.TotalRequests++
+	if res.TargetDown {
+		st.TotalWhileDown++
+		if excludeDown {
+			return
+		}
+	}
+	if !res.Dropped {
+		if origin, response, ok := agreementClasses(res); ok {
+			st.StatusAgreement[origin][response]++
+		}
+	}
+	if res.ErrorClass != ErrorNone {
+		st.ErrorCounts[res.ErrorClass]++
+		st.ErrorTime[res.ErrorClass].Add(res.TotalTime.Seconds())
+	}
+	if res.Backend != "" {
+		bs, ok := st.Backends[res.Backend]
+		if !ok {
+			bs = NewBackendStats()
+			st.Backends[res.Backend] = bs
+		}
+		bs.Record(res)
+	}
+	if res.RPCMethod != "" && !res.Dropped {
+		rs, ok := st.RPC[res.RPCMethod]
+		if !ok {
+			rs = NewRPCStats()
+			st.RPC[res.RPCMethod] = rs
+		}
+		rs.Record(res)
+	}
+	if res.ConnectError {
+		st.TotalConnectErrors++
+	} else if res.TimeoutError {
+		st.TotalTimeoutErrors++
+	} else if res.Dropped {
+		st.TotalDropped++
+	} else {
+		st.ConnectTime.Add(res.ConnectTime.Seconds())
+		st.DispatchLag.Add(res.DispatchLag.Seconds())
+		st.recordTransfer(res)
+		st.RangeOutcomes[res.Range]++
+		if res.ErrorClass == ErrorNone {
+			for phase, d := range res.Phases {
+				if d >= 0 && !(res.Transfer.Truncated && Phase(phase) == PhaseTransfer) {
+					st.PhaseTime[phase].Add(d.Seconds())
+				}
+			}
+		}
+		if class := statusClass(res.StatusCode); class != -1 && res.ErrorClass == ErrorNone {
+			st.StatusTTFB[class].Add(res.TTFB.Seconds())
+			if !res.Transfer.Truncated {
+				st.StatusTotalTime[class].Add(res.TotalTime.Seconds())
+			}
+		}
+
+		switch res.StatusCode / 100 {
+		case 2:
+			st.TotalHttp2XX++
+			if res.ErrorClass != ErrorNone {
+				// the response body could not be read so timings are not comparable
+				break
+			}
+			st.TTFB.Add(res.TTFB.Seconds())
+			if res.Transfer.Truncated {
+				// the total time of a truncated response is not comparable
+				break
+			}
+			st.TotalTime.Add(res.TotalTime.Seconds())
+		case 3:
+			st.TotalHttp3XX++
+		case 4:
+			st.TotalHttp4XX++
+		case 5:
+			st.TotalHttp5XX++
+		}
+	}
+}
+
+func (st *TargetStats) recordTransfer(res *RequestTiming) {
+	st.TransferBytes += res.Transfer.Bytes
+	st.TransferSeconds += res.Transfer.Duration.Seconds()
+	st.LongestStall.Add(res.Transfer.LongestStall.Seconds())
+	if res.Stalled {
+		st.TotalStalled++
+	}
+	if res.Transfer.Truncated {
+		st.TotalTruncated++
+	}
+	for i, d := range res.Transfer.MarkTimes {
+		if d >= 0 {
+			st.TimeToMark[i].Add(d.Seconds())
+		}
+	}
+}
+
+// Sample returns the current values of the statistics.
+func (st *TargetStats) Sample() MetricSample {
+	sample := MetricSample{
+		TotalRequests:      st.TotalRequests,
+		TotalConnectErrors: st.TotalConnectErrors,
+		TotalTimeoutErrors: st.TotalTimeoutErrors,
+		TotalDropped:       st.TotalDropped,
+		TotalWhileDown:     st.TotalWhileDown,
+		TotalWarmUp:        st.TotalWarmUp,
+		TotalHttp2XX:       st.TotalHttp2XX,
+		TotalHttp3XX:       st.TotalHttp3XX,
+		TotalHttp4XX:       st.TotalHttp4XX,
+		TotalHttp5XX:       st.TotalHttp5XX,
+		StatusAgreement:    st.StatusAgreement,
+		ErrorCounts:        st.ErrorCounts,
+		ConnectTime:        st.ConnectTime.Values(),
+		TTFB:               st.TTFB.Values(),
+		TotalTime:          st.TotalTime.Values(),
+		TotalStalled:       st.TotalStalled,
+		TotalTruncated:     st.TotalTruncated,
+		RangeOutcomes:      st.RangeOutcomes,
+		TransferBytes:      st.TransferBytes,
+		TransferSeconds:    st.TransferSeconds,
+		LongestStall:       st.LongestStall.Values(),
+		RPC:                make(map[string]RPCSample, len(st.RPC)),
+		DispatchLag:        st.DispatchLag.Values(),
+		Backends:           make(map[string]BackendSample, len(st.Backends)),
+	}
+	for backend, bs := range st.Backends {
+		sample.Backends[backend] = bs.Sample()
+	}
+	for method, rs := range st.RPC {
+		sample.RPC[method] = rs.Sample()
+	}
+	for i := range st.StatusTTFB {
+		sample.StatusTTFB[i] = st.StatusTTFB[i].Values()
+		sample.StatusTotalTime[i] = st.StatusTotalTime[i].Values()
+	}
+	for i := range st.ErrorTime {
+		sample.ErrorTime[i] = st.ErrorTime[i].Values()
+	}
+	for i := range st.PhaseTime {
+		sample.PhaseTime[i] = st.PhaseTime[i].Values()
+	}
+	for i := range st.TimeToMark {
+		sample.TimeToMark[i] = st.TimeToMark[i].Values()
+	}
+	return sample
+}
+
+// Snapshot returns a serializable copy of the statistics.
+func (st *TargetStats) Snapshot() *TargetStatsSnapshot {
+	snap := &TargetStatsSnapshot{
+		TotalRequests:      st.TotalRequests,
+		TotalConnectErrors: st.TotalConnectErrors,
+		TotalTimeoutErrors: st.TotalTimeoutErrors,
+		TotalDropped:       st.TotalDropped,
+		TotalWhileDown:     st.TotalWhileDown,
+		TotalWarmUp:        st.TotalWarmUp,
+		TotalHttp2XX:       st.TotalHttp2XX,
+		TotalHttp3XX:       st.TotalHttp3XX,
+		TotalHttp4XX:       st.TotalHttp4XX,
+		TotalHttp5XX:       st.TotalHttp5XX,
+		StatusAgreement:    st.StatusAgreement,
+		ErrorCounts:        st.ErrorCounts,
+		ConnectTime:        st.ConnectTime.Snapshot(),
+		TTFB:               st.TTFB.Snapshot(),
+		TotalTime:          st.TotalTime.Snapshot(),
+		TotalStalled:       st.TotalStalled,
+		TotalTruncated:     st.TotalTruncated,
+		RangeOutcomes:      st.RangeOutcomes,
+		TransferBytes:      st.TransferBytes,
+		TransferSeconds:    st.TransferSeconds,
+		LongestStall:       st.LongestStall.Snapshot(),
+		RPC:                make(map[string]*RPCStatsSnapshot, len(st.RPC)),
+		DispatchLag:        st.DispatchLag.Snapshot(),
+		Backends:           make(map[string]*BackendStatsSnapshot, len(st.Backends)),
+	}
+	for backend, bs := range st.Backends {
+		snap.Backends[backend] = bs.Snapshot()
+	}
+	for method, rs := range st.RPC {
+		snap.RPC[method] = rs.Snapshot()
+	}
+	for i := range st.StatusTTFB {
+		snap.StatusTTFB[i] = st.StatusTTFB[i].Snapshot()
+		snap.StatusTotalTime[i] = st.StatusTotalTime[i].Snapshot()
+	}
+	for i := range st.ErrorTime {
+		snap.ErrorTime[i] = st.ErrorTime[i].Snapshot()
+	}
+	for i := range st.PhaseTime {
+		snap.PhaseTime[i] = st.PhaseTime[i].Snapshot()
+	}
+	for i := range st.TimeToMark {
+		snap.TimeToMark[i] = st.TimeToMark[i].Snapshot()
+	}
+	return snap
+}
+
+// Merge adds the statistics held in a snapshot to st.
+func (st *TargetStats) Merge(snap *TargetStatsSnapshot) error {
+	st.TotalRequests += snap.TotalRequests
+	st.TotalConnectErrors += snap.TotalConnectErrors
+	st.TotalTimeoutErrors += snap.TotalTimeoutErrors
+	st.TotalDropped += snap.TotalDropped
+	st.TotalWhileDown += snap.TotalWhileDown
+	st.TotalWarmUp += snap.TotalWarmUp
+	st.TotalHttp2XX += snap.TotalHttp2XX
+	st.TotalHttp3XX += snap.TotalHttp3XX
+	st.TotalHttp4XX += snap.TotalHttp4XX
+	st.TotalHttp5XX += snap.TotalHttp5XX
+	st.StatusAgreement.Merge(&snap.StatusAgreement)
+	st.ErrorCounts.Merge(&snap.ErrorCounts)
+	if err := st.ConnectTime.Merge(snap.ConnectTime); err != nil {
+		return fmt.Errorf("connect time: %w", err)
+	}
+	if err := st.TTFB.Merge(snap.TTFB); err != nil {
+		return fmt.Errorf("ttfb: %w", err)
+	}
+	if err := st.TotalTime.Merge(snap.TotalTime); err != nil {
+		return fmt.Errorf("total time: %w", err)
+	}
+	for i := range st.StatusTTFB {
+		if err := st.StatusTTFB[i].Merge(snap.StatusTTFB[i]); err != nil {
+			return fmt.Errorf("%s ttfb: %w", StatusClasses[i], err)
+		}
+		if err := st.StatusTotalTime[i].Merge(snap.StatusTotalTime[i]); err != nil {
+			return fmt.Errorf("%s total time: %w", StatusClasses[i], err)
+		}
+	}
+	for i := range st.ErrorTime {
+		if err := st.ErrorTime[i].Merge(snap.ErrorTime[i]); err != nil {
+			return fmt.Errorf("%s error time: %w", ErrorClass(i), err)
+		}
+	}
+	for i := range st.PhaseTime {
+		if err := st.PhaseTime[i].Merge(snap.PhaseTime[i]); err != nil {
+			return fmt.Errorf("%s phase time: %w", Phase(i), err)
+		}
+	}
+	st.TotalStalled += snap.TotalStalled
+	st.TotalTruncated += snap.TotalTruncated
+	for i := range st.RangeOutcomes {
+		st.RangeOutcomes[i] += snap.RangeOutcomes[i]
+	}
+	st.TransferBytes += snap.TransferBytes
+	st.TransferSeconds += snap.TransferSeconds
+	if err := st.LongestStall.Merge(snap.LongestStall); err != nil {
+		return fmt.Errorf("longest stall: %w", err)
+	}
+	for i := range st.TimeToMark {
+		if err := st.TimeToMark[i].Merge(snap.TimeToMark[i]); err != nil {
+			return fmt.Errorf("time to %s: %w", TransferMarkNames[i], err)
+		}
+	}
+	if err := st.DispatchLag.Merge(snap.DispatchLag); err != nil {
+		return fmt.Errorf("dispatch lag: %w", err)
+	}
+	for backend, bsnap := range snap.Backends {
+		bs, ok := st.Backends[backend]
+		if !ok {
+			bs = NewBackendStats()
+			st.Backends[backend] = bs
+		}
+		if err := bs.Merge(bsnap); err != nil {
+			return fmt.Errorf("backend %s: %w", backend, err)
+		}
+	}
+	for method, rsnap := range snap.RPC {
+		rs, ok := st.RPC[method]
+		if !ok {
+			rs = NewRPCStats()
+			st.RPC[method] = rs
+		}
+		if err := rs.Merge(rsnap); err != nil {
+			return fmt.Errorf("rpc %s: %w", method, err)
+		}
+	}
+	return nil
+}
+
+// TargetStatsSnapshot is a serializable copy of TargetStats
+type TargetStatsSnapshot struct {
+	TotalRequests      int                                     `json:"total_requests"`
+	TotalConnectErrors int                                     `json:"total_connect_errors"`
+	TotalTimeoutErrors int                                     `json:"total_timeout_errors"`
+	TotalDropped       int                                     `json:"total_dropped"`
+	TotalWhileDown     int                                     `json:"total_while_down"`
+	TotalWarmUp        int                                     `json:"total_warm_up"`
+	TotalHttp2XX       int                                     `json:"total_http_2xx"`
+	TotalHttp3XX       int                                     `json:"total_http_3xx"`
+	TotalHttp4XX       int                                     `json:"total_http_4xx"`
+	TotalHttp5XX       int                                     `json:"total_http_5xx"`
+	StatusAgreement    StatusMatrix                            `json:"status_agreement"`
+	ErrorCounts        ErrorCounts                             `json:"error_counts"`
+	ConnectTime        *TimeMetricSnapshot                     `json:"connect_time"`
+	TTFB               *TimeMetricSnapshot                     `json:"ttfb"`
+	TotalTime          *TimeMetricSnapshot                     `json:"total_time"`
+	StatusTTFB         [StatusClassError]*TimeMetricSnapshot   `json:"status_ttfb"`
+	StatusTotalTime    [StatusClassError]*TimeMetricSnapshot   `json:"status_total_time"`
+	ErrorTime          [NumErrorClasses]*TimeMetricSnapshot    `json:"error_time"`
+	PhaseTime          [NumPhases]*TimeMetricSnapshot          `json:"phase_time"`
+	TotalStalled       int                                     `json:"total_stalled"`
+	TotalTruncated     int                                     `json:"total_truncated"`
+	RangeOutcomes      [NumRangeOutcomes]int                   `json:"range_outcomes"`
+	TransferBytes      int64                                   `json:"transfer_bytes"`
+	TransferSeconds    float64                                 `json:"transfer_seconds"`
+	LongestStall       *TimeMetricSnapshot                     `json:"longest_stall"`
+	TimeToMark         [len(transferMarks)]*TimeMetricSnapshot `json:"time_to_mark"`
+	RPC                map[string]*RPCStatsSnapshot            `json:"rpc,omitempty"`
+	DispatchLag        *TimeMetricSnapshot                     `json:"dispatch_lag"`
+	Backends           map[string]*BackendStatsSnapshot        `json:"backends,omitempty"`
+}
+
+type TimeMetric struct {
+	Digest *tdigest.TDigest
+	Count  int
+	Sum    float64
+	Min    float64
+	Max    float64
+}
+
+func NewTimeMetric() *TimeMetric {
+	return &TimeMetric{
+		Digest: tdigest.New(),
+		Min:    math.NaN(),
+		Max:    math.NaN(),
+	}
+}
+
+func (t *TimeMetric) Add(v float64) {
+	t.Count++
+	t.Sum += v
+	t.Digest.Add(v, 1)
+	if math.IsNaN(t.Min) || v < t.Min {
+		t.Min = v
+	}
+	if math.IsNaN(t.Max) || v > t.Max {
+		t.Max = v
+	}
+}
+
+func (t *TimeMetric) Mean() float64 {
+	if t.Count == 0 {
+		return 0
+	}
+	return t.Sum / float64(t.Count)
+}
+
+// Values returns the current summary values of the metric.
+func (t *TimeMetric) Values() MetricValues {
+	return MetricValues{
+		Count: t.Count,
+		Mean:  t.Mean(),
+		Max:   t.Max,
+		Min:   t.Min,
+		P50:   t.Digest.Quantile(0.50),
+		P75:   t.Digest.Quantile(0.75),
+		P90:   t.Digest.Quantile(0.90),
+		P95:   t.Digest.Quantile(0.95),
+		P99:   t.Digest.Quantile(0.99),
+		P999:  t.Digest.Quantile(0.999),
+	}
+}
+
+// Snapshot returns a serializable copy of the metric.
+func (t *TimeMetric) Snapshot() *TimeMetricSnapshot {
+	snap := &TimeMetricSnapshot{
+		Count: t.Count,
+		Sum:   t.Sum,
+	}
+	if t.Count == 0 {
+		return snap
+	}
+	snap.Min = t.Min
+	snap.Max = t.Max
+	// marshalling a digest only fails if it contains values that cannot be encoded
+	snap.Digest, _ = t.Digest.MarshalBinary()
+	return snap
+}
+
+// Merge adds the values held in a snapshot to the metric.
+func (t *TimeMetric) Merge(snap *TimeMetricSnapshot) error {
+	if snap == nil || snap.Count == 0 {
+		return nil
+	}
+	if err := addEncodedDigest(t.Digest, snap.Digest); err != nil {
+		return fmt.Errorf("merge digest: %w", err)
+	}
+
+	t.Count += snap.Count
+	t.Sum += snap.Sum
+	if math.IsNaN(t.Min) || snap.Min < t.Min {
+		t.Min = snap.Min
+	}
+	if math.IsNaN(t.Max) || snap.Max > t.Max {
+		t.Max = snap.Max
+	}
+	return nil
+}
+
+// addEncodedDigest adds the centroids of a digest encoded using MarshalBinary to d. The
+// digest's own Add and MergeInto both count the weight of a centroid more than once when
+// it is added to one that is nearly full, which skews every quantile, so instead the
+// centroids of both digests are combined, compressed and decoded into d.
+func addEncodedDigest(d *tdigest.TDigest, p []byte) error {
+	// Validate the encoding before reading the centroids directly
+	if err := tdigest.New().UnmarshalBinary(p); err != nil {
+		return err
+	}
+	own, err := d.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	compression := math.Float64frombits(binary.LittleEndian.Uint64(own[6:]))
+	centroids := compressCentroids(append(decodeCentroids(own), decodeCentroids(p)...), compression)
+
+	enc := make([]byte, digestHeaderLen, digestHeaderLen+16*len(centroids))
+	copy(enc, own[:digestHeaderLen])
+	binary.LittleEndian.PutUint32(enc[14:], uint32(len(centroids)))
+	for _, c := range centroids {
+		enc = binary.LittleEndian.AppendUint64(enc, uint64(c.count))
+		enc = binary.LittleEndian.AppendUint64(enc, math.Float64bits(c.mean))
+	}
+
+	// decoding adds to the digest's total weight so it must be reset first
+	*d = tdigest.TDigest{}
+	return d.UnmarshalBinary(enc)
+}
+
+// The encoding of a digest is a header of magic (int16), version (int32), compression
+// (float64) and centroid count (int32) followed by the count (int64) and mean (float64)
+// of each centroid, all little endian.
+const digestHeaderLen = 2 + 4 + 8 + 4
+
+type digestCentroid struct {
+	count int64
+	mean  float64
+}
+
+// decodeCentroids reads the centroids from a valid digest encoding.
+func decodeCentroids(p []byte) []digestCentroid {
+	var centroids []digestCentroid
+	for off := digestHeaderLen; off+16 <= len(p); off += 16 {
+		centroids = append(centroids, digestCentroid{
+			count: int64(binary.LittleEndian.Uint64(p[off:])),
+			mean:  math.Float64frombits(binary.LittleEndian.Uint64(p[off+8:])),
+		})
+	}
+	return centroids
+}
+
+// compressCentroids sorts the centroids and merges neighbours as long as each centroid
+// holds no more than 4*n*q*(1-q)/compression of the n values, where q is the quantile at
+// its middle. This keeps the number of centroids bounded however many digests are merged
+// while keeping the tails precise.
+func compressCentroids(centroids []digestCentroid, compression float64) []digestCentroid {
+	sort.Slice(centroids, func(i, j int) bool { return centroids[i].mean < centroids[j].mean })
+
+	var total int64
+	for _, c := range centroids {
+		total += c.count
+	}
+
+	var merged []digestCentroid
+	var before int64 // weight of the centroids before the last merged one
+	for _, c := range centroids {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			count := last.count + c.count
+			q := (float64(before) + float64(count)/2) / float64(total)
+			if float64(count) <= 4*float64(total)*q*(1-q)/compression {
+				last.mean += float64(c.count) * (c.mean - last.mean) / float64(count)
+				last.count = count
+				continue
+			}
+			before += last.count
+		}
+		merged = append(merged, c)
+	}
+	return merged
+}
+
+// TimeMetricSnapshot is a serializable copy of a TimeMetric
+type TimeMetricSnapshot struct {
+	Digest []byte  `json:"digest,omitempty"`
+	Count  int     `json:"count"`
+	Sum    float64 `json:"sum"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+}
+
+type MetricSample struct {
+	TotalRequests      int
+	TotalConnectErrors int
+	TotalTimeoutErrors int
+	TotalDropped       int
+	TotalWhileDown     int
+	TotalWarmUp        int
+	TotalHttp2XX       int
+	TotalHttp3XX       int
+	TotalHttp4XX       int
+	TotalHttp5XX       int
+	StatusAgreement    StatusMatrix
+	ErrorCounts        ErrorCounts
+	ConnectTime        MetricValues
+	TTFB               MetricValues
+	TotalTime          MetricValues
+	StatusTTFB         [StatusClassError]MetricValues
+	StatusTotalTime    [StatusClassError]MetricValues
+	ErrorTime          [NumErrorClasses]MetricValues
+	PhaseTime          [NumPhases]MetricValues
+	TotalStalled       int
+	TotalTruncated     int
+	RangeOutcomes      [NumRangeOutcomes]int
+	TransferBytes      int64
+	TransferSeconds    float64
+	LongestStall       MetricValues
+	TimeToMark         [len(transferMarks)]MetricValues
+	RPC                map[string]RPCSample // statistics of requests to the kubo RPC API by command
+	DispatchLag        MetricValues
+	Backends           map[string]BackendSample // statistics of requests by the address of the backend they were sent to
+	Windows            []WindowSample           // statistics over recent periods of time, shortest first
+}
+
+// MetricValues contains timings in seconds
+type MetricValues struct {
+	Count int
+	Mean  float64
+	Max   float64
+	Min   float64
+	P50   float64
+	P75   float64
+	P90   float64
+	P95   float64
+	P99   float64
+	P999  float64
+}
+
+// latencyBuckets are the histogram buckets used for request latencies
+var latencyBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60, 120, 240}
+
+// dispatchBuckets are the histogram buckets used for the small delays between a request
+// being dispatched and sent to each target
+var dispatchBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+func NewHistogramMetric(name string, help string, labels []string) (*prometheus.HistogramVec, error) {
+	return NewHistogramMetricWithBuckets(name, help, labels, latencyBuckets)
+}
+
+func NewHistogramMetricWithBuckets(name string, help string, labels []string, buckets []float64) (*prometheus.HistogramVec, error) {
+	m := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "thunderdome",
+			Subsystem: "dealgood",
+			Name:      name,
+			Help:      help,
+			Buckets:   buckets,
+		},
+		labels,
+	)
+	if err := prometheus.Register(m); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			m = are.ExistingCollector.(*prometheus.HistogramVec)
+		} else {
+			return nil, fmt.Errorf("register %s histogram: %w", name, err)
+		}
+	}
+	return m, nil
+}
+
+func NewCounterMetric(name string, help string, labels []string) (*prometheus.CounterVec, error) {
+	m := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "thunderdome",
+			Subsystem: "dealgood",
+			Name:      name,
+			Help:      help,
+		},
+		labels,
+	)
+	if err := prometheus.Register(m); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			m = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			return nil, fmt.Errorf("register %s counter: %w", name, err)
+		}
+	}
+	return m, nil
+}
+
+func NewGaugeMetric(name string, help string, labels []string) (*prometheus.GaugeVec, error) {
+	m := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "thunderdome",
+			Subsystem: "dealgood",
+			Name:      name,
+			Help:      help,
+		},
+		labels,
+	)
+	if err := prometheus.Register(m); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			m = are.ExistingCollector.(*prometheus.GaugeVec)
+		} else {
+			return nil, fmt.Errorf("register %s gauge: %w", name, err)
+		}
+	}
+	return m, nil
+}
+
+func DurationDesc(d int) string {
+	if d == -1 {
+		return "forever"
+	}
+
+	s := (time.Duration(d) * time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
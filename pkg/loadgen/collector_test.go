@@ -0,0 +1,179 @@
+package loadgen
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/spenczar/tdigest"
+)
+
+// digestWeight returns the total weight of the centroids in a digest.
+func digestWeight(t *testing.T, d *tdigest.TDigest) int64 {
+	t.Helper()
+	p, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal digest: %v", err)
+	}
+	var total int64
+	for off := 2 + 4 + 8 + 4; off+16 <= len(p); off += 16 {
+		total += int64(binary.LittleEndian.Uint64(p[off:]))
+	}
+	return total
+}
+
+func TestAddEncodedDigest(t *testing.T) {
+	src := tdigest.New()
+	for i := 1; i <= 10000; i++ {
+		src.Add(float64(i), 1)
+	}
+	p, err := src.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal digest: %v", err)
+	}
+
+	d := tdigest.New()
+	if err := addEncodedDigest(d, p); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := addEncodedDigest(d, p); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := digestWeight(t, d); got != 20000 {
+		t.Errorf("got total weight %d, wanted 20000", got)
+	}
+	for _, q := range []float64{0.1, 0.5, 0.9, 0.99} {
+		want := q * 10000
+		if got := d.Quantile(q); math.Abs(got-want)/want > 0.02 {
+			t.Errorf("got quantile %g of %g, wanted about %g", q, got, want)
+		}
+	}
+
+	for _, p := range [][]byte{nil, {1, 2, 3}, p[:len(p)-5]} {
+		if err := addEncodedDigest(tdigest.New(), p); err == nil {
+			t.Errorf("got no error for invalid encoding of %d bytes", len(p))
+		}
+	}
+}
+
+func TestAddEncodedDigestRepeated(t *testing.T) {
+	src := tdigest.New()
+	for i := 1; i <= 10000; i++ {
+		src.Add(float64(i), 1)
+	}
+	p, err := src.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal digest: %v", err)
+	}
+
+	// a coordinator merges snapshots from many workers throughout an experiment
+	d := tdigest.New()
+	for i := 0; i < 2000; i++ {
+		if err := addEncodedDigest(d, p); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if got := digestWeight(t, d); got != 2000*10000 {
+		t.Errorf("got total weight %d, wanted %d", got, 2000*10000)
+	}
+	merged, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal digest: %v", err)
+	}
+	if got, limit := len(decodeCentroids(merged)), 1000; got > limit {
+		t.Errorf("got %d centroids, wanted at most %d", got, limit)
+	}
+	for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99} {
+		want := src.Quantile(q)
+		if got := d.Quantile(q); math.Abs(got-want)/want > 0.02 {
+			t.Errorf("got quantile %g of %g, wanted about %g", q, got, want)
+		}
+	}
+}
+
+func TestTimeMetricMerge(t *testing.T) {
+	a := NewTimeMetric()
+	b := NewTimeMetric()
+	for i := 1; i <= 1000; i++ {
+		a.Add(float64(i) / 1000)
+		b.Add(float64(i+1000) / 1000)
+	}
+
+	// snapshots are sent between workers and the coordinator as json
+	merged := NewTimeMetric()
+	for _, m := range []*TimeMetric{a, NewTimeMetric(), b} {
+		data, err := json.Marshal(m.Snapshot())
+		if err != nil {
+			t.Fatalf("marshal snapshot: %v", err)
+		}
+		var snap TimeMetricSnapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			t.Fatalf("unmarshal snapshot: %v", err)
+		}
+		if err := merged.Merge(&snap); err != nil {
+			t.Fatalf("merge: %v", err)
+		}
+	}
+	if err := merged.Merge(nil); err != nil {
+		t.Fatalf("merge nil snapshot: %v", err)
+	}
+
+	v := merged.Values()
+	if merged.Count != 2000 {
+		t.Errorf("got count %d, wanted 2000", merged.Count)
+	}
+	if math.Abs(v.Mean-1.0005) > 1e-9 {
+		t.Errorf("got mean %g, wanted 1.0005", v.Mean)
+	}
+	if v.Min != 0.001 || v.Max != 2 {
+		t.Errorf("got min %g and max %g, wanted 0.001 and 2", v.Min, v.Max)
+	}
+	if math.Abs(v.P50-1)/1 > 0.02 || math.Abs(v.P90-1.8)/1.8 > 0.02 {
+		t.Errorf("got p50 %g and p90 %g, wanted about 1 and 1.8", v.P50, v.P90)
+	}
+	if got := digestWeight(t, merged.Digest); got != 2000 {
+		t.Errorf("got total digest weight %d, wanted 2000", got)
+	}
+
+	bad := &TimeMetricSnapshot{Count: 1, Digest: []byte{1, 2, 3}}
+	if err := NewTimeMetric().Merge(bad); err == nil {
+		t.Errorf("got no error merging an invalid digest")
+	}
+}
+
+func TestCollectorFinalSnapshot(t *testing.T) {
+	timings := make(chan *RequestTiming, 1000)
+	coll, err := NewCollector(timings, time.Hour)
+	if err != nil {
+		t.Fatalf("new collector: %v", err)
+	}
+
+	// timings still queued when the loader stops are included in the final snapshot
+	for i := 0; i < 1000; i++ {
+		timings <- &RequestTiming{ExperimentName: "collector", TargetName: "target", StatusCode: 200, TTFB: time.Millisecond, TotalTime: time.Millisecond}
+	}
+	close(timings)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		coll.Run(context.Background())
+	}()
+	<-done
+
+	snaps, err := coll.Snapshot(context.Background())
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if snaps["target"] == nil || snaps["target"].TotalRequests != 1000 {
+		t.Fatalf("got final snapshot %+v, wanted 1000 requests", snaps["target"])
+	}
+	if got := coll.Latest()["target"].TotalRequests; got != 1000 {
+		t.Errorf("got %d requests in the latest sample, wanted 1000", got)
+	}
+}
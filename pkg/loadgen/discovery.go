@@ -0,0 +1,188 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	schema "github.com/probe-lab/thunderdome/pkg/exp"
+	"github.com/probe-lab/thunderdome/pkg/request"
+)
+
+// defaultDiscoveryInterval is the time between checking for changes to the discovered
+// targets when the experiment does not specify one.
+const defaultDiscoveryInterval = 10 * time.Second
+
+type DiscoveryJSON = schema.DiscoveryJSON
+
+// A TargetProvider supplies the definitions of the targets an experiment should be
+// sending requests to.
+type TargetProvider interface {
+	// Targets returns the current list of target definitions.
+	Targets(ctx context.Context) ([]*TargetJSON, error)
+
+	// Name returns a description of where the targets come from
+	Name() string
+}
+
+// A TargetDiscovery watches a provider for changes to the targets of a running experiment.
+type TargetDiscovery struct {
+	Provider TargetProvider
+	Interval time.Duration // time between checking the provider for changes
+
+	exp *Experiment // experiment used to create targets and routers for discovered targets
+}
+
+func newTargetDiscovery(dj *DiscoveryJSON, exp *Experiment) (*TargetDiscovery, error) {
+	if dj == nil {
+		return nil, nil
+	}
+	if dj.Interval < 0 {
+		return nil, fmt.Errorf("interval must not be negative")
+	}
+
+	d := &TargetDiscovery{
+		Interval: defaultDiscoveryInterval,
+		exp:      exp,
+	}
+	if dj.Interval > 0 {
+		d.Interval = time.Duration(dj.Interval) * time.Second
+	}
+
+	switch {
+	case dj.File != "" && dj.SRV != "":
+		return nil, fmt.Errorf("only one of file or srv may be specified")
+	case dj.File != "":
+		d.Provider = &fileTargetProvider{fname: dj.File}
+	case dj.SRV != "":
+		scheme := dj.Scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		if scheme != "http" && scheme != "https" {
+			return nil, fmt.Errorf("unsupported scheme: %q", scheme)
+		}
+		d.Provider = &srvTargetProvider{name: dj.SRV, scheme: scheme}
+	default:
+		return nil, fmt.Errorf("one of file or srv must be specified")
+	}
+
+	return d, nil
+}
+
+// Watch checks the provider for changes at every interval until the context is canceled.
+// It sends the complete list of target definitions on the returned channel when first
+// read and again each time they change. Errors are reported and the previous list is
+// kept so a missing or partially written file does not remove every target.
+func (d *TargetDiscovery) Watch(ctx context.Context, quiet bool) <-chan []*TargetJSON {
+	changes := make(chan []*TargetJSON)
+	go func() {
+		defer close(changes)
+
+		var last []byte
+		t := time.NewTicker(d.Interval)
+		defer t.Stop()
+		for {
+			tjs, err := d.Provider.Targets(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				fmt.Fprintf(os.Stderr, "discover targets from %s => error %v\n", d.Provider.Name(), err)
+			} else if data, err := json.Marshal(tjs); err == nil && (last == nil || !bytes.Equal(data, last)) {
+				last = data
+				if !quiet {
+					fmt.Printf("discovered %d targets from %s\n", len(tjs), d.Provider.Name())
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case changes <- tjs:
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return changes
+}
+
+// fileTargetProvider reads targets from a JSON file holding a list of target definitions.
+// The file is polled rather than watched for events since those are not delivered for
+// network file systems such as EFS.
+type fileTargetProvider struct {
+	fname string
+}
+
+func (p *fileTargetProvider) Name() string { return "file " + p.fname }
+
+func (p *fileTargetProvider) Targets(ctx context.Context) ([]*TargetJSON, error) {
+	data, err := os.ReadFile(p.fname)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	var tjs []*TargetJSON
+	if err := json.Unmarshal(data, &tjs); err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+	return tjs, nil
+}
+
+// srvTargetProvider creates a target for each of the SRV records of a DNS name, named
+// after the host and port of the record.
+type srvTargetProvider struct {
+	name   string
+	scheme string
+}
+
+func (p *srvTargetProvider) Name() string { return "srv " + p.name }
+
+func (p *srvTargetProvider) Targets(ctx context.Context) ([]*TargetJSON, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", p.name)
+	if err != nil {
+		return nil, fmt.Errorf("lookup: %w", err)
+	}
+
+	tjs := make([]*TargetJSON, 0, len(srvs))
+	for _, srv := range srvs {
+		hostport := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		tjs = append(tjs, &TargetJSON{
+			Name:    hostport,
+			BaseURL: p.scheme + "://" + hostport,
+		})
+	}
+	// records are returned in priority order with random ordering within each priority
+	sort.Slice(tjs, func(i, j int) bool { return tjs[i].Name < tjs[j].Name })
+	return tjs, nil
+}
+
+// A discoveredTarget is a target that was added to a running experiment by discovery.
+type discoveredTarget struct {
+	target *Target
+	spec   string             // JSON definition the target was created from, used to detect changes
+	active bool               // the target passed its ready check and is being sent requests
+	ctx    context.Context    // used for probing, health monitoring and address refreshing of the target
+	cancel context.CancelFunc // stops probing, health monitoring and address refreshing of the target
+}
+
+// idleRouter routes requests to no targets. It is used while an experiment that
+// discovers its targets has none.
+type idleRouter struct {
+	mode string
+}
+
+func (r *idleRouter) Mode() string { return r.mode }
+
+func (r *idleRouter) Route(*request.Request) []*Target { return nil }
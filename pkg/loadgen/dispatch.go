@@ -0,0 +1,130 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/probe-lab/thunderdome/pkg/request"
+)
+
+const (
+	DispatchRandom  = "random"  // each request is handed to its targets in a random order
+	DispatchBarrier = "barrier" // each request is handed to its targets in a random order and released to all of them at once
+)
+
+// maxBarrierWait is the longest time a worker waits at the release barrier for the
+// workers of other targets to receive the same request.
+const maxBarrierWait = time.Second
+
+func validDispatchMode(mode string) error {
+	switch mode {
+	case DispatchRandom, DispatchBarrier:
+		return nil
+	default:
+		return fmt.Errorf("unsupported dispatch mode: %q", mode)
+	}
+}
+
+// A Dispatch is a request handed to a target along with the other targets the same
+// request was handed to.
+type Dispatch struct {
+	Request *request.Request
+	Group   *dispatchGroup
+}
+
+// A dispatchGroup tracks the targets that a single request was handed to so the time
+// each target started sending it can be compared.
+type dispatchGroup struct {
+	start   time.Time     // time the loader began handing the request to targets
+	barrier bool          // workers wait for every target to receive the request before sending it
+	release chan struct{} // closed once every target has received the request or had it dropped
+	onDone  func(skew time.Duration)
+
+	mu       sync.Mutex // guards following fields
+	expected int        // number of targets the request is being handed to
+	arrived  int        // number of targets that have received the request
+	dropped  int        // number of targets that the request was dropped for
+	first    time.Time  // earliest time a target started sending the request
+	last     time.Time  // latest time a target started sending the request
+	started  int        // number of targets that have started sending the request
+}
+
+// newDispatchGroup creates a group for a request handed to n targets. onDone is called
+// with the difference between the earliest and latest times the targets started
+// sending the request once all of them have done so.
+func newDispatchGroup(n int, barrier bool, onDone func(skew time.Duration)) *dispatchGroup {
+	return &dispatchGroup{
+		start:    time.Now(),
+		barrier:  barrier,
+		release:  make(chan struct{}),
+		onDone:   onDone,
+		expected: n,
+	}
+}
+
+// Arrive records that a target's worker has received the request. When using a barrier
+// it blocks until every target has received the request, the wait exceeds
+// maxBarrierWait or the context is canceled.
+func (g *dispatchGroup) Arrive(ctx context.Context) {
+	g.mu.Lock()
+	g.arrived++
+	g.checkReleased()
+	g.mu.Unlock()
+
+	if !g.barrier {
+		return
+	}
+
+	t := time.NewTimer(maxBarrierWait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	case <-g.release:
+	}
+}
+
+// Drop records that the request could not be handed to one of the targets.
+func (g *dispatchGroup) Drop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.dropped++
+	g.checkReleased()
+	g.checkDone()
+}
+
+// Started records the time a target's worker started sending the request and returns
+// the time since the loader began handing the request to targets.
+func (g *dispatchGroup) Started(t time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.first.IsZero() || t.Before(g.first) {
+		g.first = t
+	}
+	if t.After(g.last) {
+		g.last = t
+	}
+	g.started++
+	g.checkDone()
+	return t.Sub(g.start)
+}
+
+// checkReleased closes the release channel once every target has received the request
+// or had it dropped. It must be called with the lock held.
+func (g *dispatchGroup) checkReleased() {
+	if g.arrived+g.dropped == g.expected {
+		close(g.release)
+	}
+}
+
+// checkDone reports the skew once every target that received the request has started
+// sending it. Skew is only meaningful when more than one target sent the request. It
+// must be called with the lock held.
+func (g *dispatchGroup) checkDone() {
+	if g.started+g.dropped != g.expected || g.started < 2 || g.onDone == nil {
+		return
+	}
+	g.onDone(g.last.Sub(g.first))
+}
@@ -0,0 +1,112 @@
+package loadgen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/net/http2"
+)
+
+// ErrorClass is the probable cause of a failed request.
+type ErrorClass int
+
+const (
+	ErrorNone              ErrorClass = iota
+	ErrorDNS                          // the target's host name could not be resolved
+	ErrorConnectionRefused            // the target refused the connection, usually because it is not running
+	ErrorConnectionReset              // the connection was reset by the target
+	ErrorTLSHandshake                 // the tls handshake with the target failed
+	ErrorUnexpectedEOF                // the connection was closed before the response was complete
+	ErrorHeaderTimeout                // timed out waiting for the response headers
+	ErrorBodyTimeout                  // timed out while reading the response body
+	ErrorHTTP2Stream                  // an http/2 stream or connection error
+	ErrorOther                        // any other error
+	NumErrorClasses
+)
+
+var errorClassNames = [NumErrorClasses]string{
+	ErrorNone:              "none",
+	ErrorDNS:               "dns",
+	ErrorConnectionRefused: "connection_refused",
+	ErrorConnectionReset:   "connection_reset",
+	ErrorTLSHandshake:      "tls_handshake",
+	ErrorUnexpectedEOF:     "unexpected_eof",
+	ErrorHeaderTimeout:     "header_timeout",
+	ErrorBodyTimeout:       "body_timeout",
+	ErrorHTTP2Stream:       "http2_stream",
+	ErrorOther:             "other",
+}
+
+func (e ErrorClass) String() string {
+	if e < 0 || e >= NumErrorClasses {
+		return "unknown"
+	}
+	return errorClassNames[e]
+}
+
+// ErrorCounts counts failed requests by ErrorClass
+type ErrorCounts [NumErrorClasses]int
+
+// Merge adds the counts from another set of counts.
+func (c *ErrorCounts) Merge(o *ErrorCounts) {
+	for i := range c {
+		c[i] += o[i]
+	}
+}
+
+// classifyError determines the probable cause of an error returned while sending a
+// request or reading its response. inBody should be true if the error occurred while
+// reading the response body.
+func classifyError(err error, inBody bool) ErrorClass {
+	if err == nil {
+		return ErrorNone
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ErrorDNS
+	}
+
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &recordErr) || errors.As(err, &certErr) || errors.As(err, &alertErr) || errors.As(err, &unknownAuthErr) || errors.As(err, &invalidErr) || errors.As(err, &hostnameErr) {
+		return ErrorTLSHandshake
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrorConnectionRefused
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return ErrorConnectionReset
+	}
+
+	var streamErr http2.StreamError
+	var goAwayErr http2.GoAwayError
+	var connErr http2.ConnectionError
+	if errors.As(err, &streamErr) || errors.As(err, &goAwayErr) || errors.As(err, &connErr) {
+		return ErrorHTTP2Stream
+	}
+
+	if os.IsTimeout(err) || errors.Is(err, os.ErrDeadlineExceeded) {
+		if inBody {
+			return ErrorBodyTimeout
+		}
+		return ErrorHeaderTimeout
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return ErrorUnexpectedEOF
+	}
+
+	return ErrorOther
+}
@@ -0,0 +1,57 @@
+package loadgen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestClassifyError(t *testing.T) {
+	opErr := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://example.com/", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}}
+	}
+
+	testCases := []struct {
+		name   string
+		err    error
+		inBody bool
+		want   ErrorClass
+	}{
+		{name: "nil", err: nil, want: ErrorNone},
+		{name: "dns", err: &url.Error{Op: "Get", URL: "http://example.com/", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.com"}}}, want: ErrorDNS},
+		{name: "connection refused", err: opErr(syscall.ECONNREFUSED), want: ErrorConnectionRefused},
+		{name: "connection reset", err: opErr(syscall.ECONNRESET), want: ErrorConnectionReset},
+		{name: "broken pipe", err: opErr(syscall.EPIPE), want: ErrorConnectionReset},
+		{name: "tls record header", err: fmt.Errorf("wrapped: %w", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), want: ErrorTLSHandshake},
+		{name: "tls alert", err: fmt.Errorf("wrapped: %w", tls.AlertError(40)), want: ErrorTLSHandshake},
+		{name: "tls certificate verification", err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, want: ErrorTLSHandshake},
+		{name: "x509 unknown authority", err: fmt.Errorf("wrapped: %w", x509.UnknownAuthorityError{}), want: ErrorTLSHandshake},
+		{name: "x509 invalid certificate", err: fmt.Errorf("wrapped: %w", x509.CertificateInvalidError{Reason: x509.Expired}), want: ErrorTLSHandshake},
+		{name: "x509 hostname", err: fmt.Errorf("wrapped: %w", x509.HostnameError{Host: "example.com"}), want: ErrorTLSHandshake},
+		{name: "tls wording alone", err: errors.New("remote error: TLS handshake failure"), want: ErrorOther},
+		{name: "http2 stream", err: fmt.Errorf("wrapped: %w", http2.StreamError{StreamID: 1, Code: http2.ErrCodeInternal}), want: ErrorHTTP2Stream},
+		{name: "http2 goaway", err: http2.GoAwayError{ErrCode: http2.ErrCodeNo}, want: ErrorHTTP2Stream},
+		{name: "header timeout", err: fmt.Errorf("wrapped: %w", os.ErrDeadlineExceeded), want: ErrorHeaderTimeout},
+		{name: "body timeout", err: fmt.Errorf("wrapped: %w", os.ErrDeadlineExceeded), inBody: true, want: ErrorBodyTimeout},
+		{name: "unexpected eof", err: fmt.Errorf("wrapped: %w", io.ErrUnexpectedEOF), inBody: true, want: ErrorUnexpectedEOF},
+		{name: "eof", err: io.EOF, want: ErrorUnexpectedEOF},
+		{name: "other", err: errors.New("something else"), want: ErrorOther},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := classifyError(tc.err, tc.inBody); got != tc.want {
+				t.Errorf("got %s, wanted %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,382 @@
+package loadgen
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	schema "github.com/probe-lab/thunderdome/pkg/exp"
+)
+
+type ExperimentJSON = schema.ExperimentJSON
+
+type TargetJSON = schema.TargetJSON
+
+type Experiment struct {
+	Name        string
+	Rate        int
+	Concurrency int
+	Duration    int
+	WarmUp      int
+	Stall       time.Duration
+	Limits      TransferLimits
+	Ranges      *RangeGenerator
+	Targets     []*Target
+	Router      Router
+	Dispatch    string
+	Health      *HealthConfig
+	Resolve     time.Duration     // time between refreshing the addresses of targets, zero if disabled
+	Discovery   *TargetDiscovery  // adds and removes targets while the experiment runs, nil if targets are fixed
+	Baseline    string            // name of the target the others are compared with, empty if there is none
+	Sequential  *SequentialConfig // sequential test comparing targets with a baseline, nil if disabled
+
+	routing  *RoutingJSON  // how requests are distributed to targets, used to rebuild the router when targets change
+	probe    *ProbeConfig  // default probe for targets
+	rewrites []RewriteRule // rules applied to requests sent to every target
+}
+
+type Target struct {
+	Name        string         // short name of the target to be used in reports and metrics
+	Group       string         // name of the group of identical replicas the target belongs to, empty if it is not in one
+	BaseURL     string         // base URL of the target
+	BasePath    string         // prefix added to the path of every request, without a trailing slash
+	HostName    string         // the name of the host to be sent in the Host header of requests (may be different to the target's own host name)
+	URLScheme   string         // http or https
+	RawHostPort string         // hostname and port of target as derived from the URL
+	Header      http.Header    // extra headers sent with every request, including any credentials
+	TLS         *tls.Config    // configuration of connections to the target when using https
+	Requests    chan *Dispatch // channel used to receive requests to be issued to the target
+	Rewrites    []RewriteRule  // rules applied to each request before it is sent to the target
+	Weight      int            // relative share of requests the target receives when not broadcasting requests
+	Role        string         // role of the target assigned by the experiment's router
+	Health      *TargetHealth  // health of the target as observed from requests and probes
+	Probe       *ProbeConfig   // how the target is probed to check it is ready
+
+	mu    sync.Mutex // guards accesses to addrs which may change over time
+	addrs []string   // addresses the target's host resolved to, requests are balanced across them
+	next  int        // index of the address to use for the next request
+}
+
+// HostPort returns the address to send the next request to, cycling through each of the
+// addresses the target's host resolved to.
+func (t *Target) HostPort() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	hostport := t.addrs[t.next%len(t.addrs)]
+	t.next++
+	return hostport
+}
+
+// Addrs returns the addresses the target's host resolved to.
+func (t *Target) Addrs() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.addrs...)
+}
+
+// SetAddrs sets the addresses the target's host resolved to and reports whether they
+// changed.
+func (t *Target) SetAddrs(addrs []string) bool {
+	if len(addrs) == 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if slices.Equal(t.addrs, addrs) {
+		return false
+	}
+	t.addrs = append([]string(nil), addrs...)
+	return true
+}
+
+// SetTargetURLs sets the base urls of an experiment's targets from a list of name::url
+// pairs, so an experiment written for thunderdome can be rehearsed against targets run
+// locally. Every target must have a base url once the pairs have been applied.
+func SetTargetURLs(expjson *ExperimentJSON, urls []string) error {
+	byName := make(map[string]*TargetJSON, len(expjson.Targets))
+	for _, tj := range expjson.Targets {
+		byName[tj.Name] = tj
+	}
+
+	for _, u := range urls {
+		name, base, found := strings.Cut(u, "::")
+		if !found {
+			return fmt.Errorf("target url %q must be prefixed by the name of a target in the experiment", u)
+		}
+		tj, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("target %q not found in experiment", name)
+		}
+		tj.BaseURL = base
+	}
+
+	for _, tj := range expjson.Targets {
+		if tj.BaseURL == "" {
+			return fmt.Errorf("target %q has no base url, supply one using --targets %s::URL", tj.Name, tj.Name)
+		}
+	}
+	return nil
+}
+
+func NewExperiment(expjson *ExperimentJSON) (*Experiment, error) {
+	if expjson.Name == "" {
+		return nil, fmt.Errorf("experiment name must be specified")
+	}
+	if expjson.MaxRequestRate <= 0 {
+		return nil, fmt.Errorf("rate must be greater than zero")
+	}
+	if expjson.MaxConcurrency <= 0 {
+		return nil, fmt.Errorf("concurrency must be greater than zero")
+	}
+	if expjson.Duration <= 0 && expjson.Duration != -1 {
+		return nil, fmt.Errorf("duration must be -1 or greater than zero ")
+	}
+	if expjson.WarmUp < 0 {
+		return nil, fmt.Errorf("warm up must not be negative")
+	}
+	if expjson.Stall < 0 {
+		return nil, fmt.Errorf("stall must not be negative")
+	}
+	if expjson.MaxBodySize < 0 {
+		return nil, fmt.Errorf("max body size must not be negative")
+	}
+	if expjson.MaxTransfer < 0 {
+		return nil, fmt.Errorf("max transfer time must not be negative")
+	}
+
+	if expjson.Resolve < -1 {
+		return nil, fmt.Errorf("resolve interval must be -1 or greater")
+	}
+
+	if expjson.Dispatch == "" {
+		expjson.Dispatch = DispatchRandom
+	}
+	if err := validDispatchMode(expjson.Dispatch); err != nil {
+		return nil, err
+	}
+
+	if len(expjson.Targets) == 0 && expjson.Discovery == nil {
+		return nil, fmt.Errorf("at least one target must be specified")
+	}
+
+	exp := &Experiment{
+		Name:        expjson.Name,
+		Rate:        expjson.MaxRequestRate,
+		Concurrency: expjson.MaxConcurrency,
+		Duration:    expjson.Duration,
+		WarmUp:      expjson.WarmUp,
+		Dispatch:    expjson.Dispatch,
+		Resolve:     defaultResolveInterval,
+		Stall:       DefaultStallThreshold,
+		Limits: TransferLimits{
+			MaxBytes: expjson.MaxBodySize,
+			MaxTime:  time.Duration(expjson.MaxTransfer) * time.Second,
+		},
+		routing: expjson.Routing,
+	}
+	switch {
+	case expjson.Resolve == -1:
+		exp.Resolve = 0
+	case expjson.Resolve > 0:
+		exp.Resolve = time.Duration(expjson.Resolve) * time.Second
+	}
+	if expjson.Stall > 0 {
+		exp.Stall = time.Duration(expjson.Stall) * time.Second
+	}
+
+	var err error
+	exp.rewrites, err = newRewriteRules(expjson.Rewrite)
+	if err != nil {
+		return nil, fmt.Errorf("experiment rewrite: %w", err)
+	}
+
+	exp.Ranges, err = newRangeGenerator(expjson.Ranges)
+	if err != nil {
+		return nil, fmt.Errorf("ranges: %w", err)
+	}
+
+	exp.probe, err = newProbeConfig(expjson.Probe, defaultProbe)
+	if err != nil {
+		return nil, fmt.Errorf("probe: %w", err)
+	}
+
+	exp.Health, err = newHealthConfig(expjson.Health)
+	if err != nil {
+		return nil, fmt.Errorf("health: %w", err)
+	}
+
+	exp.Discovery, err = newTargetDiscovery(expjson.Discovery, exp)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+
+	seenNames := map[string]bool{}
+	for i, tj := range expjson.Targets {
+		t, err := exp.newTarget(tj, fmt.Sprintf("target %d", i+1))
+		if err != nil {
+			return nil, err
+		}
+
+		if seenNames[t.Name] {
+			return nil, fmt.Errorf("duplicate target name found: %s", t.Name)
+		}
+		seenNames[t.Name] = true
+
+		exp.Targets = append(exp.Targets, t)
+	}
+
+	exp.Router, err = exp.newRouter(exp.Targets)
+	if err != nil {
+		return nil, fmt.Errorf("routing: %w", err)
+	}
+
+	if expjson.Baseline != "" && !seenNames[expjson.Baseline] && exp.Discovery == nil {
+		return nil, fmt.Errorf("baseline target %q not found in experiment", expjson.Baseline)
+	}
+	exp.Baseline = expjson.Baseline
+
+	exp.Sequential, err = newSequentialConfig(expjson.Sequential, exp.Baseline, expjson.Targets, exp.Discovery != nil)
+	if err != nil {
+		return nil, fmt.Errorf("sequential: %w", err)
+	}
+
+	return exp, nil
+}
+
+// TargetGroups returns the group of each of the experiment's targets that is a replica,
+// keyed by target name.
+func (exp *Experiment) TargetGroups() map[string]string {
+	groups := map[string]string{}
+	for _, t := range exp.Targets {
+		if t.Group != "" {
+			groups[t.Name] = t.Group
+		}
+	}
+	return groups
+}
+
+// NewLoader creates a loader that sends requests from source to the experiment's targets
+// using the experiment's settings, sending the timing of each request to timings.
+func (exp *Experiment) NewLoader(source RequestSource, timings chan *RequestTiming) (*Loader, error) {
+	l, err := NewLoader(exp.Name, exp.Targets, source, timings, exp.Rate, exp.Concurrency, exp.Duration)
+	if err != nil {
+		return nil, err
+	}
+	l.Router = exp.Router
+	l.WarmUp = exp.WarmUp
+	l.Stall = exp.Stall
+	l.Limits = exp.Limits
+	l.Ranges = exp.Ranges
+	l.Dispatch = exp.Dispatch
+	l.Resolve = exp.Resolve
+	l.Discovery = exp.Discovery
+	return l, nil
+}
+
+// targetName returns the name of the target, which defaults to the host name of its base
+// URL.
+func targetName(tj *TargetJSON) string {
+	if tj.Name != "" {
+		return tj.Name
+	}
+	if u, err := url.Parse(tj.BaseURL); err == nil {
+		return u.Hostname()
+	}
+	return ""
+}
+
+// newTarget creates a target from its definition, applying the experiment's probe and
+// rewrite rules. desc identifies the target in any error.
+func (exp *Experiment) newTarget(tj *TargetJSON, desc string) (*Target, error) {
+	if tj.BaseURL == "" {
+		return nil, fmt.Errorf("%s must have a base url", desc)
+	}
+
+	u, err := url.Parse(tj.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s must have a valid base url: %w", desc, err)
+	}
+
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("%s base url should not have a query or fragment", desc)
+	}
+
+	tj.Name = targetName(tj)
+
+	t := &Target{
+		Name:        tj.Name,
+		Group:       tj.Group,
+		BaseURL:     tj.BaseURL,
+		HostName:    u.Hostname(),
+		URLScheme:   u.Scheme,
+		BasePath:    strings.TrimSuffix(u.Path, "/"),
+		RawHostPort: u.Host,
+		addrs:       []string{u.Host},
+		Requests:    make(chan *Dispatch),
+	}
+
+	// allow host to be overridden
+	if tj.Host != "" {
+		t.HostName = tj.Host
+	}
+
+	t.Header, err = newTargetHeader(tj.Headers, tj.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", desc, err)
+	}
+
+	t.TLS, err = newTLSConfig(tj.TLS, t.HostName)
+	if err != nil {
+		return nil, fmt.Errorf("%s tls: %w", desc, err)
+	}
+
+	if tj.Weight < 0 {
+		return nil, fmt.Errorf("%s weight must not be negative", desc)
+	}
+	t.Weight = tj.Weight
+	if t.Weight == 0 {
+		t.Weight = 1
+	}
+
+	t.Probe, err = newProbeConfig(tj.Probe, exp.probe)
+	if err != nil {
+		return nil, fmt.Errorf("%s probe: %w", desc, err)
+	}
+
+	t.Health, err = NewTargetHealth(exp.Name, t.Name, exp.Health)
+	if err != nil {
+		return nil, fmt.Errorf("%s health: %w", desc, err)
+	}
+
+	targetRewrites, err := newRewriteRules(tj.Rewrite)
+	if err != nil {
+		return nil, fmt.Errorf("%s rewrite: %w", desc, err)
+	}
+	t.Rewrites = append(t.Rewrites, exp.rewrites...)
+	t.Rewrites = append(t.Rewrites, targetRewrites...)
+
+	return t, nil
+}
+
+// newRouter creates a router for the given targets using the experiment's routing. When
+// there are no targets yet, requests are routed nowhere until some are discovered.
+func (exp *Experiment) newRouter(targets []*Target) (Router, error) {
+	if len(targets) == 0 && exp.Discovery != nil {
+		mode := RoutingBroadcast
+		if exp.routing != nil && exp.routing.Mode != "" {
+			mode = exp.routing.Mode
+		}
+		switch mode {
+		case RoutingBroadcast, RoutingHash, RoutingSplit, RoutingMirror:
+		default:
+			return nil, fmt.Errorf("unsupported routing mode: %q", mode)
+		}
+		return &idleRouter{mode: mode}, nil
+	}
+	return newRouter(exp.routing, targets)
+}
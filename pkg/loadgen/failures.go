@@ -0,0 +1,250 @@
+package loadgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/probe-lab/thunderdome/pkg/request"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A FailureSample holds the details of a failed or anomalous request.
+type FailureSample struct {
+	Time           time.Time         `json:"time"`                      // time the request was sent
+	Target         string            `json:"target"`                    // name of the target the request was sent to
+	Backend        string            `json:"backend,omitempty"`         // address of the backend the request was sent to
+	Reason         string            `json:"reason"`                    // why the request was captured: error, status, disagreement, stalled, truncated, range or rpc
+	Method         string            `json:"method"`                    // method of the request
+	URI            string            `json:"uri"`                       // path and query of the request
+	RequestHeader  http.Header       `json:"request_header,omitempty"`  // headers sent with the request, after rewrites were applied
+	OriginStatus   int               `json:"origin_status,omitempty"`   // status returned by the original gateway, zero if not known
+	Status         int               `json:"status,omitempty"`          // status of the response, zero if no response was received
+	ResponseHeader http.Header       `json:"response_header,omitempty"` // headers of the response
+	Body           string            `json:"body,omitempty"`            // the start of the response body
+	BodyTruncated  bool              `json:"body_truncated,omitempty"`  // the response body was longer than the captured part
+	Error          string            `json:"error,omitempty"`           // text of any error encountered
+	Timings        FailureTimingJSON `json:"timings"`                   // timings of the request
+	TraceID        string            `json:"trace_id,omitempty"`        // id of the trace recorded for the request
+}
+
+// FailureTimingJSON holds the timings of a captured request in seconds
+type FailureTimingJSON struct {
+	Connect      float64 `json:"connect,omitempty"`
+	TTFB         float64 `json:"ttfb,omitempty"`
+	Total        float64 `json:"total"`
+	LongestStall float64 `json:"longest_stall,omitempty"`
+}
+
+// FailuresJSON holds the failures captured for a single target
+type FailuresJSON struct {
+	Seen    int              `json:"seen"`    // number of failed or anomalous requests seen
+	Samples []*FailureSample `json:"samples"` // a uniform random sample of the failed or anomalous requests, oldest first
+}
+
+// failureReason reports why a request should be captured or returns an empty string if
+// the request was neither failed nor anomalous.
+func failureReason(res *RequestTiming) string {
+	switch {
+	case res.Dropped:
+		return ""
+	case res.ConnectError || res.TimeoutError || res.ErrorClass != ErrorNone:
+		return "error"
+	case res.RPCMethod != "" && rpcOutcome(res) != RPCOK:
+		return "rpc"
+	case res.StatusCode >= 500:
+		return "status"
+	}
+	if origin, response, ok := agreementClasses(res); ok && origin != response {
+		return "disagreement"
+	}
+	switch {
+	case res.Range == RangeInvalid || res.Range == RangeMismatch:
+		return "range"
+	case res.Transfer.Truncated:
+		return "truncated"
+	case res.Stalled:
+		return "stalled"
+	}
+	return ""
+}
+
+// newFailureSample creates a sample of a captured request from its timing. req is the
+// request sent to the target or nil if the request could not be created.
+func newFailureSample(res *RequestTiming, reason string, r *request.Request, req *http.Request, start time.Time, err error) *FailureSample {
+	s := &FailureSample{
+		Time:         start,
+		Target:       res.TargetName,
+		Backend:      res.Backend,
+		Reason:       reason,
+		Method:       r.Method,
+		URI:          r.URI,
+		OriginStatus: res.OriginStatus,
+		Status:       res.StatusCode,
+		Timings: FailureTimingJSON{
+			Connect:      res.ConnectTime.Seconds(),
+			TTFB:         res.TTFB.Seconds(),
+			Total:        res.TotalTime.Seconds(),
+			LongestStall: res.Transfer.LongestStall.Seconds(),
+		},
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	if req == nil {
+		s.RequestHeader = make(http.Header, len(r.Header))
+		for k, v := range r.Header {
+			s.RequestHeader.Set(k, v)
+		}
+		return s
+	}
+
+	s.URI = req.URL.RequestURI()
+	s.RequestHeader = req.Header.Clone()
+	// credentials configured for the target must not be exposed with the failures
+	for _, k := range []string{"Authorization", "Proxy-Authorization"} {
+		if s.RequestHeader.Get(k) != "" {
+			s.RequestHeader.Set(k, "[redacted]")
+		}
+	}
+	if sc := trace.SpanContextFromContext(req.Context()); sc.HasTraceID() {
+		s.TraceID = sc.TraceID().String()
+	}
+	return s
+}
+
+// A FailureStore keeps a bounded random sample of the failed and anomalous requests sent
+// to each target.
+type FailureStore struct {
+	size     int // maximum number of samples kept for each target
+	bodySize int // maximum number of bytes of each response body kept
+
+	mu      sync.Mutex // guards following fields
+	rng     *rand.Rand
+	targets map[string]*FailuresJSON
+}
+
+// NewFailureStore creates a store that keeps up to size samples for each target with
+// up to bodySize bytes of each response body. It returns nil if size is zero.
+func NewFailureStore(size int, bodySize int) *FailureStore {
+	if size <= 0 {
+		return nil
+	}
+	return &FailureStore{
+		size:     size,
+		bodySize: bodySize,
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		targets:  make(map[string]*FailuresJSON),
+	}
+}
+
+// Add offers a sample to the store, replacing an existing sample at random once the
+// store is full so that every failure has an equal chance of being kept.
+func (f *FailureStore) Add(s *FailureSample) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fj, ok := f.targets[s.Target]
+	if !ok {
+		fj = &FailuresJSON{}
+		f.targets[s.Target] = fj
+	}
+	fj.Seen++
+	if len(fj.Samples) < f.size {
+		fj.Samples = append(fj.Samples, s)
+		return
+	}
+	if idx := f.rng.Intn(fj.Seen); idx < f.size {
+		// keep the samples in the order they were captured
+		copy(fj.Samples[idx:], fj.Samples[idx+1:])
+		fj.Samples[f.size-1] = s
+	}
+}
+
+// Failures returns a copy of the samples held for each target.
+func (f *FailureStore) Failures() map[string]*FailuresJSON {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	failures := make(map[string]*FailuresJSON, len(f.targets))
+	for name, fj := range f.targets {
+		failures[name] = &FailuresJSON{
+			Seen:    fj.Seen,
+			Samples: append([]*FailureSample(nil), fj.Samples...),
+		}
+	}
+	return failures
+}
+
+// ServeHTTP responds with the samples held for each target as JSON. The target query
+// parameter may be used to select a single target.
+func (f *FailureStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	failures := f.Failures()
+	if name := r.URL.Query().Get("target"); name != "" {
+		fj, ok := failures[name]
+		if !ok {
+			fj = &FailuresJSON{}
+		}
+		failures = map[string]*FailuresJSON{name: fj}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(failures)
+}
+
+// WriteFile writes the samples held for each target to the named file as JSON.
+func (f *FailureStore) WriteFile(fname string) error {
+	data, err := json.MarshalIndent(f.Failures(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if err := os.WriteFile(fname, data, 0o644); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
+
+// Summary returns the number of failures seen and captured for each target, ordered by
+// target name.
+func (f *FailureStore) Summary() []string {
+	failures := f.Failures()
+	names := make([]string, 0, len(failures))
+	for name := range failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s: %d captured of %d failed or anomalous requests", name, len(failures[name].Samples), failures[name].Seen))
+	}
+	return lines
+}
+
+// prefixBuffer keeps the first max bytes written to it and discards the rest.
+type prefixBuffer struct {
+	buf      bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (p *prefixBuffer) Write(b []byte) (int, error) {
+	if room := p.max - p.buf.Len(); room < len(b) {
+		p.overflow = true
+		if room > 0 {
+			p.buf.Write(b[:room])
+		}
+	} else {
+		p.buf.Write(b)
+	}
+	return len(b), nil
+}
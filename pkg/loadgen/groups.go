@@ -0,0 +1,265 @@
+package loadgen
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A GroupSample summarises the statistics of a group of identical replicas of a target.
+type GroupSample struct {
+	Replicas []string        // names of the targets in the group, sorted
+	Pooled   MetricSample    // statistics of the requests sent to every replica combined
+	Spread   []ReplicaSpread // how each metric varies between the replicas
+}
+
+// A ReplicaSpread describes how a metric varies between the replicas in a group. The
+// variation between replicas is the noise caused by differences between instances, which
+// a difference between groups must exceed before it can be attributed to the variants.
+type ReplicaSpread struct {
+	Metric   string  // ttfb_p50, ttfb_p90, ttfb_p99, total_time_p50, total_time_p90, total_time_p99, error_rate or drop_rate
+	Pooled   float64 // value of the metric over the requests sent to every replica combined, NaN if not known
+	Replicas int     // number of replicas that have a value for the metric
+	Mean     float64 // mean of the replicas' values
+	StdDev   float64 // sample standard deviation of the replicas' values, NaN with fewer than two replicas
+	Min      float64 // smallest of the replicas' values
+	Max      float64 // largest of the replicas' values
+	IsRate   bool    // the metric is a rate rather than a time
+}
+
+// StdErr returns the standard error of the mean of the replicas' values.
+func (rs ReplicaSpread) StdErr() float64 {
+	return rs.StdDev / math.Sqrt(float64(rs.Replicas))
+}
+
+// CV returns the coefficient of variation of the replicas' values, NaN if their mean is zero.
+func (rs ReplicaSpread) CV() float64 {
+	if rs.Mean == 0 {
+		return math.NaN()
+	}
+	return rs.StdDev / rs.Mean
+}
+
+// NewGroupSample summarises a group from the statistics of its replicas and of all their
+// requests combined.
+func NewGroupSample(pooled MetricSample, replicas map[string]MetricSample, excludeDown bool) GroupSample {
+	gs := GroupSample{
+		Replicas: make([]string, 0, len(replicas)),
+		Pooled:   pooled,
+		Spread:   replicaSpread(replicas, excludeDown),
+	}
+	for name := range replicas {
+		gs.Replicas = append(gs.Replicas, name)
+	}
+	sort.Strings(gs.Replicas)
+
+	pms := sampleMetrics(pooled, excludeDown)
+	for i := range gs.Spread {
+		for _, pm := range pms {
+			if pm.name == gs.Spread[i].Metric {
+				gs.Spread[i].Pooled = pm.value
+			}
+		}
+	}
+	return gs
+}
+
+// replicaSpread measures how each metric varies between the replicas. Metrics that no
+// replica has a value for are omitted.
+func replicaSpread(replicas map[string]MetricSample, excludeDown bool) []ReplicaSpread {
+	var spreads []ReplicaSpread
+	values := map[string][]float64{}
+	for _, sample := range replicas {
+		for _, m := range sampleMetrics(sample, excludeDown) {
+			if _, ok := values[m.name]; !ok {
+				spreads = append(spreads, ReplicaSpread{Metric: m.name, IsRate: m.isRate})
+				values[m.name] = nil
+			}
+			if !math.IsNaN(m.value) {
+				values[m.name] = append(values[m.name], m.value)
+			}
+		}
+	}
+
+	kept := spreads[:0]
+	for _, rs := range spreads {
+		vs := values[rs.Metric]
+		if len(vs) == 0 {
+			continue
+		}
+		rs.Pooled = math.NaN()
+		rs.Replicas = len(vs)
+		rs.Min, rs.Max = vs[0], vs[0]
+		sum := 0.0
+		for _, v := range vs {
+			sum += v
+			rs.Min = math.Min(rs.Min, v)
+			rs.Max = math.Max(rs.Max, v)
+		}
+		rs.Mean = sum / float64(len(vs))
+		rs.StdDev = math.NaN()
+		if len(vs) > 1 {
+			ss := 0.0
+			for _, v := range vs {
+				ss += (v - rs.Mean) * (v - rs.Mean)
+			}
+			rs.StdDev = math.Sqrt(ss / float64(len(vs)-1))
+		}
+		kept = append(kept, rs)
+	}
+	return kept
+}
+
+// A GroupComparison compares the mean of a metric over the replicas of a group with the
+// mean over the replicas of the baseline group.
+type GroupComparison struct {
+	Metric     string  // name of the metric, as in ReplicaSpread
+	Value      float64 // mean of the group's replicas
+	Baseline   float64 // mean of the baseline group's replicas
+	Difference float64 // value minus the baseline's value
+	StdErr     float64 // standard error of the difference estimated from the variation between replicas, NaN if either group has fewer than two replicas
+	T          float64 // difference divided by its standard error, NaN if the error is not known or is zero
+	IsRate     bool    // the metric is a rate rather than a time
+}
+
+// CompareGroups compares each metric of a group with the baseline group. The T statistic
+// measures the difference in units of between-replica noise: a magnitude much below two
+// is consistent with the groups being the same.
+func CompareGroups(group, baseline GroupSample) []GroupComparison {
+	var comps []GroupComparison
+	for _, gs := range group.Spread {
+		for _, bs := range baseline.Spread {
+			if gs.Metric != bs.Metric {
+				continue
+			}
+			c := GroupComparison{
+				Metric:     gs.Metric,
+				Value:      gs.Mean,
+				Baseline:   bs.Mean,
+				Difference: gs.Mean - bs.Mean,
+				StdErr:     math.Sqrt(gs.StdErr()*gs.StdErr() + bs.StdErr()*bs.StdErr()),
+				T:          math.NaN(),
+				IsRate:     gs.IsRate,
+			}
+			if c.StdErr > 0 {
+				c.T = c.Difference / c.StdErr
+			}
+			comps = append(comps, c)
+		}
+	}
+	return comps
+}
+
+// replicasByGroup divides the samples of targets between the groups they belong to.
+// Targets that are not in a group are left out.
+func replicasByGroup(groupOf map[string]string, samples map[string]MetricSample) map[string]map[string]MetricSample {
+	groups := map[string]map[string]MetricSample{}
+	for name, sample := range samples {
+		group := groupOf[name]
+		if group == "" {
+			continue
+		}
+		if groups[group] == nil {
+			groups[group] = map[string]MetricSample{}
+		}
+		groups[group][name] = sample
+	}
+	return groups
+}
+
+// groupMetrics exports the statistics of replica groups as gauges.
+type groupMetrics struct {
+	replicasGauge *prometheus.GaugeVec
+	pooledGauge   *prometheus.GaugeVec
+	meanGauge     *prometheus.GaugeVec
+	stddevGauge   *prometheus.GaugeVec
+	tGauge        *prometheus.GaugeVec
+}
+
+func newGroupMetrics() (*groupMetrics, error) {
+	gm := &groupMetrics{}
+
+	var err error
+	gm.replicasGauge, err = NewGaugeMetric(
+		"group_replicas",
+		"The number of replicas in each group of identical targets that have been sent requests.",
+		[]string{"experiment", "group"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	gm.pooledGauge, err = NewGaugeMetric(
+		"group_pooled",
+		"Quantiles of the time to first byte and total request time in seconds and the error and drop rates over the requests sent to every replica in a group combined.",
+		[]string{"experiment", "group", "metric"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	gm.meanGauge, err = NewGaugeMetric(
+		"group_replica_mean",
+		"The mean over the replicas in a group of each replica's quantiles of the time to first byte and total request time in seconds and error and drop rates. The window label is 1m, 5m or all for the whole experiment.",
+		[]string{"experiment", "group", "metric", "window"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	gm.stddevGauge, err = NewGaugeMetric(
+		"group_replica_stddev",
+		"The standard deviation between the replicas in a group of each replica's quantiles of the time to first byte and total request time in seconds and error and drop rates. The window label is 1m, 5m or all for the whole experiment.",
+		[]string{"experiment", "group", "metric", "window"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	gm.tGauge, err = NewGaugeMetric(
+		"group_baseline_t",
+		"The difference between the replica means of a group and the baseline's group divided by its standard error estimated from the variation between replicas. The window label is 1m, 5m or all for the whole experiment.",
+		[]string{"experiment", "group", "baseline", "metric", "window"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	return gm, nil
+}
+
+// update sets the gauges describing each group for a window. The baseline group may be
+// empty if there is none.
+func (gm *groupMetrics) update(experimentName string, baseline string, window string, groups map[string]GroupSample) {
+	for name, gs := range groups {
+		if window == "all" {
+			gm.replicasGauge.WithLabelValues(experimentName, name).Set(float64(len(gs.Replicas)))
+		}
+		for _, rs := range gs.Spread {
+			if !math.IsNaN(rs.Pooled) {
+				gm.pooledGauge.WithLabelValues(experimentName, name, rs.Metric).Set(rs.Pooled)
+			}
+			gm.meanGauge.WithLabelValues(experimentName, name, rs.Metric, window).Set(rs.Mean)
+			if !math.IsNaN(rs.StdDev) {
+				gm.stddevGauge.WithLabelValues(experimentName, name, rs.Metric, window).Set(rs.StdDev)
+			}
+		}
+	}
+
+	base, ok := groups[baseline]
+	if !ok {
+		return
+	}
+	for name, gs := range groups {
+		if name == baseline {
+			continue
+		}
+		for _, c := range CompareGroups(gs, base) {
+			if !math.IsNaN(c.T) {
+				gm.tGauge.WithLabelValues(experimentName, name, baseline, c.Metric, window).Set(c.T)
+			}
+		}
+	}
+}
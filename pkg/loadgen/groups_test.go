@@ -0,0 +1,165 @@
+package loadgen
+
+import (
+	"math"
+	"testing"
+)
+
+// testSample returns a sample whose time to first byte quantiles are all v and whose
+// error rate is errors in 100 requests.
+func testSample(v float64, errors int) MetricSample {
+	return MetricSample{
+		TotalRequests: 100,
+		TotalHttp2XX:  100 - errors,
+		TotalHttp5XX:  errors,
+		TTFB:          MetricValues{Count: 100, P50: v, P90: v, P99: v},
+	}
+}
+
+func findSpread(t *testing.T, spreads []ReplicaSpread, metric string) ReplicaSpread {
+	t.Helper()
+	for _, rs := range spreads {
+		if rs.Metric == metric {
+			return rs
+		}
+	}
+	t.Fatalf("no spread for metric %s", metric)
+	return ReplicaSpread{}
+}
+
+func TestReplicaSpread(t *testing.T) {
+	spreads := replicaSpread(map[string]MetricSample{
+		"a": testSample(1, 0),
+		"b": testSample(2, 10),
+		"c": testSample(3, 20),
+	}, false)
+
+	// the total time has not been measured for any replica
+	if len(spreads) != 5 {
+		t.Errorf("got %d metrics, wanted ttfb quantiles and error and drop rates", len(spreads))
+	}
+
+	ttfb := findSpread(t, spreads, "ttfb_p50")
+	if ttfb.Replicas != 3 || ttfb.Mean != 2 || ttfb.Min != 1 || ttfb.Max != 3 || ttfb.IsRate {
+		t.Errorf("got ttfb spread %+v, wanted 3 replicas with mean 2 between 1 and 3", ttfb)
+	}
+	if ttfb.StdDev != 1 {
+		t.Errorf("got standard deviation %g, wanted 1", ttfb.StdDev)
+	}
+	if want := 1 / math.Sqrt(3); math.Abs(ttfb.StdErr()-want) > 1e-12 {
+		t.Errorf("got standard error %g, wanted %g", ttfb.StdErr(), want)
+	}
+	if ttfb.CV() != 0.5 {
+		t.Errorf("got coefficient of variation %g, wanted 0.5", ttfb.CV())
+	}
+	if !math.IsNaN(ttfb.Pooled) {
+		t.Errorf("got pooled value %g, wanted NaN", ttfb.Pooled)
+	}
+
+	errRate := findSpread(t, spreads, "error_rate")
+	if !errRate.IsRate || math.Abs(errRate.Mean-0.1) > 1e-12 || math.Abs(errRate.StdDev-0.1) > 1e-12 {
+		t.Errorf("got error rate spread %+v, wanted mean and standard deviation 0.1", errRate)
+	}
+
+	drop := findSpread(t, spreads, "drop_rate")
+	if drop.Mean != 0 || !math.IsNaN(drop.CV()) {
+		t.Errorf("got drop rate spread %+v with coefficient of variation %g, wanted mean 0 and NaN", drop, drop.CV())
+	}
+}
+
+func TestReplicaSpreadSingleReplica(t *testing.T) {
+	spreads := replicaSpread(map[string]MetricSample{
+		"a": testSample(1, 0),
+		"b": {}, // no requests have been sent yet
+	}, false)
+
+	ttfb := findSpread(t, spreads, "ttfb_p50")
+	if ttfb.Replicas != 1 || ttfb.Mean != 1 {
+		t.Errorf("got ttfb spread %+v, wanted 1 replica with mean 1", ttfb)
+	}
+	if !math.IsNaN(ttfb.StdDev) || !math.IsNaN(ttfb.StdErr()) {
+		t.Errorf("got standard deviation %g and error %g, wanted NaN with one replica", ttfb.StdDev, ttfb.StdErr())
+	}
+
+	if got := replicaSpread(map[string]MetricSample{"a": {}}, false); len(got) != 0 {
+		t.Errorf("got %d metrics for a replica with no requests, wanted none", len(got))
+	}
+}
+
+func TestNewGroupSample(t *testing.T) {
+	replicas := map[string]MetricSample{
+		"b": testSample(2, 0),
+		"a": testSample(4, 0),
+	}
+	gs := NewGroupSample(testSample(3.5, 5), replicas, false)
+
+	if len(gs.Replicas) != 2 || gs.Replicas[0] != "a" || gs.Replicas[1] != "b" {
+		t.Errorf("got replicas %v, wanted [a b]", gs.Replicas)
+	}
+	if got := findSpread(t, gs.Spread, "ttfb_p90").Pooled; got != 3.5 {
+		t.Errorf("got pooled ttfb %g, wanted 3.5", got)
+	}
+	if got := findSpread(t, gs.Spread, "error_rate").Pooled; got != 0.05 {
+		t.Errorf("got pooled error rate %g, wanted 0.05", got)
+	}
+}
+
+func TestCompareGroups(t *testing.T) {
+	group := NewGroupSample(MetricSample{}, map[string]MetricSample{
+		"g1": testSample(1.2, 0),
+		"g2": testSample(1.4, 0),
+		"g3": testSample(1.6, 0),
+	}, false)
+	baseline := NewGroupSample(MetricSample{}, map[string]MetricSample{
+		"b1": testSample(0.9, 0),
+		"b2": testSample(1.0, 0),
+		"b3": testSample(1.1, 0),
+	}, false)
+	single := NewGroupSample(MetricSample{}, map[string]MetricSample{
+		"s1": testSample(5, 0),
+	}, false)
+
+	var ttfb *GroupComparison
+	comps := CompareGroups(group, baseline)
+	for i := range comps {
+		if comps[i].Metric == "ttfb_p50" {
+			ttfb = &comps[i]
+		}
+	}
+	if ttfb == nil {
+		t.Fatalf("no comparison of ttfb_p50")
+	}
+
+	// the replicas' standard deviations are 0.2 and 0.1 so the standard error of the
+	// difference is sqrt(0.04/3 + 0.01/3)
+	wantErr := math.Sqrt(0.05 / 3)
+	if math.Abs(ttfb.Difference-0.4) > 1e-12 || math.Abs(ttfb.StdErr-wantErr) > 1e-12 {
+		t.Errorf("got difference %g with standard error %g, wanted 0.4 with %g", ttfb.Difference, ttfb.StdErr, wantErr)
+	}
+	if want := 0.4 / wantErr; math.Abs(ttfb.T-want) > 1e-9 {
+		t.Errorf("got t %g, wanted %g", ttfb.T, want)
+	}
+
+	for _, c := range CompareGroups(group, group) {
+		if c.Difference != 0 || (c.Metric == "ttfb_p50" && c.T != 0) {
+			t.Errorf("got difference %g and t %g comparing %s of a group with itself, wanted 0", c.Difference, c.T, c.Metric)
+		}
+	}
+
+	// identical replicas give no estimate of the noise between them
+	for _, c := range CompareGroups(group, single) {
+		if !math.IsNaN(c.T) {
+			t.Errorf("got t %g for %s against a single replica, wanted NaN", c.T, c.Metric)
+		}
+	}
+}
+
+func TestReplicasByGroup(t *testing.T) {
+	groups := replicasByGroup(
+		map[string]string{"a1": "a", "a2": "a", "b1": "b", "lone": ""},
+		map[string]MetricSample{"a1": {}, "a2": {}, "b1": {}, "lone": {}, "unknown": {}},
+	)
+	if len(groups) != 2 || len(groups["a"]) != 2 || len(groups["b"]) != 1 {
+		t.Errorf("got groups %v, wanted a with 2 replicas and b with 1", groups)
+	}
+}
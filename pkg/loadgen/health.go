@@ -0,0 +1,315 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	schema "github.com/probe-lab/thunderdome/pkg/exp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HealthState is the state of a target as observed by dealgood.
+type HealthState int
+
+const (
+	HealthHealthy    HealthState = iota // requests are succeeding
+	HealthFailing                       // recent requests have failed
+	HealthDown                          // requests have failed consistently and the target is considered unavailable
+	HealthRecovering                    // requests have begun to succeed after the target was down
+)
+
+var healthStateNames = []string{
+	HealthHealthy:    "healthy",
+	HealthFailing:    "failing",
+	HealthDown:       "down",
+	HealthRecovering: "recovering",
+}
+
+func (s HealthState) String() string {
+	if s < 0 || int(s) >= len(healthStateNames) {
+		return "unknown"
+	}
+	return healthStateNames[s]
+}
+
+type HealthJSON = schema.HealthJSON
+
+type HealthConfig struct {
+	FailingAfter  int
+	DownAfter     int
+	RecoverAfter  int
+	ProbeInterval time.Duration
+	Probe         bool // actively probe targets that are not healthy, only when the experiment configures health tracking
+	ExcludeDown   bool
+}
+
+func newHealthConfig(hj *HealthJSON) (*HealthConfig, error) {
+	cfg := &HealthConfig{
+		FailingAfter:  3,
+		DownAfter:     20,
+		RecoverAfter:  5,
+		ProbeInterval: 5 * time.Second,
+	}
+	if hj == nil {
+		// health is still tracked from the outcome of requests but targets are not sent
+		// any probes beyond the requests of the experiment
+		return cfg, nil
+	}
+	cfg.Probe = true
+
+	if hj.FailingAfter < 0 || hj.DownAfter < 0 || hj.RecoverAfter < 0 || hj.ProbeInterval < 0 {
+		return nil, fmt.Errorf("health thresholds must not be negative")
+	}
+	if hj.FailingAfter > 0 {
+		cfg.FailingAfter = hj.FailingAfter
+	}
+	if hj.DownAfter > 0 {
+		cfg.DownAfter = hj.DownAfter
+	}
+	if hj.RecoverAfter > 0 {
+		cfg.RecoverAfter = hj.RecoverAfter
+	}
+	if hj.ProbeInterval > 0 {
+		cfg.ProbeInterval = time.Duration(hj.ProbeInterval) * time.Second
+	}
+	if cfg.DownAfter < cfg.FailingAfter {
+		return nil, fmt.Errorf("down_after must not be less than failing_after")
+	}
+	cfg.ExcludeDown = hj.ExcludeDown
+	return cfg, nil
+}
+
+// A DownInterval is a period of time during which a target was down.
+type DownInterval struct {
+	Start time.Time
+	End   time.Time // zero if the target is still down
+}
+
+// TargetHealth tracks the health of a target using the outcome of requests and probes.
+type TargetHealth struct {
+	cfg            *HealthConfig
+	experimentName string
+	targetName     string
+
+	availableGauge *prometheus.GaugeVec
+	stateGauge     *prometheus.GaugeVec
+	downCounter    *prometheus.CounterVec
+	downSeconds    *prometheus.CounterVec
+
+	mu        sync.Mutex // guards following fields
+	state     HealthState
+	failures  int // consecutive failures
+	successes int // consecutive successes
+	intervals []DownInterval
+	firstSeen time.Time
+	removed   bool // the target was removed from the experiment so its state is no longer reported
+}
+
+func NewTargetHealth(experimentName string, targetName string, cfg *HealthConfig) (*TargetHealth, error) {
+	h := &TargetHealth{
+		cfg:            cfg,
+		experimentName: experimentName,
+		targetName:     targetName,
+		firstSeen:      time.Now(),
+	}
+
+	var err error
+	h.availableGauge, err = NewGaugeMetric(
+		"target_available",
+		"Indicates whether the target is available (1) or down (0).",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	h.stateGauge, err = NewGaugeMetric(
+		"target_health_state",
+		"Set to 1 for the current health state of the target.",
+		[]string{"experiment", "target", "state"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	h.downCounter, err = NewCounterMetric(
+		"target_down_total",
+		"The total number of times the target has been considered down.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	h.downSeconds, err = NewCounterMetric(
+		"target_down_seconds_total",
+		"The total number of seconds the target has been considered down.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	h.reportState()
+	return h, nil
+}
+
+// Record updates the health of the target with the outcome of a request or probe.
+func (h *TargetHealth) Record(success bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	prev := h.state
+	if success {
+		h.failures = 0
+		h.successes++
+		switch h.state {
+		case HealthFailing:
+			h.state = HealthHealthy
+		case HealthDown:
+			h.state = HealthRecovering
+			if h.successes >= h.cfg.RecoverAfter {
+				h.state = HealthHealthy
+			}
+		case HealthRecovering:
+			if h.successes >= h.cfg.RecoverAfter {
+				h.state = HealthHealthy
+			}
+		}
+	} else {
+		h.successes = 0
+		h.failures++
+		switch h.state {
+		case HealthHealthy:
+			if h.failures >= h.cfg.FailingAfter {
+				h.state = HealthFailing
+			}
+			if h.failures >= h.cfg.DownAfter {
+				h.state = HealthDown
+			}
+		case HealthFailing:
+			if h.failures >= h.cfg.DownAfter {
+				h.state = HealthDown
+			}
+		case HealthRecovering:
+			h.state = HealthDown
+		}
+	}
+
+	if h.state == prev {
+		return
+	}
+
+	wasDown := prev == HealthDown || prev == HealthRecovering
+	isDown := h.state == HealthDown || h.state == HealthRecovering
+	if isDown && !wasDown {
+		h.intervals = append(h.intervals, DownInterval{Start: now})
+		h.downCounter.WithLabelValues(h.experimentName, h.targetName).Add(1)
+	} else if wasDown && !isDown {
+		last := &h.intervals[len(h.intervals)-1]
+		last.End = now
+		h.downSeconds.WithLabelValues(h.experimentName, h.targetName).Add(last.End.Sub(last.Start).Seconds())
+	}
+	h.reportState()
+}
+
+// Remove deletes the state metrics of a target that has been removed from the experiment
+// and stops them from being reported again.
+func (h *TargetHealth) Remove() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removed = true
+	for _, name := range healthStateNames {
+		h.stateGauge.DeleteLabelValues(h.experimentName, h.targetName, name)
+	}
+	h.availableGauge.DeleteLabelValues(h.experimentName, h.targetName)
+}
+
+// reportState updates the state metrics, h.mu must be held by the caller
+func (h *TargetHealth) reportState() {
+	if h.removed {
+		return
+	}
+	for s, name := range healthStateNames {
+		v := 0.0
+		if HealthState(s) == h.state {
+			v = 1
+		}
+		h.stateGauge.WithLabelValues(h.experimentName, h.targetName, name).Set(v)
+	}
+	available := 1.0
+	if h.state == HealthDown || h.state == HealthRecovering {
+		available = 0
+	}
+	h.availableGauge.WithLabelValues(h.experimentName, h.targetName).Set(available)
+}
+
+// State returns the current health state of the target.
+func (h *TargetHealth) State() HealthState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state
+}
+
+// IsDown reports whether the target is currently considered unavailable.
+func (h *TargetHealth) IsDown() bool {
+	s := h.State()
+	return s == HealthDown || s == HealthRecovering
+}
+
+// DownIntervals returns the periods during which the target was down.
+func (h *TargetHealth) DownIntervals() []DownInterval {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]DownInterval(nil), h.intervals...)
+}
+
+// Availability returns the fraction of time since tracking started that the target
+// has not been down.
+func (h *TargetHealth) Availability() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	total := now.Sub(h.firstSeen)
+	if total <= 0 {
+		return 1
+	}
+	var down time.Duration
+	for _, iv := range h.intervals {
+		end := iv.End
+		if end.IsZero() {
+			end = now
+		}
+		down += end.Sub(iv.Start)
+	}
+	return 1 - float64(down)/float64(total)
+}
+
+// Monitor actively probes the target while it is not healthy until the context is canceled.
+// It returns immediately if probing is not enabled.
+func (h *TargetHealth) Monitor(ctx context.Context, target *Target) {
+	if !h.cfg.Probe {
+		return
+	}
+	t := time.NewTicker(h.cfg.ProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if h.State() == HealthHealthy {
+				continue
+			}
+			err := probeTarget(ctx, target, target.Probe)
+			if ctx.Err() != nil {
+				return
+			}
+			h.Record(err == nil)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package loadgen
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// defaultInterval is the length of each interval in the interval statistics when the
+// collector is not configured with one.
+const defaultInterval = time.Minute
+
+// windowBucketWidth is the span of time covered by each bucket of statistics used to
+// calculate rolling windows. Rolling window statistics are updated at this rate.
+const windowBucketWidth = 10 * time.Second
+
+// rollingWindows are the recent periods of time that rolling window statistics are
+// reported for, shortest first.
+var rollingWindows = []time.Duration{1 * time.Minute, 5 * time.Minute}
+
+// A WindowSample holds the statistics for a recent period of time.
+type WindowSample struct {
+	Window time.Duration
+	MetricSample
+}
+
+// An IntervalSample holds the statistics for a target over a single interval.
+type IntervalSample struct {
+	Start      time.Time
+	End        time.Time
+	TargetName string
+	MetricSample
+}
+
+// RollingStats keeps statistics in fixed width buckets so they can be combined to give
+// statistics over a recent period of time.
+type RollingStats struct {
+	width      time.Duration
+	maxBuckets int
+	buckets    []*TargetStats // completed buckets, oldest first
+	current    *TargetStats
+}
+
+// NewRollingStats creates rolling statistics using buckets of the given width, retaining
+// enough buckets to cover span.
+func NewRollingStats(width time.Duration, span time.Duration) *RollingStats {
+	maxBuckets := int(span / width)
+	if maxBuckets < 1 {
+		maxBuckets = 1
+	}
+	return &RollingStats{
+		width:      width,
+		maxBuckets: maxBuckets,
+		current:    NewTargetStats(),
+	}
+}
+
+// Current returns the bucket that statistics should be recorded in.
+func (r *RollingStats) Current() *TargetStats {
+	return r.current
+}
+
+// Rotate completes the current bucket and discards any bucket that is too old to be
+// part of a window.
+func (r *RollingStats) Rotate() {
+	r.buckets = append(r.buckets, r.current)
+	if len(r.buckets) > r.maxBuckets {
+		r.buckets = append([]*TargetStats(nil), r.buckets[len(r.buckets)-r.maxBuckets:]...)
+	}
+	r.current = NewTargetStats()
+}
+
+// Windows returns the statistics of the completed buckets over each of the spans, which
+// must be in ascending order.
+func (r *RollingStats) Windows(spans []time.Duration) []WindowSample {
+	samples := make([]WindowSample, 0, len(spans))
+	merged := NewTargetStats()
+	n := 0
+	for _, span := range spans {
+		want := int(span / r.width)
+		for ; n < want && n < len(r.buckets); n++ {
+			// merging snapshots only fails if a digest cannot be encoded
+			_ = merged.Merge(r.buckets[len(r.buckets)-1-n].Snapshot())
+		}
+		samples = append(samples, WindowSample{
+			Window:       span,
+			MetricSample: merged.Sample(),
+		})
+	}
+	return samples
+}
+
+const (
+	IntervalFormatCSV   = "csv"
+	IntervalFormatJSONL = "jsonl"
+)
+
+// An IntervalWriter writes interval statistics as CSV or JSON lines.
+type IntervalWriter struct {
+	experimentName string
+	format         string
+	w              io.Writer
+	csv            *csv.Writer
+	wroteHeader    bool
+}
+
+func NewIntervalWriter(w io.Writer, format string, experimentName string) (*IntervalWriter, error) {
+	iw := &IntervalWriter{
+		experimentName: experimentName,
+		format:         format,
+		w:              w,
+	}
+	switch format {
+	case IntervalFormatCSV:
+		iw.csv = csv.NewWriter(w)
+	case IntervalFormatJSONL:
+	default:
+		return nil, fmt.Errorf("unsupported interval format: %q", format)
+	}
+	return iw, nil
+}
+
+// Write writes the statistics for a single interval.
+func (iw *IntervalWriter) Write(samples []IntervalSample) error {
+	for _, s := range samples {
+		rec := newIntervalRecord(iw.experimentName, &s)
+		if iw.format == IntervalFormatJSONL {
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return fmt.Errorf("marshal interval: %w", err)
+			}
+			data = append(data, '\n')
+			if _, err := iw.w.Write(data); err != nil {
+				return fmt.Errorf("write interval: %w", err)
+			}
+			continue
+		}
+
+		if !iw.wroteHeader {
+			if err := iw.csv.Write(intervalRecordHeader); err != nil {
+				return fmt.Errorf("write header: %w", err)
+			}
+			iw.wroteHeader = true
+		}
+		if err := iw.csv.Write(rec.fields()); err != nil {
+			return fmt.Errorf("write interval: %w", err)
+		}
+	}
+
+	if iw.csv != nil {
+		iw.csv.Flush()
+		if err := iw.csv.Error(); err != nil {
+			return fmt.Errorf("flush: %w", err)
+		}
+	}
+	return nil
+}
+
+var intervalRecordHeader = []string{
+	"experiment", "target", "start", "end", "requests", "connect_errors", "timeout_errors", "dropped",
+	"http_2xx", "http_3xx", "http_4xx", "http_5xx", "ttfb_mean", "ttfb_p50", "ttfb_p90", "ttfb_p99",
+	"total_time_mean", "total_time_p50", "total_time_p90", "total_time_p99",
+}
+
+// intervalRecord is the form interval statistics are written in. Times are in seconds.
+type intervalRecord struct {
+	Experiment    string    `json:"experiment"`
+	Target        string    `json:"target"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Requests      int       `json:"requests"`
+	ConnectErrors int       `json:"connect_errors"`
+	TimeoutErrors int       `json:"timeout_errors"`
+	Dropped       int       `json:"dropped"`
+	Http2XX       int       `json:"http_2xx"`
+	Http3XX       int       `json:"http_3xx"`
+	Http4XX       int       `json:"http_4xx"`
+	Http5XX       int       `json:"http_5xx"`
+	TTFBMean      float64   `json:"ttfb_mean"`
+	TTFBP50       float64   `json:"ttfb_p50"`
+	TTFBP90       float64   `json:"ttfb_p90"`
+	TTFBP99       float64   `json:"ttfb_p99"`
+	TotalTimeMean float64   `json:"total_time_mean"`
+	TotalTimeP50  float64   `json:"total_time_p50"`
+	TotalTimeP90  float64   `json:"total_time_p90"`
+	TotalTimeP99  float64   `json:"total_time_p99"`
+}
+
+func newIntervalRecord(experimentName string, s *IntervalSample) *intervalRecord {
+	return &intervalRecord{
+		Experiment:    experimentName,
+		Target:        s.TargetName,
+		Start:         s.Start.UTC(),
+		End:           s.End.UTC(),
+		Requests:      s.TotalRequests,
+		ConnectErrors: s.TotalConnectErrors,
+		TimeoutErrors: s.TotalTimeoutErrors,
+		Dropped:       s.TotalDropped,
+		Http2XX:       s.TotalHttp2XX,
+		Http3XX:       s.TotalHttp3XX,
+		Http4XX:       s.TotalHttp4XX,
+		Http5XX:       s.TotalHttp5XX,
+		TTFBMean:      Finite(s.TTFB.Mean),
+		TTFBP50:       Finite(s.TTFB.P50),
+		TTFBP90:       Finite(s.TTFB.P90),
+		TTFBP99:       Finite(s.TTFB.P99),
+		TotalTimeMean: Finite(s.TotalTime.Mean),
+		TotalTimeP50:  Finite(s.TotalTime.P50),
+		TotalTimeP90:  Finite(s.TotalTime.P90),
+		TotalTimeP99:  Finite(s.TotalTime.P99),
+	}
+}
+
+func (r *intervalRecord) fields() []string {
+	ff := func(v float64) string { return strconv.FormatFloat(v, 'f', 6, 64) }
+	return []string{
+		r.Experiment, r.Target, r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339),
+		strconv.Itoa(r.Requests), strconv.Itoa(r.ConnectErrors), strconv.Itoa(r.TimeoutErrors), strconv.Itoa(r.Dropped),
+		strconv.Itoa(r.Http2XX), strconv.Itoa(r.Http3XX), strconv.Itoa(r.Http4XX), strconv.Itoa(r.Http5XX),
+		ff(r.TTFBMean), ff(r.TTFBP50), ff(r.TTFBP90), ff(r.TTFBP99),
+		ff(r.TotalTimeMean), ff(r.TotalTimeP50), ff(r.TotalTimeP90), ff(r.TotalTimeP99),
+	}
+}
+
+// Finite returns v or zero if v is not a finite number, which is the case for statistics
+// of metrics with no values.
+func Finite(v float64) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0
+	}
+	return v
+}
@@ -0,0 +1,538 @@
+package loadgen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/probe-lab/thunderdome/pkg/request"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+)
+
+type Loader struct {
+	Source         RequestSource // source of requests
+	ExperimentName string
+	Targets        []*Target           // targets to send load to
+	Timings        chan *RequestTiming // channel to send timings to
+	Rate           int                 // maximum number of requests per second per target
+	Concurrency    int                 // number of workers per target
+	Duration       int
+	PrintFailures  bool
+	Router         Router           // chooses the targets each request is sent to, defaults to broadcasting to all targets
+	WarmUp         int              // seconds at the start during which requests are sent but excluded from statistics, in addition to the duration
+	Stall          time.Duration    // length of pause while reading a response body after which the transfer is considered stalled
+	Limits         TransferLimits   // bounds on how much of each response body is read
+	Ranges         *RangeGenerator  // adds Range headers to a proportion of requests, may be nil
+	Failures       *FailureStore    // keeps a sample of failed and anomalous requests, may be nil
+	Dispatch       string           // how each request is handed to its targets, defaults to random
+	Resolve        time.Duration    // time between refreshing the addresses of targets, zero if disabled
+	Discovery      *TargetDiscovery // adds and removes targets while sending, may be nil
+
+	streamLagGauge        *prometheus.GaugeVec
+	streamIntervalGauge   *prometheus.GaugeVec
+	streamRequestsCounter *prometheus.CounterVec
+	streamWaitCounter     *prometheus.CounterVec
+	targetsGauge          *prometheus.GaugeVec
+	rateGauge             *prometheus.GaugeVec
+	concurrencyGauge      *prometheus.GaugeVec
+	targetRoleGauge       *prometheus.GaugeVec
+	dispatchedCounter     *prometheus.CounterVec
+	warmingUpGauge        *prometheus.GaugeVec
+	dispatchSkewHist      *prometheus.HistogramVec
+	rng                   *rand.Rand
+
+	// following fields are only accessed by the goroutine running Send
+	wg           *sync.WaitGroup
+	warmUpUntil  time.Time
+	verifyRanges float64
+	all          []*Target                    // every target that has been sent requests, in the order they were added
+	discovered   map[string]*discoveredTarget // targets added by discovery, keyed by name
+	ready        chan *Target                 // receives discovered targets once they pass their ready check
+
+	mu   sync.Mutex  // guards skew
+	skew *TimeMetric // difference between the earliest and latest time each request was sent to its targets
+}
+
+func NewLoader(experimentName string, targets []*Target, source RequestSource, timings chan *RequestTiming, maxRate int, maxConcurrency int, duration int) (*Loader, error) {
+	l := &Loader{
+		Source:         source,
+		ExperimentName: experimentName,
+		Targets:        targets,
+		Rate:           maxRate,
+		Concurrency:    maxConcurrency,
+		Duration:       duration,
+		Timings:        timings,
+		rng:            rand.New(rand.NewSource(time.Now().UnixNano())),
+		skew:           NewTimeMetric(),
+	}
+
+	var err error
+	l.streamLagGauge, err = NewGaugeMetric(
+		"stream_lag_seconds",
+		"The number of seconds between a request being placed in the stream before being sent to targets. Increasing values indicate the targets are falling behind the stream.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	l.streamIntervalGauge, err = NewGaugeMetric(
+		"stream_interval_seconds",
+		"The number of seconds between a request being read from the incoming stream and being send to targets. Higher values indicate the stream is falling behind the targets, leading to starvation.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	l.streamWaitCounter, err = NewCounterMetric(
+		"stream_wait_total",
+		"The number of times the loader had to wait for an incoming request from the stream. This indicates starvation.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	l.streamRequestsCounter, err = NewCounterMetric(
+		"stream_requests_total",
+		"The number of requests read from the stream.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	l.targetsGauge, err = NewGaugeMetric(
+		"experiment_targets",
+		"The number of targets specified for the experiment.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	l.rateGauge, err = NewGaugeMetric(
+		"experiment_request_rate",
+		"The maximum request rate specified for the experiment.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	l.concurrencyGauge, err = NewGaugeMetric(
+		"experiment_concurrency",
+		"The maximum number of concurrent requests specified for the experiment.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	l.targetRoleGauge, err = NewGaugeMetric(
+		"experiment_target_role",
+		"Set to 1 for the role assigned to each target by the routing mode of the experiment.",
+		[]string{"experiment", "target", "routing", "role"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	l.dispatchedCounter, err = NewCounterMetric(
+		"dispatched_total",
+		"The number of requests from the stream that were routed to each target.",
+		[]string{"experiment", "target", "routing", "role"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	l.warmingUpGauge, err = NewGaugeMetric(
+		"experiment_warming_up",
+		"Set to 1 while the experiment is in its warm up period and requests are excluded from statistics.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	l.dispatchSkewHist, err = NewHistogramMetricWithBuckets(
+		"dispatch_skew_seconds",
+		"The difference between the earliest and latest times that each request was sent to the targets it was dispatched to.",
+		[]string{"experiment"},
+		dispatchBuckets,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	return l, nil
+}
+
+// Send sends requests to each target until the duration has passed or the context is canceled.
+func (l *Loader) Send(ctx context.Context) error {
+	if l.Duration > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(l.Duration+l.WarmUp)*time.Second)
+		defer cancel()
+	}
+	warmUpUntil := time.Now().Add(time.Duration(l.WarmUp) * time.Second)
+
+	if l.Router == nil {
+		l.Router = &broadcastRouter{targets: l.Targets}
+	}
+
+	verifyRanges := 0.0
+	if l.Ranges != nil {
+		verifyRanges = l.Ranges.verify
+	}
+
+	var wg sync.WaitGroup
+	l.wg = &wg
+	l.warmUpUntil = warmUpUntil
+	l.verifyRanges = verifyRanges
+	l.all = append([]*Target(nil), l.Targets...)
+	for _, target := range l.Targets {
+		l.startTarget(ctx, ctx, target)
+	}
+
+	var discovered <-chan []*TargetJSON
+	if l.Discovery != nil {
+		var cancel func()
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		l.discovered = make(map[string]*discoveredTarget)
+		l.ready = make(chan *Target)
+		discovered = l.Discovery.Watch(ctx, !l.PrintFailures)
+	}
+
+	if err := l.Source.Start(); err != nil {
+		return fmt.Errorf("start source: %w", err)
+	}
+
+	requestInterval := time.Duration(float64(time.Second) / float64(l.Rate))
+
+	tick := time.NewTicker(requestInterval)
+	defer tick.Stop()
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case tjs, ok := <-discovered:
+			if !ok {
+				discovered = nil
+				continue
+			}
+			l.updateTargets(ctx, tjs)
+		case target := <-l.ready:
+			l.activateTarget(ctx, target)
+		case <-tick.C:
+			l.targetsGauge.WithLabelValues(l.ExperimentName).Set(float64(len(l.Targets)))
+			l.rateGauge.WithLabelValues(l.ExperimentName).Set(float64(l.Rate))
+			l.concurrencyGauge.WithLabelValues(l.ExperimentName).Set(float64(l.Concurrency))
+			warmingUp := time.Now().Before(warmUpUntil)
+			if warmingUp {
+				l.warmingUpGauge.WithLabelValues(l.ExperimentName).Set(1)
+			} else {
+				l.warmingUpGauge.WithLabelValues(l.ExperimentName).Set(0)
+			}
+			for _, be := range l.Targets {
+				l.targetRoleGauge.WithLabelValues(l.ExperimentName, be.Name, l.Router.Mode(), be.Role).Set(1)
+			}
+
+			var req request.Request
+			var ok bool
+
+			// Do we have a request available
+			select {
+			case <-ctx.Done():
+				break loop
+			case req, ok = <-l.Source.Chan():
+			default:
+				// No request ready so report that
+				l.streamWaitCounter.WithLabelValues(l.ExperimentName).Add(1)
+
+				// Now wait for the request
+				select {
+				case <-ctx.Done():
+					break loop
+				case req, ok = <-l.Source.Chan():
+				}
+			}
+			if !ok {
+				// Channel was closed so source is terminated
+				break loop
+			}
+			// Report that we got a request
+			l.streamRequestsCounter.WithLabelValues(l.ExperimentName).Add(1)
+
+			// report how far behind the stream we are
+			l.streamLagGauge.WithLabelValues(l.ExperimentName).Set(time.Since(req.Timestamp).Seconds())
+
+			dispatch := &req
+			if l.Ranges != nil {
+				dispatch = l.Ranges.Apply(dispatch)
+			}
+
+			var targets []*Target
+			if len(l.Targets) > 0 {
+				targets = l.Router.Route(dispatch)
+			}
+			var onDone func(time.Duration)
+			if !warmingUp {
+				onDone = l.recordSkew
+			}
+			group := newDispatchGroup(len(targets), l.Dispatch == DispatchBarrier, onDone)
+
+			// hand the request to targets in a random order so none has a consistent head start
+			for _, idx := range l.rng.Perm(len(targets)) {
+				be := targets[idx]
+				l.dispatchedCounter.WithLabelValues(l.ExperimentName, be.Name, l.Router.Mode(), be.Role).Add(1)
+				select {
+				case be.Requests <- &Dispatch{Request: dispatch, Group: group}:
+				default:
+					group.Drop()
+					l.Timings <- &RequestTiming{
+						ExperimentName: l.ExperimentName,
+						TargetName:     be.Name,
+						TargetGroup:    be.Group,
+						Dropped:        true,
+						WarmUp:         warmingUp,
+					}
+				}
+			}
+		}
+	}
+
+	for _, be := range l.Targets {
+		close(be.Requests)
+	}
+	for _, dt := range l.discovered {
+		dt.cancel()
+	}
+	wg.Wait()
+
+	if err := l.Source.Err(); err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+
+	return nil
+}
+
+// startTarget starts the workers that send requests to the target along with monitoring
+// its health and refreshing its addresses until tctx is canceled. Workers use ctx so they
+// can drain any request in progress once the target's request channel is closed.
+func (l *Loader) startTarget(ctx context.Context, tctx context.Context, target *Target) {
+	for j := 0; j < l.Concurrency; j++ {
+		tr := &http.Transport{
+			TLSClientConfig:     target.TLS.Clone(),
+			MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+			DisableCompression:  true,
+			DisableKeepAlives:   true,
+		}
+		http2.ConfigureTransport(tr)
+
+		w := &Worker{
+			Target:         target,
+			ExperimentName: l.ExperimentName,
+			Client: &http.Client{
+				Transport: tr,
+				Timeout:   l.Limits.ClientTimeout(),
+			},
+			PrintFailures: l.PrintFailures,
+			WarmUpUntil:   l.warmUpUntil,
+			Stall:         l.Stall,
+			Limits:        l.Limits,
+			VerifyRanges:  l.verifyRanges,
+			Failures:      l.Failures,
+		}
+		l.wg.Add(1)
+		go w.Run(ctx, l.wg, l.Timings)
+	}
+
+	if target.Health != nil {
+		go target.Health.Monitor(tctx, target)
+	}
+	if l.Resolve > 0 {
+		go refreshTarget(tctx, target, l.Resolve, !l.PrintFailures)
+	}
+}
+
+// updateTargets brings the discovered targets in line with the latest definitions from
+// discovery. New targets are probed and only sent requests once they are ready. Targets
+// that are no longer defined, or whose definition changed, are drained and removed.
+func (l *Loader) updateTargets(ctx context.Context, tjs []*TargetJSON) {
+	static := make(map[string]bool, len(l.Targets))
+	for _, t := range l.Targets {
+		if _, ok := l.discovered[t.Name]; !ok {
+			static[t.Name] = true
+		}
+	}
+
+	// targets are only created for new or changed definitions since creating a target
+	// resets its health metrics
+	wanted := make(map[string]*TargetJSON, len(tjs))
+	specs := make(map[string]string, len(tjs))
+	for _, tj := range tjs {
+		name := targetName(tj)
+		if static[name] || wanted[name] != nil {
+			fmt.Fprintf(os.Stderr, "discovery: duplicate target name found: %s\n", name)
+			continue
+		}
+		spec, err := json.Marshal(tj)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "discovery: target %s: %v\n", name, err)
+			continue
+		}
+		wanted[name] = tj
+		specs[name] = string(spec)
+	}
+
+	for name, dt := range l.discovered {
+		if spec, ok := specs[name]; ok && spec == dt.spec {
+			continue
+		}
+		if !l.removeTarget(name) {
+			// keep using the current definition of the target
+			delete(wanted, name)
+		}
+	}
+
+	for name, tj := range wanted {
+		if _, ok := l.discovered[name]; ok {
+			continue
+		}
+		t, err := l.Discovery.exp.newTarget(tj, fmt.Sprintf("discovered target %s", name))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "discovery: %v\n", err)
+			continue
+		}
+		dt := &discoveredTarget{target: t, spec: specs[name]}
+		dt.ctx, dt.cancel = context.WithCancel(ctx)
+		l.discovered[name] = dt
+		if !l.PrintFailures {
+			fmt.Printf("probing discovered target %s\n", name)
+		}
+
+		go func(dt *discoveredTarget) {
+			if err := targetReady(dt.ctx, dt.target, !l.PrintFailures); err != nil {
+				return
+			}
+			select {
+			case <-dt.ctx.Done():
+			case l.ready <- dt.target:
+			}
+		}(dt)
+	}
+}
+
+// activateTarget starts sending requests to a discovered target that passed its ready
+// check.
+func (l *Loader) activateTarget(ctx context.Context, target *Target) {
+	dt, ok := l.discovered[target.Name]
+	if !ok || dt.target != target || dt.active {
+		// target was removed or redefined while it was being probed
+		return
+	}
+
+	targets := append(append([]*Target(nil), l.Targets...), target)
+	if err := l.setTargets(targets); err != nil {
+		// forget the target so it is probed and added again on the next update
+		fmt.Fprintf(os.Stderr, "discovery: unable to add target %s: %v\n", target.Name, err)
+		dt.cancel()
+		if target.Health != nil {
+			target.Health.Remove()
+		}
+		delete(l.discovered, target.Name)
+		return
+	}
+	dt.active = true
+	l.startTarget(ctx, dt.ctx, target)
+
+	l.all = slices.DeleteFunc(l.all, func(t *Target) bool { return t.Name == target.Name })
+	l.all = append(l.all, target)
+	fmt.Fprintf(os.Stderr, "added target %s (%s)\n", target.Name, target.BaseURL)
+}
+
+// removeTarget stops sending requests to a discovered target, leaving its workers to
+// finish any requests in progress. It reports false if the target could not be removed
+// because the remaining targets could not be routed to.
+func (l *Loader) removeTarget(name string) bool {
+	dt, ok := l.discovered[name]
+	if !ok {
+		return true
+	}
+
+	if dt.active {
+		targets := slices.DeleteFunc(append([]*Target(nil), l.Targets...), func(t *Target) bool { return t == dt.target })
+		if err := l.setTargets(targets); err != nil {
+			fmt.Fprintf(os.Stderr, "discovery: unable to remove target %s: %v\n", name, err)
+			return false
+		}
+		close(dt.target.Requests)
+		fmt.Fprintf(os.Stderr, "removed target %s, draining\n", name)
+	}
+	dt.cancel()
+	if dt.target.Health != nil {
+		dt.target.Health.Remove()
+	}
+	delete(l.discovered, name)
+	return true
+}
+
+// setTargets replaces the targets being sent requests and the router that chooses
+// between them.
+func (l *Loader) setTargets(targets []*Target) error {
+	roles := make(map[*Target]string, len(l.Targets))
+	for _, t := range l.Targets {
+		roles[t] = t.Role
+	}
+	router, err := l.Discovery.exp.newRouter(targets)
+	if err != nil {
+		// restore roles assigned by the current router
+		for t, role := range roles {
+			t.Role = role
+		}
+		return err
+	}
+
+	for t, role := range roles {
+		l.targetRoleGauge.DeleteLabelValues(l.ExperimentName, t.Name, l.Router.Mode(), role)
+	}
+	l.Targets = targets
+	l.Router = router
+	return nil
+}
+
+// AllTargets returns every target that was sent requests, including those removed by
+// discovery. It must not be called while Send is running.
+func (l *Loader) AllTargets() []*Target {
+	return l.all
+}
+
+// recordSkew records the difference between the earliest and latest times a request was
+// sent to its targets.
+func (l *Loader) recordSkew(skew time.Duration) {
+	l.dispatchSkewHist.WithLabelValues(l.ExperimentName).Observe(skew.Seconds())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.skew.Add(skew.Seconds())
+}
+
+// DispatchSkew returns the current values of the dispatch skew between targets.
+func (l *Loader) DispatchSkew() MetricValues {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.skew.Values()
+}
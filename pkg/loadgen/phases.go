@@ -0,0 +1,78 @@
+package loadgen
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"time"
+)
+
+// Phase is a phase of an http request. Requests are sent to addresses the target's host
+// was resolved to beforehand so name resolution is not one of the phases.
+type Phase int
+
+const (
+	PhaseConnect    Phase = iota // establishing the tcp connection
+	PhaseTLS                     // performing the tls handshake
+	PhaseWrite                   // writing the request once a connection was obtained
+	PhaseServerWait              // waiting for the first byte of the response after the request was written
+	PhaseTransfer                // reading the response after the first byte was received
+	NumPhases
+)
+
+var phaseNames = [NumPhases]string{
+	PhaseConnect:    "connect",
+	PhaseTLS:        "tls",
+	PhaseWrite:      "write",
+	PhaseServerWait: "server_wait",
+	PhaseTransfer:   "transfer",
+}
+
+func (p Phase) String() string {
+	if p < 0 || p >= NumPhases {
+		return "unknown"
+	}
+	return phaseNames[p]
+}
+
+// PhaseTimes holds the time spent in each phase of a request. A phase that did not occur
+// has a negative duration.
+type PhaseTimes [NumPhases]time.Duration
+
+// phaseTracer records the times at which each phase of a request starts and ends.
+type phaseTracer struct {
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	gotConn                   time.Time
+	wroteRequest              time.Time
+	firstByte                 time.Time
+}
+
+func (p *phaseTracer) ClientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		ConnectStart:         func(network, addr string) { p.connectStart = time.Now() },
+		ConnectDone:          func(network, addr string, err error) { p.connectDone = time.Now() },
+		TLSHandshakeStart:    func() { p.tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { p.tlsDone = time.Now() },
+		GotConn:              func(httptrace.GotConnInfo) { p.gotConn = time.Now() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { p.wroteRequest = time.Now() },
+		GotFirstResponseByte: func() { p.firstByte = time.Now() },
+	}
+}
+
+// Times returns the time spent in each phase of a request that completed at end.
+func (p *phaseTracer) Times(end time.Time) PhaseTimes {
+	span := func(start, end time.Time) time.Duration {
+		if start.IsZero() || end.IsZero() || end.Before(start) {
+			return -1
+		}
+		return end.Sub(start)
+	}
+
+	return PhaseTimes{
+		PhaseConnect:    span(p.connectStart, p.connectDone),
+		PhaseTLS:        span(p.tlsStart, p.tlsDone),
+		PhaseWrite:      span(p.gotConn, p.wroteRequest),
+		PhaseServerWait: span(p.wroteRequest, p.firstByte),
+		PhaseTransfer:   span(p.firstByte, end),
+	}
+}
@@ -0,0 +1,64 @@
+package loadgen
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	schema "github.com/probe-lab/thunderdome/pkg/exp"
+)
+
+type ProbeJSON = schema.ProbeJSON
+
+type ProbeConfig struct {
+	Path         string
+	ExpectStatus int
+	Successes    int
+	Timeout      time.Duration
+	Interval     time.Duration
+}
+
+// defaultProbe is used when an experiment does not define a probe. Any response to a
+// request for / is taken to mean the target is ready.
+var defaultProbe = &ProbeConfig{
+	Path:      "/",
+	Successes: 1,
+	Timeout:   2 * time.Second,
+	Interval:  5 * time.Second,
+}
+
+// newProbeConfig creates a probe configuration, using base for any values that are not
+// specified.
+func newProbeConfig(pj *ProbeJSON, base *ProbeConfig) (*ProbeConfig, error) {
+	cfg := *base
+	if pj == nil {
+		return &cfg, nil
+	}
+
+	if pj.ExpectStatus < 0 || pj.Successes < 0 || pj.Timeout < 0 || pj.Interval < 0 {
+		return nil, fmt.Errorf("probe values must not be negative")
+	}
+	if pj.ExpectStatus != 0 && (pj.ExpectStatus < 100 || pj.ExpectStatus > 599) {
+		return nil, fmt.Errorf("expected status must be a valid http status code")
+	}
+
+	if pj.Path != "" {
+		if !strings.HasPrefix(pj.Path, "/") {
+			return nil, fmt.Errorf("probe path must start with /")
+		}
+		cfg.Path = pj.Path
+	}
+	if pj.ExpectStatus != 0 {
+		cfg.ExpectStatus = pj.ExpectStatus
+	}
+	if pj.Successes != 0 {
+		cfg.Successes = pj.Successes
+	}
+	if pj.Timeout != 0 {
+		cfg.Timeout = time.Duration(pj.Timeout) * time.Second
+	}
+	if pj.Interval != 0 {
+		cfg.Interval = time.Duration(pj.Interval) * time.Second
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,385 @@
+package loadgen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	schema "github.com/probe-lab/thunderdome/pkg/exp"
+	"github.com/probe-lab/thunderdome/pkg/request"
+)
+
+type RangesJSON = schema.RangesJSON
+
+// A RangeGenerator adds Range headers to a proportion of requests.
+type RangeGenerator struct {
+	fraction  float64
+	weights   [3]int // single, suffix and multi
+	maxOffset int64
+	maxLength int64
+	verify    float64
+	rng       *rand.Rand
+}
+
+func newRangeGenerator(rj *RangesJSON) (*RangeGenerator, error) {
+	if rj == nil || rj.Fraction == 0 {
+		return nil, nil
+	}
+	if rj.Fraction < 0 || rj.Fraction > 1 {
+		return nil, fmt.Errorf("fraction must be between 0 and 1")
+	}
+	if rj.Verify < 0 || rj.Verify > 1 {
+		return nil, fmt.Errorf("verify must be between 0 and 1")
+	}
+	if rj.Single < 0 || rj.Suffix < 0 || rj.Multi < 0 || rj.MaxOffset < 0 || rj.MaxLength < 0 {
+		return nil, fmt.Errorf("range weights and sizes must not be negative")
+	}
+
+	g := &RangeGenerator{
+		fraction:  rj.Fraction,
+		weights:   [3]int{rj.Single, rj.Suffix, rj.Multi},
+		maxOffset: rj.MaxOffset,
+		maxLength: rj.MaxLength,
+		verify:    rj.Verify,
+		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if g.weights == [3]int{} {
+		g.weights = [3]int{1, 1, 1}
+	}
+	if g.maxOffset == 0 {
+		g.maxOffset = 1 << 20
+	}
+	if g.maxLength == 0 {
+		g.maxLength = 256 << 10
+	}
+	return g, nil
+}
+
+// Apply returns a copy of the request with a generated Range header or the original
+// request if it should not be given one. It is only called from a single goroutine.
+func (g *RangeGenerator) Apply(req *request.Request) *request.Request {
+	if req.Method != http.MethodGet || !(strings.HasPrefix(req.URI, "/ipfs/") || strings.HasPrefix(req.URI, "/ipns/")) {
+		return req
+	}
+	if _, ok := req.Header["Range"]; ok {
+		return req
+	}
+	if g.rng.Float64() >= g.fraction {
+		return req
+	}
+
+	var spec string
+	n := g.rng.Intn(g.weights[0] + g.weights[1] + g.weights[2])
+	switch {
+	case n < g.weights[0]:
+		spec = g.span(0)
+	case n < g.weights[0]+g.weights[1]:
+		spec = "-" + strconv.FormatInt(1+g.rng.Int63n(g.maxLength), 10)
+	default:
+		parts := 2 + g.rng.Intn(2)
+		spans := make([]string, 0, parts)
+		var from int64
+		for i := 0; i < parts; i++ {
+			s := g.span(from)
+			spans = append(spans, s)
+			end, _ := strconv.ParseInt(s[strings.Index(s, "-")+1:], 10, 64)
+			from = end + 1
+		}
+		spec = strings.Join(spans, ",")
+	}
+
+	r := *req
+	r.Header = make(map[string]string, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header["Range"] = "bytes=" + spec
+	return &r
+}
+
+// span returns a range that starts at or after from
+func (g *RangeGenerator) span(from int64) string {
+	start := from + g.rng.Int63n(g.maxOffset)
+	end := start + g.rng.Int63n(g.maxLength)
+	return strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end, 10)
+}
+
+// RangeOutcome is the result of checking the response to a range request.
+type RangeOutcome int
+
+const (
+	RangeNone          RangeOutcome = iota // not a range request or the response was an error
+	RangePartial                           // a valid 206 response
+	RangeVerified                          // a valid 206 response whose bytes matched the full body
+	RangeIgnored                           // the range was ignored and the full body returned
+	RangeUnsatisfiable                     // a valid 416 response
+	RangeInvalid                           // the response did not follow the semantics of range requests
+	RangeMismatch                          // the bytes of the response did not match the full body
+	NumRangeOutcomes
+)
+
+var rangeOutcomeNames = [NumRangeOutcomes]string{
+	RangeNone:          "none",
+	RangePartial:       "partial",
+	RangeVerified:      "verified",
+	RangeIgnored:       "ignored",
+	RangeUnsatisfiable: "unsatisfiable",
+	RangeInvalid:       "invalid",
+	RangeMismatch:      "mismatch",
+}
+
+func (o RangeOutcome) String() string {
+	if o < 0 || o >= NumRangeOutcomes {
+		return "unknown"
+	}
+	return rangeOutcomeNames[o]
+}
+
+// maxRangeCapture is the largest range response body that is kept for checking
+const maxRangeCapture = 8 << 20
+
+// byteRange is a range of bytes as requested in a Range header. End is -1 for ranges
+// without an end and Start is -1 for suffix ranges, where End is the suffix length.
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+// resolve returns the first and last byte positions of the range in a body of the given
+// size, or false if the range cannot be satisfied.
+func (r byteRange) resolve(size int64) (int64, int64, bool) {
+	if r.Start == -1 {
+		if r.End == 0 || size == 0 {
+			return 0, 0, false
+		}
+		first := size - r.End
+		if first < 0 {
+			first = 0
+		}
+		return first, size - 1, true
+	}
+	if r.Start >= size {
+		return 0, 0, false
+	}
+	last := r.End
+	if last == -1 || last >= size {
+		last = size - 1
+	}
+	return r.Start, last, true
+}
+
+// parseRangeHeader parses a Range header with the bytes unit
+func parseRangeHeader(h string) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(h), "bytes=")
+	if !ok {
+		return nil, fmt.Errorf("unsupported range unit")
+	}
+	var ranges []byteRange
+	for _, part := range strings.Split(spec, ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(part), "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid range %q", part)
+		}
+		r := byteRange{Start: -1, End: -1}
+		var err error
+		if first != "" {
+			if r.Start, err = strconv.ParseInt(first, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid range start %q", first)
+			}
+		}
+		if last != "" {
+			if r.End, err = strconv.ParseInt(last, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid range end %q", last)
+			}
+		}
+		if (r.Start == -1 && r.End == -1) || (r.Start != -1 && r.End != -1 && r.End < r.Start) {
+			return nil, fmt.Errorf("invalid range %q", part)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// parseContentRange parses a Content-Range header, returning -1 for the first and last
+// positions of an unsatisfied range and -1 for the size if it is unknown.
+func parseContentRange(h string) (int64, int64, int64, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(h), "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("unsupported content range unit")
+	}
+	rng, sizeStr, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("missing content range size")
+	}
+	size := int64(-1)
+	if sizeStr != "*" {
+		var err error
+		if size, err = strconv.ParseInt(sizeStr, 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid content range size %q", sizeStr)
+		}
+	}
+	if rng == "*" {
+		return -1, -1, size, nil
+	}
+	firstStr, lastStr, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid content range %q", rng)
+	}
+	first, err := strconv.ParseInt(firstStr, 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid content range start %q", firstStr)
+	}
+	last, err := strconv.ParseInt(lastStr, 10, 64)
+	if err != nil || last < first || (size != -1 && last >= size) {
+		return 0, 0, 0, fmt.Errorf("invalid content range end %q", lastStr)
+	}
+	return first, last, size, nil
+}
+
+// rangePart is a part of a partial response
+type rangePart struct {
+	First int64
+	Last  int64
+	Data  []byte
+}
+
+// checkRangeResponse checks that a response to a range request follows the semantics of
+// range requests. body holds the response body or nil if it was too large to keep. It
+// returns the parts of a partial response so they can be verified.
+func checkRangeResponse(ranges []byteRange, resp *http.Response, body []byte, bodyLen int64) (RangeOutcome, []rangePart, int64) {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return RangeIgnored, nil, 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		first, _, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || first != -1 || size == -1 {
+			return RangeInvalid, nil, 0
+		}
+		for _, r := range ranges {
+			if _, _, ok := r.resolve(size); ok {
+				return RangeInvalid, nil, 0
+			}
+		}
+		return RangeUnsatisfiable, nil, 0
+	case http.StatusPartialContent:
+	default:
+		return RangeNone, nil, 0
+	}
+
+	var parts []rangePart
+	var size int64 = -1
+	mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "multipart/byteranges" {
+		if body == nil {
+			return RangePartial, nil, 0
+		}
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return RangeInvalid, nil, 0
+			}
+			first, last, psize, err := parseContentRange(p.Header.Get("Content-Range"))
+			if err != nil || first == -1 {
+				return RangeInvalid, nil, 0
+			}
+			data, err := io.ReadAll(p)
+			if err != nil || int64(len(data)) != last-first+1 {
+				return RangeInvalid, nil, 0
+			}
+			size = psize
+			parts = append(parts, rangePart{First: first, Last: last, Data: data})
+		}
+		if len(parts) == 0 {
+			return RangeInvalid, nil, 0
+		}
+	} else {
+		first, last, psize, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || first == -1 || bodyLen != last-first+1 {
+			return RangeInvalid, nil, 0
+		}
+		size = psize
+		parts = append(parts, rangePart{First: first, Last: last, Data: body})
+	}
+
+	if size == -1 {
+		// without the size the parts cannot be compared with the requested ranges
+		return RangePartial, parts, size
+	}
+
+	// Every part must lie within the span of the requested ranges. Servers may coalesce
+	// or reorder multiple ranges but a single range must be answered exactly.
+	lo, hi := int64(-1), int64(-1)
+	for _, r := range ranges {
+		first, last, ok := r.resolve(size)
+		if !ok {
+			continue
+		}
+		if lo == -1 || first < lo {
+			lo = first
+		}
+		if last > hi {
+			hi = last
+		}
+	}
+	for _, p := range parts {
+		if p.First < lo || p.Last > hi {
+			return RangeInvalid, nil, 0
+		}
+	}
+	if len(ranges) == 1 && (len(parts) != 1 || parts[0].First != lo || parts[0].Last != hi) {
+		return RangeInvalid, nil, 0
+	}
+	return RangePartial, parts, size
+}
+
+// verifyRangeParts compares the parts of a partial response with the full body.
+func verifyRangeParts(parts []rangePart, full []byte) RangeOutcome {
+	for _, p := range parts {
+		if p.Data == nil {
+			return RangePartial
+		}
+		if p.Last >= int64(len(full)) || !bytes.Equal(p.Data, full[p.First:p.Last+1]) {
+			return RangeMismatch
+		}
+	}
+	return RangeVerified
+}
+
+// cappedBuffer keeps the data written to it until it exceeds its maximum size, after
+// which the data is discarded.
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if !c.overflow {
+		if c.buf.Len()+len(p) > c.max {
+			c.overflow = true
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Bytes returns the data written or nil if it exceeded the maximum size.
+func (c *cappedBuffer) Bytes() []byte {
+	if c.overflow {
+		return nil
+	}
+	return c.buf.Bytes()
+}
@@ -0,0 +1,146 @@
+package loadgen
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"reflect"
+	"testing"
+)
+
+func TestParseRangeHeader(t *testing.T) {
+	testCases := []struct {
+		header  string
+		want    []byteRange
+		wantErr bool
+	}{
+		{header: "bytes=0-99", want: []byteRange{{Start: 0, End: 99}}},
+		{header: "bytes=100-", want: []byteRange{{Start: 100, End: -1}}},
+		{header: "bytes=-500", want: []byteRange{{Start: -1, End: 500}}},
+		{header: " bytes=0-0, 10-19 ,-5", want: []byteRange{{Start: 0, End: 0}, {Start: 10, End: 19}, {Start: -1, End: 5}}},
+		{header: "items=0-99", wantErr: true},
+		{header: "bytes=", wantErr: true},
+		{header: "bytes=-", wantErr: true},
+		{header: "bytes=10-5", wantErr: true},
+		{header: "bytes=a-5", wantErr: true},
+		{header: "bytes=5-b", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseRangeHeader(tc.header)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: got no error, wanted one", tc.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.header, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v, wanted %v", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestByteRangeResolve(t *testing.T) {
+	testCases := []struct {
+		r           byteRange
+		size        int64
+		first, last int64
+		ok          bool
+	}{
+		{r: byteRange{Start: 0, End: 99}, size: 1000, first: 0, last: 99, ok: true},
+		{r: byteRange{Start: 900, End: 1999}, size: 1000, first: 900, last: 999, ok: true},
+		{r: byteRange{Start: 500, End: -1}, size: 1000, first: 500, last: 999, ok: true},
+		{r: byteRange{Start: 1000, End: -1}, size: 1000},
+		{r: byteRange{Start: -1, End: 100}, size: 1000, first: 900, last: 999, ok: true},
+		{r: byteRange{Start: -1, End: 5000}, size: 1000, first: 0, last: 999, ok: true},
+		{r: byteRange{Start: -1, End: 0}, size: 1000},
+		{r: byteRange{Start: -1, End: 10}, size: 0},
+	}
+
+	for _, tc := range testCases {
+		first, last, ok := tc.r.resolve(tc.size)
+		if ok != tc.ok || (ok && (first != tc.first || last != tc.last)) {
+			t.Errorf("%+v in %d bytes: got %d-%d %v, wanted %d-%d %v", tc.r, tc.size, first, last, ok, tc.first, tc.last, tc.ok)
+		}
+	}
+}
+
+func multipartBody(t *testing.T, parts ...[2]string) (string, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Range": {p[0]}})
+		if err != nil {
+			t.Fatalf("create part: %v", err)
+		}
+		w.Write([]byte(p[1]))
+	}
+	mw.Close()
+	return "multipart/byteranges; boundary=" + mw.Boundary(), buf.Bytes()
+}
+
+func TestCheckRangeResponse(t *testing.T) {
+	full := []byte("0123456789abcdefghij")
+
+	multiType, multi := multipartBody(t, [2]string{"bytes 0-1/20", "01"}, [2]string{"bytes 10-12/20", "abc"})
+	badType, bad := multipartBody(t, [2]string{"bytes 0-3/20", "01"})
+
+	testCases := []struct {
+		name         string
+		header       string
+		status       int
+		contentRange string
+		contentType  string
+		body         []byte
+		want         RangeOutcome
+		wantVerified RangeOutcome
+	}{
+		{name: "single range", header: "bytes=2-5", status: 206, contentRange: "bytes 2-5/20", body: []byte("2345"), want: RangePartial, wantVerified: RangeVerified},
+		{name: "suffix range", header: "bytes=-3", status: 206, contentRange: "bytes 17-19/20", body: []byte("hij"), want: RangePartial, wantVerified: RangeVerified},
+		{name: "wrong bytes", header: "bytes=2-5", status: 206, contentRange: "bytes 2-5/20", body: []byte("xxxx"), want: RangePartial, wantVerified: RangeMismatch},
+		{name: "unknown size", header: "bytes=2-5", status: 206, contentRange: "bytes 2-5/*", body: []byte("2345"), want: RangePartial, wantVerified: RangeVerified},
+		{name: "different range", header: "bytes=2-5", status: 206, contentRange: "bytes 2-6/20", body: []byte("23456"), want: RangeInvalid},
+		{name: "length mismatch", header: "bytes=2-5", status: 206, contentRange: "bytes 2-5/20", body: []byte("234"), want: RangeInvalid},
+		{name: "missing content range", header: "bytes=2-5", status: 206, body: []byte("2345"), want: RangeInvalid},
+		{name: "multipart", header: "bytes=0-1,10-12", status: 206, contentType: multiType, body: multi, want: RangePartial, wantVerified: RangeVerified},
+		{name: "invalid multipart part", header: "bytes=0-3", status: 206, contentType: badType, body: bad, want: RangeInvalid},
+		{name: "ignored", header: "bytes=2-5", status: 200, body: full, want: RangeIgnored},
+		{name: "unsatisfiable", header: "bytes=30-", status: 416, contentRange: "bytes */20", want: RangeUnsatisfiable},
+		{name: "satisfiable but refused", header: "bytes=5-", status: 416, contentRange: "bytes */20", want: RangeInvalid},
+		{name: "unsatisfiable without size", header: "bytes=30-", status: 416, want: RangeInvalid},
+		{name: "error", header: "bytes=2-5", status: 500, want: RangeNone},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ranges, err := parseRangeHeader(tc.header)
+			if err != nil {
+				t.Fatalf("parse range header: %v", err)
+			}
+			resp := &http.Response{StatusCode: tc.status, Header: http.Header{}}
+			if tc.contentRange != "" {
+				resp.Header.Set("Content-Range", tc.contentRange)
+			}
+			if tc.contentType != "" {
+				resp.Header.Set("Content-Type", tc.contentType)
+			}
+
+			got, parts, _ := checkRangeResponse(ranges, resp, tc.body, int64(len(tc.body)))
+			if got != tc.want {
+				t.Fatalf("got %s, wanted %s", got, tc.want)
+			}
+			if got != RangePartial {
+				return
+			}
+			if verified := verifyRangeParts(parts, full); verified != tc.wantVerified {
+				t.Errorf("got %s after verification, wanted %s", verified, tc.wantVerified)
+			}
+		})
+	}
+}
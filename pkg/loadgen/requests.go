@@ -1,4 +1,4 @@
-package main
+package loadgen
 
 import (
 	"bufio"
@@ -42,6 +42,10 @@ type RequestSource interface {
 	Name() string
 }
 
+// metricsSubsystem is the subsystem of request source metrics, which keep the name of
+// the dealgood command so existing dashboards continue to work.
+const metricsSubsystem = "dealgood"
+
 type RequestSourceMetrics struct {
 	requestsDropped  prometheus.Counter
 	requestsFiltered prometheus.Counter
@@ -55,7 +59,7 @@ func NewRequestSourceMetrics(labels map[string]string) (*RequestSourceMetrics, e
 
 	var err error
 	s.requestsDropped, err = prom.NewPrometheusCounter(
-		appName,
+		metricsSubsystem,
 		"source_requests_dropped_total",
 		"The total number of requests dropped by the request source due to targets falling behind.",
 		labels,
@@ -65,7 +69,7 @@ func NewRequestSourceMetrics(labels map[string]string) (*RequestSourceMetrics, e
 	}
 
 	s.requestsFiltered, err = prom.NewPrometheusCounter(
-		appName,
+		metricsSubsystem,
 		"source_requests_filtered_total",
 		"The total number of requests ignored by the request source due to filter rules.",
 		labels,
@@ -75,7 +79,7 @@ func NewRequestSourceMetrics(labels map[string]string) (*RequestSourceMetrics, e
 	}
 
 	s.requestsIncoming, err = prom.NewPrometheusCounter(
-		appName,
+		metricsSubsystem,
 		"source_requests_incoming_total",
 		"The total number of requests read from the request source.",
 		labels,
@@ -85,7 +89,7 @@ func NewRequestSourceMetrics(labels map[string]string) (*RequestSourceMetrics, e
 	}
 
 	s.errors, err = prom.NewPrometheusCounter(
-		appName,
+		metricsSubsystem,
 		"source_error_total",
 		"The total number of errors encountered when reading from request source.",
 		labels,
@@ -95,7 +99,7 @@ func NewRequestSourceMetrics(labels map[string]string) (*RequestSourceMetrics, e
 	}
 
 	s.connected, err = prom.NewPrometheusGauge(
-		appName,
+		metricsSubsystem,
 		"source_connected",
 		"Indicates whether the request source is connected to its provider of requests.",
 		labels,
@@ -340,7 +344,7 @@ var samplePathsIPNS = []string{
 	"/ipns/fromthemachine.org/ARTIMESIAN.html",
 }
 
-func sampleRequests() []*request.Request {
+func SampleRequests() []*request.Request {
 	paths := []string{}
 	paths = append(paths, samplePathsIPFS...)
 	paths = append(paths, samplePathsIPNS...)
@@ -0,0 +1,100 @@
+package loadgen
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	schema "github.com/probe-lab/thunderdome/pkg/exp"
+)
+
+// RewriteRuleJSON describes a modification to be made to a request before it is sent to a target.
+type RewriteRuleJSON = schema.RewriteRuleJSON
+
+// A RewriteRule modifies a request before it is sent to a target.
+type RewriteRule func(*http.Request)
+
+func newRewriteRule(rj *RewriteRuleJSON) (RewriteRule, error) {
+	switch rj.Action {
+	case "set_header":
+		if rj.Name == "" {
+			return nil, fmt.Errorf("%s requires a header name", rj.Action)
+		}
+		return func(req *http.Request) {
+			if http.CanonicalHeaderKey(rj.Name) == "Host" {
+				req.Host = rj.Value
+			}
+			req.Header.Set(rj.Name, rj.Value)
+		}, nil
+	case "add_header":
+		if rj.Name == "" {
+			return nil, fmt.Errorf("%s requires a header name", rj.Action)
+		}
+		return func(req *http.Request) {
+			req.Header.Add(rj.Name, rj.Value)
+		}, nil
+	case "remove_header":
+		if rj.Name == "" {
+			return nil, fmt.Errorf("%s requires a header name", rj.Action)
+		}
+		return func(req *http.Request) {
+			req.Header.Del(rj.Name)
+		}, nil
+	case "rewrite_path":
+		if rj.Match == "" {
+			return nil, fmt.Errorf("%s requires a match expression", rj.Action)
+		}
+		re, err := regexp.Compile(rj.Match)
+		if err != nil {
+			return nil, fmt.Errorf("%s match expression: %w", rj.Action, err)
+		}
+		return func(req *http.Request) {
+			req.URL.Path = re.ReplaceAllString(req.URL.Path, rj.Replace)
+		}, nil
+	case "set_query", "add_query", "remove_query":
+		if rj.Name == "" {
+			return nil, fmt.Errorf("%s requires a query parameter name", rj.Action)
+		}
+		return func(req *http.Request) {
+			q, err := url.ParseQuery(req.URL.RawQuery)
+			if err != nil {
+				// leave malformed queries as they are
+				return
+			}
+			switch rj.Action {
+			case "set_query":
+				q.Set(rj.Name, rj.Value)
+			case "add_query":
+				q.Add(rj.Name, rj.Value)
+			case "remove_query":
+				q.Del(rj.Name)
+			}
+			req.URL.RawQuery = q.Encode()
+		}, nil
+	case "map_host":
+		if rj.Value == "" {
+			return nil, fmt.Errorf("%s requires a value", rj.Action)
+		}
+		return func(req *http.Request) {
+			if rj.Match == "" || req.Host == rj.Match {
+				req.Host = rj.Value
+				req.Header.Set("Host", rj.Value)
+			}
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported rewrite action: %q", rj.Action)
+	}
+}
+
+func newRewriteRules(rjs []*RewriteRuleJSON) ([]RewriteRule, error) {
+	rules := make([]RewriteRule, 0, len(rjs))
+	for i, rj := range rjs {
+		rule, err := newRewriteRule(rj)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,241 @@
+package loadgen
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	schema "github.com/probe-lab/thunderdome/pkg/exp"
+	"github.com/probe-lab/thunderdome/pkg/request"
+)
+
+const (
+	RoutingBroadcast = "broadcast" // every request is sent to every target
+	RoutingHash      = "hash"      // requests are sent to targets chosen by consistent hashing of the CID
+	RoutingSplit     = "split"     // requests are sent to a target chosen at random according to target weights
+	RoutingMirror    = "mirror"    // requests are sent to the primary target and mirrored to shadow targets
+)
+
+const (
+	RolePrimary = "primary" // target receives all requests
+	RoleShadow  = "shadow"  // target receives mirrored copies of requests sent to the primary
+	RoleMember  = "member"  // target receives a share of the requests
+)
+
+type RoutingJSON = schema.RoutingJSON
+
+// A Router chooses which targets a request should be sent to.
+type Router interface {
+	// Route returns the targets that the request should be sent to. It is only called
+	// from a single goroutine.
+	Route(*request.Request) []*Target
+
+	// Mode returns the name of the routing mode
+	Mode() string
+}
+
+// newRouter creates a router for the given targets and assigns each target its role.
+func newRouter(rj *RoutingJSON, targets []*Target) (Router, error) {
+	if rj == nil {
+		rj = &RoutingJSON{}
+	}
+
+	switch rj.Mode {
+	case "", RoutingBroadcast:
+		for _, t := range targets {
+			t.Role = RolePrimary
+		}
+		return &broadcastRouter{targets: targets}, nil
+	case RoutingHash:
+		if rj.Replicas < 0 || rj.Replicas > len(targets) {
+			return nil, fmt.Errorf("replicas must not be negative or more than the number of targets")
+		}
+		replicas := rj.Replicas
+		if replicas == 0 {
+			replicas = 1
+		}
+		for _, t := range targets {
+			t.Role = RoleMember
+		}
+		return newHashRouter(targets, replicas), nil
+	case RoutingSplit:
+		for _, t := range targets {
+			t.Role = RoleMember
+		}
+		return newSplitRouter(targets), nil
+	case RoutingMirror:
+		if rj.MirrorRate < 0 || rj.MirrorRate > 1 {
+			return nil, fmt.Errorf("mirror rate must be between 0 and 1")
+		}
+		mirrorRate := rj.MirrorRate
+		if mirrorRate == 0 {
+			mirrorRate = 1
+		}
+		r := &mirrorRouter{
+			mirrorRate: mirrorRate,
+			rng:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		}
+		for _, t := range targets {
+			if r.primary == nil && (rj.Primary == "" || t.Name == rj.Primary) {
+				t.Role = RolePrimary
+				r.primary = t
+				continue
+			}
+			t.Role = RoleShadow
+			r.shadows = append(r.shadows, t)
+		}
+		if r.primary == nil {
+			return nil, fmt.Errorf("primary target %q not found", rj.Primary)
+		}
+		return r, nil
+	default:
+		return nil, fmt.Errorf("unsupported routing mode: %q", rj.Mode)
+	}
+}
+
+type broadcastRouter struct {
+	targets []*Target
+}
+
+func (r *broadcastRouter) Mode() string { return RoutingBroadcast }
+
+func (r *broadcastRouter) Route(*request.Request) []*Target {
+	return r.targets
+}
+
+// virtualNodesPerWeight is the number of points each unit of target weight is given on the hash ring.
+const virtualNodesPerWeight = 100
+
+type ringPoint struct {
+	hash   uint64
+	target *Target
+}
+
+// hashRouter simulates a cluster of gateways behind a load balancer that uses consistent
+// hashing of the requested CID to choose which gateway serves the request.
+type hashRouter struct {
+	ring     []ringPoint
+	replicas int
+}
+
+func newHashRouter(targets []*Target, replicas int) *hashRouter {
+	r := &hashRouter{
+		replicas: replicas,
+	}
+	for _, t := range targets {
+		for i := 0; i < t.Weight*virtualNodesPerWeight; i++ {
+			r.ring = append(r.ring, ringPoint{
+				hash:   hashString(t.Name + "#" + strconv.Itoa(i)),
+				target: t,
+			})
+		}
+	}
+	sort.Slice(r.ring, func(i, j int) bool { return r.ring[i].hash < r.ring[j].hash })
+	return r
+}
+
+func (r *hashRouter) Mode() string { return RoutingHash }
+
+func (r *hashRouter) Route(req *request.Request) []*Target {
+	h := hashString(routingKey(req.URI))
+	idx := sort.Search(len(r.ring), func(i int) bool { return r.ring[i].hash >= h })
+
+	selected := make([]*Target, 0, r.replicas)
+	for i := 0; i < len(r.ring) && len(selected) < r.replicas; i++ {
+		t := r.ring[(idx+i)%len(r.ring)].target
+		seen := false
+		for _, s := range selected {
+			if s == t {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			selected = append(selected, t)
+		}
+	}
+	return selected
+}
+
+// splitRouter sends each request to a single target chosen at random in proportion to
+// the target weights.
+type splitRouter struct {
+	targets []*Target
+	total   int
+	rng     *rand.Rand
+}
+
+func newSplitRouter(targets []*Target) *splitRouter {
+	r := &splitRouter{
+		targets: targets,
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, t := range targets {
+		r.total += t.Weight
+	}
+	return r
+}
+
+func (r *splitRouter) Mode() string { return RoutingSplit }
+
+func (r *splitRouter) Route(*request.Request) []*Target {
+	n := r.rng.Intn(r.total)
+	for _, t := range r.targets {
+		if n < t.Weight {
+			return []*Target{t}
+		}
+		n -= t.Weight
+	}
+	return nil
+}
+
+// mirrorRouter sends every request to a primary target and mirrors a fraction of them
+// to each of the shadow targets.
+type mirrorRouter struct {
+	primary    *Target
+	shadows    []*Target
+	mirrorRate float64
+	rng        *rand.Rand
+}
+
+func (r *mirrorRouter) Mode() string { return RoutingMirror }
+
+func (r *mirrorRouter) Route(*request.Request) []*Target {
+	selected := []*Target{r.primary}
+	if r.mirrorRate >= 1 || r.rng.Float64() < r.mirrorRate {
+		selected = append(selected, r.shadows...)
+	}
+	return selected
+}
+
+// routingKey returns the part of the uri used for consistent hashing. This is the root
+// CID or IPNS name for gateway paths or the full path otherwise.
+func routingKey(uri string) string {
+	path, _, _ := strings.Cut(uri, "?")
+	for _, ns := range []string{"/ipfs/", "/ipns/"} {
+		if rest, ok := strings.CutPrefix(path, ns); ok {
+			root, _, _ := strings.Cut(rest, "/")
+			return root
+		}
+	}
+	return path
+}
+
+// hashString hashes s to a point on the ring. The last bytes of a string only change the
+// low bits of an fnv hash, so it is mixed with the murmur3 finalizer to stop similar CIDs
+// and target names from clustering together on the ring.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
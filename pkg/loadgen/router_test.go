@@ -0,0 +1,201 @@
+package loadgen
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/probe-lab/thunderdome/pkg/request"
+)
+
+func testTargets(weights ...int) []*Target {
+	targets := make([]*Target, len(weights))
+	for i, w := range weights {
+		targets[i] = &Target{Name: fmt.Sprintf("target%d", i), Weight: w}
+	}
+	return targets
+}
+
+func TestNewRouterHashReplicas(t *testing.T) {
+	testCases := []struct {
+		replicas int
+		wantErr  bool
+		want     int
+	}{
+		{replicas: -1, wantErr: true},
+		{replicas: 0, want: 1},
+		{replicas: 1, want: 1},
+		{replicas: 3, want: 3},
+		{replicas: 4, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("replicas %d", tc.replicas), func(t *testing.T) {
+			r, err := newRouter(&RoutingJSON{Mode: RoutingHash, Replicas: tc.replicas}, testTargets(1, 1, 1))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got no error, wanted one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := len(r.Route(&request.Request{URI: "/ipfs/bafy"})); got != tc.want {
+				t.Errorf("got %d targets, wanted %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHashRouterDistribution(t *testing.T) {
+	const requests = 20000
+
+	testCases := []struct {
+		name     string
+		weights  []int
+		replicas int
+	}{
+		{name: "equal weights", weights: []int{1, 1, 1, 1}, replicas: 1},
+		{name: "unequal weights", weights: []int{1, 2, 1}, replicas: 1},
+		{name: "two replicas", weights: []int{1, 1, 1, 1}, replicas: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targets := testTargets(tc.weights...)
+			r := newHashRouter(targets, tc.replicas)
+
+			counts := map[*Target]int{}
+			for i := 0; i < requests; i++ {
+				selected := r.Route(&request.Request{URI: fmt.Sprintf("/ipfs/cid%d/file", i)})
+				if len(selected) != tc.replicas {
+					t.Fatalf("got %d targets, wanted %d", len(selected), tc.replicas)
+				}
+				seen := map[*Target]bool{}
+				for _, s := range selected {
+					if seen[s] {
+						t.Fatalf("target %s selected more than once", s.Name)
+					}
+					seen[s] = true
+					counts[s]++
+				}
+			}
+
+			totalWeight := 0
+			for _, w := range tc.weights {
+				totalWeight += w
+			}
+			for _, target := range targets {
+				want := float64(requests*tc.replicas) * float64(target.Weight) / float64(totalWeight)
+				if tc.replicas > 1 {
+					// with equal weights each target is chosen as one of the replicas equally often
+					want = float64(requests*tc.replicas) / float64(len(targets))
+				}
+				if got := float64(counts[target]); math.Abs(got-want)/want > 0.15 {
+					t.Errorf("%s got %.0f requests, wanted about %.0f", target.Name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHashRouterConsistent(t *testing.T) {
+	targets := testTargets(1, 1, 1, 1)
+	r := newHashRouter(targets, 2)
+
+	// every request for the same root is routed to the same targets
+	first := r.Route(&request.Request{URI: "/ipfs/bafyroot/a.txt"})
+	for _, uri := range []string{"/ipfs/bafyroot", "/ipfs/bafyroot/b/c.txt", "/ipfs/bafyroot?format=car"} {
+		got := r.Route(&request.Request{URI: uri})
+		if len(got) != len(first) || got[0] != first[0] || got[1] != first[1] {
+			t.Errorf("%s routed to different targets from /ipfs/bafyroot/a.txt", uri)
+		}
+	}
+
+	// removing a target only moves the requests that were routed to it
+	smaller := newHashRouter(targets[:3], 1)
+	full := newHashRouter(targets, 1)
+	for i := 0; i < 1000; i++ {
+		req := &request.Request{URI: fmt.Sprintf("/ipfs/cid%d", i)}
+		before := full.Route(req)[0]
+		after := smaller.Route(req)[0]
+		if before != targets[3] && before != after {
+			t.Fatalf("request for %s moved from %s to %s", req.URI, before.Name, after.Name)
+		}
+	}
+}
+
+func TestSplitRouterDistribution(t *testing.T) {
+	const requests = 20000
+
+	targets := testTargets(1, 3)
+	r := newSplitRouter(targets)
+
+	counts := map[*Target]int{}
+	for i := 0; i < requests; i++ {
+		selected := r.Route(&request.Request{URI: "/ipfs/bafy"})
+		if len(selected) != 1 {
+			t.Fatalf("got %d targets, wanted 1", len(selected))
+		}
+		counts[selected[0]]++
+	}
+
+	for _, target := range targets {
+		want := float64(requests) * float64(target.Weight) / 4
+		if got := float64(counts[target]); math.Abs(got-want)/want > 0.1 {
+			t.Errorf("%s got %.0f requests, wanted about %.0f", target.Name, got, want)
+		}
+	}
+}
+
+func TestMirrorRouter(t *testing.T) {
+	const requests = 20000
+
+	targets := testTargets(1, 1, 1)
+	r, err := newRouter(&RoutingJSON{Mode: RoutingMirror, Primary: "target1", MirrorRate: 0.25}, targets)
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+	if targets[1].Role != RolePrimary || targets[0].Role != RoleShadow || targets[2].Role != RoleShadow {
+		t.Fatalf("got roles %s, %s, %s, wanted shadow, primary, shadow", targets[0].Role, targets[1].Role, targets[2].Role)
+	}
+
+	mirrored := 0
+	for i := 0; i < requests; i++ {
+		selected := r.Route(&request.Request{URI: "/ipfs/bafy"})
+		if selected[0] != targets[1] {
+			t.Fatalf("got first target %s, wanted the primary", selected[0].Name)
+		}
+		switch len(selected) {
+		case 1:
+		case 3:
+			mirrored++
+		default:
+			t.Fatalf("got %d targets, wanted 1 or 3", len(selected))
+		}
+	}
+
+	if got, want := float64(mirrored), float64(requests)*0.25; math.Abs(got-want)/want > 0.1 {
+		t.Errorf("mirrored %.0f requests, wanted about %.0f", got, want)
+	}
+}
+
+func TestRoutingKey(t *testing.T) {
+	testCases := []struct {
+		uri  string
+		want string
+	}{
+		{uri: "/ipfs/bafyroot", want: "bafyroot"},
+		{uri: "/ipfs/bafyroot/a/b.txt", want: "bafyroot"},
+		{uri: "/ipfs/bafyroot?format=car", want: "bafyroot"},
+		{uri: "/ipns/example.com/index.html", want: "example.com"},
+		{uri: "/api/v0/version?x=1", want: "/api/v0/version"},
+	}
+
+	for _, tc := range testCases {
+		if got := routingKey(tc.uri); got != tc.want {
+			t.Errorf("routingKey(%q) got %q, wanted %q", tc.uri, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package loadgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/probe-lab/thunderdome/pkg/filter"
+	"github.com/probe-lab/thunderdome/pkg/request"
+)
+
+// rpcPathPrefix is the path prefix of requests to the kubo RPC API
+const rpcPathPrefix = "/api/v0/"
+
+// defaultRPCAddSize is the size of the file sent by add requests when the template does
+// not specify one.
+const defaultRPCAddSize = 64 << 10
+
+// maxRPCCapture is the largest RPC response body that is kept for validation
+const maxRPCCapture = 8 << 20
+
+type RPCTemplateJSON struct {
+	Command string            `json:"command"`          // rpc command such as cat or dag/get
+	Weight  int               `json:"weight,omitempty"` // relative share of requests using this template, defaults to 1
+	Args    []string          `json:"args,omitempty"`   // values of the arg parameter, one is chosen at random for each request
+	Params  map[string]string `json:"params,omitempty"` // additional query parameters sent with every request
+	Size    int               `json:"size,omitempty"`   // size in bytes of the random file sent in the multipart body of add requests, defaults to 64KiB
+}
+
+// rpcCommand describes how the response to an RPC command is validated.
+type rpcCommand struct {
+	needsArg bool
+	validate func(body []byte) error // validates the body of a successful response, nil if any body is acceptable
+}
+
+// rpcCommands are the RPC commands whose responses dealgood knows how to validate.
+// Responses to other commands are only checked for their status.
+var rpcCommands = map[string]rpcCommand{
+	"add":               {validate: expectJSONField("Hash")},
+	"cat":               {needsArg: true},
+	"dag/get":           {needsArg: true, validate: expectJSONField("")},
+	"routing/findprovs": {needsArg: true, validate: expectJSONField("")},
+	"name/resolve":      {needsArg: true, validate: expectJSONField("Path")},
+}
+
+// rpcMethod returns the RPC command requested by r or an empty string if it is not a
+// request to the kubo RPC API.
+func rpcMethod(r *request.Request) string {
+	path, _, _ := strings.Cut(r.URI, "?")
+	if r.Method != http.MethodPost || !strings.HasPrefix(path, rpcPathPrefix) {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(path, rpcPathPrefix), "/")
+}
+
+// validateRPCResponse checks the response to a successful RPC request. body holds the
+// response body or is nil if it was too large to be kept.
+func validateRPCResponse(method string, resp *http.Response, body []byte) error {
+	// kubo reports errors that occur after a streaming response has started in a trailer
+	if msg := resp.Trailer.Get("X-Stream-Error"); msg != "" {
+		return fmt.Errorf("stream error: %s", msg)
+	}
+	cmd, ok := rpcCommands[method]
+	if !ok || cmd.validate == nil || body == nil {
+		return nil
+	}
+	return cmd.validate(body)
+}
+
+// expectJSONField returns a validator that requires the body to be a stream of one or
+// more JSON values, at least one of which is an object with the named field. No field is
+// required if field is empty.
+func expectJSONField(field string) func([]byte) error {
+	return func(body []byte) error {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		values := 0
+		found := field == ""
+		for {
+			var v any
+			if err := dec.Decode(&v); err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return fmt.Errorf("invalid json: %w", err)
+			}
+			values++
+			if obj, ok := v.(map[string]any); ok && !found {
+				_, found = obj[field]
+			}
+		}
+		if values == 0 {
+			return fmt.Errorf("empty response")
+		}
+		if !found {
+			return fmt.Errorf("response has no %s field", field)
+		}
+		return nil
+	}
+}
+
+// RPCOutcome is the result of a request to the kubo RPC API.
+type RPCOutcome int
+
+const (
+	RPCOK      RPCOutcome = iota // a successful response that passed validation
+	RPCInvalid                   // a successful response that failed validation
+	RPCFailed                    // a response with an error status
+	RPCError                     // the request failed without a complete response
+	numRPCOutcomes
+)
+
+var rpcOutcomeNames = [numRPCOutcomes]string{
+	RPCOK:      "ok",
+	RPCInvalid: "invalid",
+	RPCFailed:  "failed",
+	RPCError:   "error",
+}
+
+func (o RPCOutcome) String() string {
+	if o < 0 || o >= numRPCOutcomes {
+		return "unknown"
+	}
+	return rpcOutcomeNames[o]
+}
+
+// rpcOutcome returns the outcome of an RPC request.
+func rpcOutcome(res *RequestTiming) RPCOutcome {
+	switch {
+	case res.ConnectError || res.TimeoutError || res.ErrorClass != ErrorNone || res.Transfer.Truncated:
+		return RPCError
+	case res.StatusCode/100 != 2:
+		return RPCFailed
+	case res.RPCInvalid:
+		return RPCInvalid
+	default:
+		return RPCOK
+	}
+}
+
+// rpcTemplate is a template used to generate requests for an RPC command
+type rpcTemplate struct {
+	command string
+	weight  int
+	args    []string
+	params  url.Values
+	size    int
+}
+
+func newRPCTemplates(tjs []*RPCTemplateJSON) ([]*rpcTemplate, error) {
+	if len(tjs) == 0 {
+		return nil, fmt.Errorf("at least one template must be specified")
+	}
+	templates := make([]*rpcTemplate, 0, len(tjs))
+	for i, tj := range tjs {
+		command := strings.Trim(tj.Command, "/")
+		if command == "" {
+			return nil, fmt.Errorf("template %d: command must be specified", i)
+		}
+		if tj.Weight < 0 || tj.Size < 0 {
+			return nil, fmt.Errorf("template %d: weight and size must not be negative", i)
+		}
+		if cmd, ok := rpcCommands[command]; ok && cmd.needsArg && len(tj.Args) == 0 {
+			return nil, fmt.Errorf("template %d: %s requires at least one arg", i, command)
+		}
+
+		t := &rpcTemplate{
+			command: command,
+			weight:  tj.Weight,
+			args:    tj.Args,
+			params:  url.Values{},
+			size:    tj.Size,
+		}
+		if t.weight == 0 {
+			t.weight = 1
+		}
+		if t.size == 0 {
+			t.size = defaultRPCAddSize
+		}
+		for k, v := range tj.Params {
+			t.params.Set(k, v)
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// Request generates a request from the template.
+func (t *rpcTemplate) Request(rng *rand.Rand) (*request.Request, error) {
+	query := url.Values{}
+	for k, v := range t.params {
+		query[k] = v
+	}
+	if len(t.args) > 0 {
+		query.Set("arg", t.args[rng.Intn(len(t.args))])
+	}
+
+	uri := rpcPathPrefix + t.command
+	if enc := query.Encode(); enc != "" {
+		uri += "?" + enc
+	}
+
+	req := &request.Request{
+		Method: http.MethodPost,
+		URI:    uri,
+		Header: map[string]string{},
+	}
+
+	if t.command == "add" {
+		data := make([]byte, t.size)
+		rng.Read(data)
+
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		fw, err := mw.CreateFormFile("file", "data")
+		if err != nil {
+			return nil, fmt.Errorf("create form file: %w", err)
+		}
+		if _, err := fw.Write(data); err != nil {
+			return nil, fmt.Errorf("write form file: %w", err)
+		}
+		if err := mw.Close(); err != nil {
+			return nil, fmt.Errorf("close multipart writer: %w", err)
+		}
+		req.Body = buf.Bytes()
+		req.Header["Content-Type"] = mw.FormDataContentType()
+	}
+
+	return req, nil
+}
+
+// sampleRPCCatPaths are paths of files that can be read using the cat command
+var sampleRPCCatPaths = []string{
+	"/ipfs/QmQPeNsJPyVWPFDVHb77w8G42Fvo15z4bG2X8D2GhfbSXc/readme",
+	"/ipfs/bafkreifjjcie6lypi6ny7amxnfftagclbuxndqonfipmb64f2km2devei4",
+	"/ipfs/QmNvTjdqEPjZVWCvRWsFJA1vK7TTw1g9JP6we1WBJTRADM/rfc-data/rfc1113.txt",
+	"/ipfs/QmSnuWmxptJZdLJpKRarxBMS2Ju2oANVrgbr2xWbie9b2D/frontend/thumbnails/21027771304_43d7ae4edc_o.jpg._t.jpg",
+	"/ipfs/QmNoscE3kNc83dM5rZNUC5UDXChiTdDcgf16RVtFCRWYuU/food/aphrodis.txt",
+	"/ipfs/QmNoscE3kNc83dM5rZNUC5UDXChiTdDcgf16RVtFCRWYuU/food/ppbeer.txt",
+	"/ipfs/QmNoscE3kNc83dM5rZNUC5UDXChiTdDcgf16RVtFCRWYuU/humor/aclamt.txt",
+}
+
+// sampleRPCTemplates returns templates for a mix of commonly used RPC commands using the
+// builtin sample paths.
+func sampleRPCTemplates() []*RPCTemplateJSON {
+	var cids, names []string
+	seen := map[string]bool{}
+	for _, p := range samplePathsIPFS {
+		root, _, _ := strings.Cut(strings.TrimPrefix(p, "/ipfs/"), "/")
+		if !seen[root] {
+			seen[root] = true
+			cids = append(cids, root)
+		}
+	}
+	for _, p := range samplePathsIPNS {
+		name, _, _ := strings.Cut(strings.TrimPrefix(p, "/ipns/"), "/")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, "/ipns/"+name)
+		}
+	}
+
+	return []*RPCTemplateJSON{
+		{Command: "add", Params: map[string]string{"pin": "false"}},
+		{Command: "cat", Args: sampleRPCCatPaths},
+		{Command: "dag/get", Args: cids},
+		{Command: "routing/findprovs", Args: cids, Params: map[string]string{"num-providers": "5"}},
+		{Command: "name/resolve", Args: names},
+	}
+}
+
+// RPCRequestSource is a request source that generates requests to the kubo RPC API
+// from a set of weighted templates.
+type RPCRequestSource struct {
+	templates   []*rpcTemplate
+	totalWeight int
+	rng         *rand.Rand
+	ch          chan request.Request
+	done        chan struct{}
+	filter      filter.RequestFilter
+	metrics     *RequestSourceMetrics
+
+	mu  sync.Mutex // guards following fields
+	err error
+}
+
+// NewRPCRequestSource creates a source of RPC requests using the templates held in the
+// JSON file fname or a builtin set of templates if fname is empty.
+func NewRPCRequestSource(fname string, filter filter.RequestFilter, metrics *RequestSourceMetrics) (*RPCRequestSource, error) {
+	tjs := sampleRPCTemplates()
+	if fname != "" {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			return nil, fmt.Errorf("read templates: %w", err)
+		}
+		tjs = nil
+		if err := json.Unmarshal(data, &tjs); err != nil {
+			return nil, fmt.Errorf("unmarshal templates: %w", err)
+		}
+	}
+
+	templates, err := newRPCTemplates(tjs)
+	if err != nil {
+		return nil, fmt.Errorf("templates: %w", err)
+	}
+
+	s := &RPCRequestSource{
+		templates: templates,
+		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		ch:        make(chan request.Request),
+		done:      make(chan struct{}),
+		filter:    filter,
+		metrics:   metrics,
+	}
+	for _, t := range templates {
+		s.totalWeight += t.weight
+	}
+	return s, nil
+}
+
+func (s *RPCRequestSource) Name() string {
+	return "rpc"
+}
+
+func (s *RPCRequestSource) Chan() <-chan request.Request {
+	return s.ch
+}
+
+func (s *RPCRequestSource) Start() error {
+	go func() {
+		s.metrics.connected.Set(1)
+		defer s.metrics.connected.Set(0)
+		defer close(s.ch)
+
+		for {
+			s.metrics.requestsIncoming.Add(1)
+			req, err := s.template().Request(s.rng)
+			if err != nil {
+				s.metrics.errors.Add(1)
+				s.mu.Lock()
+				s.err = err
+				s.mu.Unlock()
+				return
+			}
+			req.Timestamp = time.Now()
+
+			if s.filter != nil && !s.filter(req) {
+				s.metrics.requestsFiltered.Add(1)
+				continue
+			}
+
+			select {
+			case <-s.done:
+				return
+			case s.ch <- *req:
+			}
+		}
+	}()
+
+	return nil
+}
+
+// template chooses a template at random according to the template weights
+func (s *RPCRequestSource) template() *rpcTemplate {
+	n := s.rng.Intn(s.totalWeight)
+	for _, t := range s.templates {
+		if n < t.weight {
+			return t
+		}
+		n -= t.weight
+	}
+	return s.templates[len(s.templates)-1]
+}
+
+func (s *RPCRequestSource) Stop() {
+	close(s.done)
+}
+
+func (s *RPCRequestSource) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// RPCStats holds the statistics of requests for a single RPC command
+type RPCStats struct {
+	Outcomes [numRPCOutcomes]int
+	Time     *TimeMetric // total time of successful responses that passed validation
+}
+
+func NewRPCStats() *RPCStats {
+	return &RPCStats{Time: NewTimeMetric()}
+}
+
+func (r *RPCStats) Record(res *RequestTiming) {
+	outcome := rpcOutcome(res)
+	r.Outcomes[outcome]++
+	if outcome == RPCOK {
+		r.Time.Add(res.TotalTime.Seconds())
+	}
+}
+
+func (r *RPCStats) Sample() RPCSample {
+	return RPCSample{
+		Outcomes: r.Outcomes,
+		Time:     r.Time.Values(),
+	}
+}
+
+func (r *RPCStats) Snapshot() *RPCStatsSnapshot {
+	return &RPCStatsSnapshot{
+		Outcomes: r.Outcomes,
+		Time:     r.Time.Snapshot(),
+	}
+}
+
+func (r *RPCStats) Merge(snap *RPCStatsSnapshot) error {
+	for i := range r.Outcomes {
+		r.Outcomes[i] += snap.Outcomes[i]
+	}
+	return r.Time.Merge(snap.Time)
+}
+
+// RPCStatsSnapshot is a serializable copy of RPCStats
+type RPCStatsSnapshot struct {
+	Outcomes [numRPCOutcomes]int `json:"outcomes"`
+	Time     *TimeMetricSnapshot `json:"time"`
+}
+
+type RPCSample struct {
+	Outcomes [numRPCOutcomes]int
+	Time     MetricValues
+}
+
+// Total returns the number of requests made for the command.
+func (r RPCSample) Total() int {
+	total := 0
+	for _, n := range r.Outcomes {
+		total += n
+	}
+	return total
+}
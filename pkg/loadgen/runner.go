@@ -0,0 +1,265 @@
+// Package loadgen sends a stream of requests to a set of HTTP targets and measures how
+// each target responds. It is the engine used by dealgood and may be embedded in other
+// programs by creating an Experiment and running it with a Runner:
+//
+//	exp, err := loadgen.NewExperiment(expjson)
+//	...
+//	r, err := loadgen.NewRunner(exp,
+//		loadgen.WithSource(source),
+//		loadgen.WithSink(loadgen.SinkFunc(func(res *loadgen.RequestTiming) {
+//			// called as each request completes
+//		})),
+//	)
+//	...
+//	result, err := r.Run(ctx)
+package loadgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A Sink receives the timing of each request sent to a target once it completes. Record
+// is called from a single goroutine and must not modify the timing.
+type Sink interface {
+	Record(res *RequestTiming)
+}
+
+// SinkFunc adapts a function to a Sink.
+type SinkFunc func(res *RequestTiming)
+
+func (f SinkFunc) Record(res *RequestTiming) { f(res) }
+
+// An Option configures a Runner.
+type Option func(*Runner) error
+
+// WithSource sets the source of the requests sent to targets. It is required.
+func WithSource(source RequestSource) Option {
+	return func(r *Runner) error {
+		if source == nil {
+			return fmt.Errorf("source must not be nil")
+		}
+		r.source = source
+		return nil
+	}
+}
+
+// WithSink adds a sink that receives the timing of every request. It may be given more
+// than once.
+func WithSink(sink Sink) Option {
+	return func(r *Runner) error {
+		if sink == nil {
+			return fmt.Errorf("sink must not be nil")
+		}
+		r.sinks = append(r.sinks, sink)
+		return nil
+	}
+}
+
+// WithFailures keeps a sample of failed and anomalous requests in the store.
+func WithFailures(failures *FailureStore) Option {
+	return func(r *Runner) error {
+		r.failures = failures
+		return nil
+	}
+}
+
+// WithPrintFailures prints failed requests and changes to targets as they happen.
+func WithPrintFailures(print bool) Option {
+	return func(r *Runner) error {
+		r.printFailures = print
+		return nil
+	}
+}
+
+// WithInterval sets the length of each interval in the statistics published by the
+// runner's collector.
+func WithInterval(interval time.Duration) Option {
+	return func(r *Runner) error {
+		if interval < 0 {
+			return fmt.Errorf("interval must not be negative")
+		}
+		r.interval = interval
+		return nil
+	}
+}
+
+// WithReadyCheck probes targets before sending any requests, waiting up to timeout for
+// all of them to be ready. A timeout of zero waits forever.
+func WithReadyCheck(timeout time.Duration) Option {
+	return func(r *Runner) error {
+		if timeout < 0 {
+			return fmt.Errorf("ready timeout must not be negative")
+		}
+		r.checkReady = true
+		r.readyTimeout = timeout
+		return nil
+	}
+}
+
+// A Runner runs a single experiment, sending requests to its targets and collecting
+// statistics on how they respond.
+type Runner struct {
+	exp           *Experiment
+	source        RequestSource
+	sinks         []Sink
+	failures      *FailureStore
+	printFailures bool
+	interval      time.Duration
+	checkReady    bool
+	readyTimeout  time.Duration
+
+	coll       *Collector
+	timings    chan *RequestTiming // timings read by the collector
+	sequential *SequentialTest     // nil unless the experiment has a sequential test
+
+	mu      sync.Mutex // guards started
+	started bool
+}
+
+// Result holds the outcome of running an experiment.
+type Result struct {
+	Targets      []*Target               // every target that was sent requests, in the order they were added
+	Stats        map[string]MetricSample // statistics of each target, keyed by target name
+	DispatchSkew MetricValues            // difference between the earliest and latest time each request was sent to its targets
+	Sequential   []SequentialResult      // outcome of the experiment's sequential test for each target, if it has one
+	Groups       map[string]GroupSample  // statistics of each group of replicas, keyed by group name
+}
+
+// NewRunner creates a runner for the experiment.
+func NewRunner(exp *Experiment, opts ...Option) (*Runner, error) {
+	r := &Runner{
+		exp:     exp,
+		timings: make(chan *RequestTiming, 10000),
+	}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+	if r.source == nil {
+		return nil, fmt.Errorf("a request source must be supplied")
+	}
+
+	var err error
+	r.coll, err = NewCollector(r.timings, 100*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("new collector: %w", err)
+	}
+	r.coll.ExcludeDown = exp.Health.ExcludeDown
+	r.coll.Interval = r.interval
+	r.coll.Baseline = exp.Baseline
+
+	if exp.Sequential != nil {
+		r.sequential, err = NewSequentialTest(exp.Name, exp.Sequential, exp.Health.ExcludeDown)
+		if err != nil {
+			return nil, fmt.Errorf("new sequential test: %w", err)
+		}
+		r.sinks = append(r.sinks, r.sequential)
+	}
+
+	return r, nil
+}
+
+// Collector returns the collector of the runner's statistics, which may be used to follow
+// the progress of the experiment while it runs.
+func (r *Runner) Collector() *Collector {
+	return r.coll
+}
+
+// Run sends requests to the experiment's targets until its duration has passed, the
+// source is exhausted or the context is canceled. It may only be called once. The
+// result holds the statistics collected up until the run stopped.
+func (r *Runner) Run(ctx context.Context) (*Result, error) {
+	r.mu.Lock()
+	started := r.started
+	r.started = true
+	r.mu.Unlock()
+	if started {
+		return nil, fmt.Errorf("runner has already been run")
+	}
+
+	if r.checkReady {
+		if err := TargetsReady(ctx, r.exp.Targets, !r.printFailures, false, 0, int(r.readyTimeout/time.Second)); err != nil {
+			return nil, fmt.Errorf("targets ready check: %w", err)
+		}
+	}
+
+	// sinks are given each timing before it is passed on to the collector
+	timings := r.timings
+	if len(r.sinks) > 0 {
+		timings = make(chan *RequestTiming, cap(r.timings))
+	}
+
+	l, err := r.exp.NewLoader(r.source, timings)
+	if err != nil {
+		return nil, fmt.Errorf("new loader: %w", err)
+	}
+	l.PrintFailures = r.printFailures
+	l.Failures = r.failures
+
+	// the collector stops once its timings are closed so it holds every timing even if
+	// the run is canceled
+	collDone := make(chan struct{})
+	go func() {
+		defer close(collDone)
+		r.coll.Run(context.Background())
+	}()
+
+	teeDone := make(chan struct{})
+	if len(r.sinks) > 0 {
+		go func() {
+			defer close(teeDone)
+			for res := range timings {
+				for _, sink := range r.sinks {
+					sink.Record(res)
+				}
+				r.timings <- res
+			}
+		}()
+	} else {
+		close(teeDone)
+	}
+
+	// the sequential test may end the run early once every target has a verdict
+	sendCtx, sendCancel := context.WithCancel(ctx)
+	defer sendCancel()
+	if r.sequential != nil {
+		go r.sequential.Run(sendCtx)
+		if r.exp.Sequential.Stop {
+			go func() {
+				select {
+				case <-sendCtx.Done():
+				case <-r.sequential.Decided():
+					sendCancel()
+				}
+			}()
+		}
+	}
+
+	sendErr := l.Send(sendCtx)
+
+	if len(r.sinks) > 0 {
+		close(timings)
+	}
+	<-teeDone
+	close(r.timings)
+	<-collDone
+
+	res := &Result{
+		Targets:      l.AllTargets(),
+		Stats:        r.coll.Latest(),
+		DispatchSkew: l.DispatchSkew(),
+		Groups:       r.coll.LatestGroups(),
+	}
+	if r.sequential != nil {
+		res.Sequential = r.sequential.Results()
+	}
+	if sendErr != nil && !errors.Is(sendErr, context.Canceled) && !errors.Is(sendErr, context.DeadlineExceeded) {
+		return res, fmt.Errorf("send: %w", sendErr)
+	}
+	return res, nil
+}
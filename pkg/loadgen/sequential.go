@@ -0,0 +1,461 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	schema "github.com/probe-lab/thunderdome/pkg/exp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type SequentialJSON = schema.SequentialJSON
+
+// Verdicts of a sequential test comparing a target with the baseline. Lower values of
+// every metric are better.
+const (
+	VerdictUndecided  = "undecided"  // not enough evidence has been collected yet
+	VerdictBetter     = "better"     // the target's metric is lower than the baseline's
+	VerdictWorse      = "worse"      // the target's metric is higher than the baseline's
+	VerdictEquivalent = "equivalent" // any difference from the baseline is smaller than the minimum effect
+)
+
+var verdictNames = []string{VerdictUndecided, VerdictBetter, VerdictWorse, VerdictEquivalent}
+
+type SequentialConfig struct {
+	Metric      string
+	Baseline    string  // name of the target the others are compared with
+	Alpha       float64 // probability of declaring a difference when there is none
+	MinEffect   float64 // smallest difference worth detecting
+	Window      time.Duration
+	MinWindows  int
+	MinRequests int
+	Stop        bool // stop sending requests once every target has a verdict
+}
+
+// IsRate reports whether the metric is a rate, whose differences from the baseline are
+// absolute rather than relative.
+func (cfg *SequentialConfig) IsRate() bool {
+	return cfg.Metric == "error_rate"
+}
+
+// newSequentialConfig creates the configuration of a sequential test. The baseline
+// defaults to the experiment's baseline, then to the first target.
+func newSequentialConfig(sj *SequentialJSON, baseline string, targets []*TargetJSON, discovery bool) (*SequentialConfig, error) {
+	if sj == nil {
+		return nil, nil
+	}
+
+	cfg := &SequentialConfig{
+		Metric:      sj.Metric,
+		Baseline:    sj.Baseline,
+		Alpha:       0.05,
+		MinEffect:   0.05,
+		Window:      60 * time.Second,
+		MinWindows:  5,
+		MinRequests: 20,
+		Stop:        sj.Stop,
+	}
+
+	if !slices.Contains(schema.SequentialMetrics, cfg.Metric) {
+		return nil, fmt.Errorf("unsupported metric %q, must be one of %s", cfg.Metric, strings.Join(schema.SequentialMetrics, ", "))
+	}
+	if cfg.IsRate() {
+		cfg.MinEffect = 0.01
+	}
+
+	if sj.Alpha < 0 || sj.Alpha >= 1 {
+		return nil, fmt.Errorf("alpha must be between 0 and 1")
+	}
+	if sj.MinEffect < 0 || sj.Window < 0 || sj.MinWindows < 0 || sj.MinRequests < 0 {
+		return nil, fmt.Errorf("sequential test values must not be negative")
+	}
+	if sj.Alpha > 0 {
+		cfg.Alpha = sj.Alpha
+	}
+	if sj.MinEffect > 0 {
+		cfg.MinEffect = sj.MinEffect
+	}
+	if sj.Window > 0 {
+		cfg.Window = time.Duration(sj.Window) * time.Second
+	}
+	if sj.MinWindows > 0 {
+		cfg.MinWindows = sj.MinWindows
+	}
+	// the variance of the differences cannot be estimated from fewer windows
+	if cfg.MinWindows < 2 {
+		cfg.MinWindows = 2
+	}
+	if sj.MinRequests > 0 {
+		cfg.MinRequests = sj.MinRequests
+	}
+
+	if cfg.Baseline == "" {
+		cfg.Baseline = baseline
+	}
+	if cfg.Baseline == "" {
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("baseline must be specified when targets are discovered")
+		}
+		cfg.Baseline = targets[0].Name
+	} else if !discovery {
+		found := slices.ContainsFunc(targets, func(tj *TargetJSON) bool { return tj.Name == cfg.Baseline })
+		if !found {
+			return nil, fmt.Errorf("baseline target %q not found in experiment", cfg.Baseline)
+		}
+	}
+
+	return cfg, nil
+}
+
+// A SequentialResult is the outcome of comparing a target with the baseline.
+type SequentialResult struct {
+	Target     string
+	Baseline   string
+	Metric     string
+	Verdict    string
+	Windows    int       // number of windows compared
+	Difference float64   // mean difference from the baseline, a fraction of the baseline's value unless the metric is a rate
+	Lower      float64   // lower bound of the confidence interval of the difference
+	Upper      float64   // upper bound of the confidence interval of the difference
+	DecidedAt  time.Time // time the verdict was declared, zero if undecided
+}
+
+// A SequentialTest compares each target with a baseline after every window of requests,
+// declaring a verdict as soon as there is enough evidence that the target is better,
+// worse or no different to the baseline.
+//
+// Each window gives one observation of the difference between a target's metric and the
+// baseline's. The observations are tested using a mixture sequential probability ratio
+// test that estimates their variance as it goes, whose confidence intervals remain valid
+// however often they are checked, so the experiment can be stopped as soon as a verdict
+// is reached without inflating the error rate.
+type SequentialTest struct {
+	cfg            *SequentialConfig
+	experimentName string
+	excludeDown    bool
+
+	verdictGauge    *prometheus.GaugeVec
+	differenceGauge *prometheus.GaugeVec
+	windowsGauge    *prometheus.GaugeVec
+
+	decided chan struct{} // closed once every target compared with the baseline has a verdict
+
+	mu      sync.Mutex // guards following fields
+	window  map[string]*sequentialWindow
+	results map[string]*sequentialState
+	closed  bool // decided has been closed
+}
+
+func NewSequentialTest(experimentName string, cfg *SequentialConfig, excludeDown bool) (*SequentialTest, error) {
+	st := &SequentialTest{
+		cfg:            cfg,
+		experimentName: experimentName,
+		excludeDown:    excludeDown,
+		decided:        make(chan struct{}),
+		window:         make(map[string]*sequentialWindow),
+		results:        make(map[string]*sequentialState),
+	}
+
+	var err error
+	st.verdictGauge, err = NewGaugeMetric(
+		"sequential_verdict",
+		"Set to 1 for the current verdict of the sequential test comparing the target with the baseline: undecided, better, worse or equivalent.",
+		[]string{"experiment", "target", "baseline", "metric", "verdict"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	st.differenceGauge, err = NewGaugeMetric(
+		"sequential_difference",
+		"The estimated difference between the target's metric and the baseline's and the bounds of its confidence interval, a fraction of the baseline's value unless the metric is a rate.",
+		[]string{"experiment", "target", "baseline", "metric", "bound"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	st.windowsGauge, err = NewGaugeMetric(
+		"sequential_windows",
+		"The number of windows in which the target has been compared with the baseline.",
+		[]string{"experiment", "target", "baseline", "metric"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	return st, nil
+}
+
+// Record adds a request timing to the current window.
+func (st *SequentialTest) Record(res *RequestTiming) {
+	if res.WarmUp || res.Dropped || (res.TargetDown && st.excludeDown) {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	w, ok := st.window[res.TargetName]
+	if !ok {
+		w = &sequentialWindow{times: NewTimeMetric()}
+		st.window[res.TargetName] = w
+	}
+	w.record(res, st.cfg.Metric)
+}
+
+// Run compares the targets with the baseline at the end of every window until the
+// context is canceled.
+func (st *SequentialTest) Run(ctx context.Context) {
+	t := time.NewTicker(st.cfg.Window)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			st.closeWindow(now)
+		}
+	}
+}
+
+// Decided returns a channel that is closed once every target compared with the baseline
+// has a verdict.
+func (st *SequentialTest) Decided() <-chan struct{} {
+	return st.decided
+}
+
+// Results returns the outcome of comparing each target with the baseline, ordered by
+// target name.
+func (st *SequentialTest) Results() []SequentialResult {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	results := make([]SequentialResult, 0, len(st.results))
+	for _, s := range st.results {
+		results = append(results, s.SequentialResult)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Target < results[j].Target })
+	return results
+}
+
+// closeWindow adds the difference between each target and the baseline in the window
+// that has just ended to the tests and starts a new window.
+func (st *SequentialTest) closeWindow(now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	window := st.window
+	st.window = make(map[string]*sequentialWindow)
+
+	base, ok := window[st.cfg.Baseline]
+	if !ok {
+		return
+	}
+	baseValue, ok := base.value(st.cfg)
+	if !ok {
+		return
+	}
+	if !st.cfg.IsRate() && baseValue <= 0 {
+		return
+	}
+
+	for name, w := range window {
+		if name == st.cfg.Baseline {
+			continue
+		}
+		v, ok := w.value(st.cfg)
+		if !ok {
+			continue
+		}
+		d := v - baseValue
+		if !st.cfg.IsRate() {
+			d /= baseValue
+		}
+
+		s, ok := st.results[name]
+		if !ok {
+			s = &sequentialState{
+				SequentialResult: SequentialResult{
+					Target:   name,
+					Baseline: st.cfg.Baseline,
+					Metric:   st.cfg.Metric,
+					Verdict:  VerdictUndecided,
+				},
+			}
+			st.results[name] = s
+		}
+		s.add(d)
+		if s.update(st.cfg, now) {
+			fmt.Fprintf(os.Stderr, "sequential test: %s is %s than baseline %s on %s (difference %s, interval %s to %s after %d windows)\n", name, verdictDesc(s.Verdict), st.cfg.Baseline, st.cfg.Metric, st.differenceDesc(s.Difference), st.differenceDesc(s.Lower), st.differenceDesc(s.Upper), s.Windows)
+		}
+		st.report(s)
+	}
+
+	if st.closed || len(st.results) == 0 {
+		return
+	}
+	for _, s := range st.results {
+		if s.Verdict == VerdictUndecided {
+			return
+		}
+	}
+	st.closed = true
+	close(st.decided)
+}
+
+// report updates the metrics of a target's test, st.mu must be held by the caller
+func (st *SequentialTest) report(s *sequentialState) {
+	for _, name := range verdictNames {
+		v := 0.0
+		if name == s.Verdict {
+			v = 1
+		}
+		st.verdictGauge.WithLabelValues(st.experimentName, s.Target, s.Baseline, s.Metric, name).Set(v)
+	}
+	st.differenceGauge.WithLabelValues(st.experimentName, s.Target, s.Baseline, s.Metric, "estimate").Set(s.Difference)
+	st.differenceGauge.WithLabelValues(st.experimentName, s.Target, s.Baseline, s.Metric, "lower").Set(Finite(s.Lower))
+	st.differenceGauge.WithLabelValues(st.experimentName, s.Target, s.Baseline, s.Metric, "upper").Set(Finite(s.Upper))
+	st.windowsGauge.WithLabelValues(st.experimentName, s.Target, s.Baseline, s.Metric).Set(float64(s.Windows))
+}
+
+// differenceDesc formats a difference from the baseline for printing.
+func (st *SequentialTest) differenceDesc(d float64) string {
+	if st.cfg.IsRate() {
+		return fmt.Sprintf("%+.3f", d)
+	}
+	return fmt.Sprintf("%+.1f%%", d*100)
+}
+
+func verdictDesc(verdict string) string {
+	switch verdict {
+	case VerdictBetter:
+		return "better"
+	case VerdictWorse:
+		return "worse"
+	case VerdictEquivalent:
+		return "no different"
+	}
+	return verdict
+}
+
+// sequentialWindow holds the measurements of a target during a single window.
+type sequentialWindow struct {
+	requests int
+	failed   int
+	times    *TimeMetric
+}
+
+func (w *sequentialWindow) record(res *RequestTiming, metric string) {
+	w.requests++
+	if res.ConnectError || res.TimeoutError || res.StatusCode/100 == 5 {
+		w.failed++
+	}
+	if res.StatusCode/100 != 2 || res.ErrorClass != ErrorNone {
+		return
+	}
+	if strings.HasPrefix(metric, "ttfb_") {
+		w.times.Add(res.TTFB.Seconds())
+	} else if !res.Transfer.Truncated {
+		w.times.Add(res.TotalTime.Seconds())
+	}
+}
+
+// value returns the metric's value in the window and whether there were enough
+// measurements for it to be used.
+func (w *sequentialWindow) value(cfg *SequentialConfig) (float64, bool) {
+	if cfg.IsRate() {
+		if w.requests < cfg.MinRequests {
+			return 0, false
+		}
+		return float64(w.failed) / float64(w.requests), true
+	}
+
+	if w.times.Count < cfg.MinRequests {
+		return 0, false
+	}
+	v := w.times.Values()
+	switch cfg.Metric[strings.LastIndex(cfg.Metric, "_")+1:] {
+	case "p50":
+		return v.P50, true
+	case "p90":
+		return v.P90, true
+	case "p99":
+		return v.P99, true
+	default:
+		return v.Mean, true
+	}
+}
+
+// sequentialMixingVariance is the variance of the mixing distribution over the difference
+// from the baseline in units of the standard deviation of the differences between windows.
+const sequentialMixingVariance = 1.0
+
+// sequentialState is the running state of the test of a single target.
+type sequentialState struct {
+	SequentialResult
+	sum   float64 // sum of the differences
+	sumSq float64 // sum of the squares of the differences
+}
+
+func (s *sequentialState) add(d float64) {
+	s.Windows++
+	s.sum += d
+	s.sumSq += d * d
+}
+
+// update recalculates the estimate of the difference and its confidence interval and
+// reports whether a verdict was declared. Verdicts are final once declared.
+func (s *sequentialState) update(cfg *SequentialConfig, now time.Time) bool {
+	n := float64(s.Windows)
+	mean := s.sum / n
+	s.Difference = mean
+	s.Lower, s.Upper = math.Inf(-1), math.Inf(1)
+	if s.Windows < 2 {
+		return false
+	}
+
+	variance := (s.sumSq - n*mean*mean) / (n - 1)
+	if variance < 1e-12 {
+		variance = 1e-12
+	}
+
+	// The variance of the differences is not known in advance and the sample variance is
+	// a poor estimate of it after a few windows, so the interval is that of a scale
+	// invariant mixture test: the t statistic's Bayes factor using a normal mixing
+	// distribution over the difference measured in standard deviations and the right
+	// Haar prior over the standard deviation. This is a test martingale, so the interval
+	// of the differences whose Bayes factor is below 1/alpha remains valid however often
+	// it is checked. It is unbounded until there are enough windows to rule anything out,
+	// which is five windows when alpha is 0.05.
+	nu := n - 1
+	a := 1 + n*sequentialMixingVariance
+	k := math.Pow(math.Sqrt(a)/cfg.Alpha, 2/(nu+1))
+	if k >= a {
+		return false
+	}
+	maxT2 := nu * (k - 1) / (1 - k/a)
+	halfWidth := math.Sqrt(variance * maxT2 / n)
+	s.Lower, s.Upper = mean-halfWidth, mean+halfWidth
+
+	if s.Verdict != VerdictUndecided || s.Windows < cfg.MinWindows {
+		return false
+	}
+	switch {
+	case s.Upper < 0:
+		s.Verdict = VerdictBetter
+	case s.Lower > 0:
+		s.Verdict = VerdictWorse
+	case s.Lower > -cfg.MinEffect && s.Upper < cfg.MinEffect:
+		s.Verdict = VerdictEquivalent
+	default:
+		return false
+	}
+	s.DecidedAt = now
+	return true
+}
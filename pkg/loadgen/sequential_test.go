@@ -0,0 +1,144 @@
+package loadgen
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func testSequentialConfig(t *testing.T, sj *SequentialJSON) *SequentialConfig {
+	t.Helper()
+	cfg, err := newSequentialConfig(sj, "base", []*TargetJSON{{Name: "base"}, {Name: "target"}}, false)
+	if err != nil {
+		t.Fatalf("new sequential config: %v", err)
+	}
+	return cfg
+}
+
+// runSequential adds normally distributed differences to a test until a verdict is
+// declared or the maximum number of windows is reached.
+func runSequential(cfg *SequentialConfig, rng *rand.Rand, mean, stddev float64, maxWindows int) *sequentialState {
+	s := &sequentialState{SequentialResult: SequentialResult{Verdict: VerdictUndecided}}
+	for i := 0; i < maxWindows; i++ {
+		s.add(mean + stddev*rng.NormFloat64())
+		if s.update(cfg, time.Now()) {
+			break
+		}
+	}
+	return s
+}
+
+func TestSequentialVerdicts(t *testing.T) {
+	testCases := []struct {
+		name   string
+		mean   float64
+		stddev float64
+		want   string
+	}{
+		{name: "better", mean: -0.2, stddev: 0.1, want: VerdictBetter},
+		{name: "worse", mean: 0.2, stddev: 0.1, want: VerdictWorse},
+		{name: "equivalent", mean: 0, stddev: 0.01, want: VerdictEquivalent},
+		{name: "slightly worse", mean: 0.03, stddev: 0.01, want: VerdictWorse},
+	}
+
+	cfg := testSequentialConfig(t, &SequentialJSON{Metric: "ttfb_p50"})
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			s := runSequential(cfg, rng, tc.mean, tc.stddev, 200)
+			if s.Verdict != tc.want {
+				t.Fatalf("got verdict %s after %d windows, wanted %s", s.Verdict, s.Windows, tc.want)
+			}
+			if s.Windows < cfg.MinWindows {
+				t.Errorf("verdict declared after %d windows, wanted at least %d", s.Windows, cfg.MinWindows)
+			}
+			if s.Lower > tc.mean || s.Upper < tc.mean {
+				t.Errorf("interval %g to %g does not contain the true difference %g", s.Lower, s.Upper, tc.mean)
+			}
+		})
+	}
+}
+
+func TestSequentialUnboundedWithFewWindows(t *testing.T) {
+	cfg := testSequentialConfig(t, &SequentialJSON{Metric: "ttfb_p50", MinWindows: 1})
+	s := &sequentialState{SequentialResult: SequentialResult{Verdict: VerdictUndecided}}
+
+	// the differences look very consistent but a handful of windows cannot rule out that
+	// the variance is much larger than it appears
+	for i, d := range []float64{0.5, 0.51, 0.49, 0.5, 0.5} {
+		s.add(d)
+		decided := s.update(cfg, time.Now())
+		if i < 4 {
+			if decided || !math.IsInf(s.Lower, -1) || !math.IsInf(s.Upper, 1) {
+				t.Fatalf("got verdict %s and interval %g to %g after %d windows, wanted undecided and unbounded", s.Verdict, s.Lower, s.Upper, s.Windows)
+			}
+			continue
+		}
+		if !decided || s.Verdict != VerdictWorse {
+			t.Fatalf("got verdict %s and interval %g to %g after %d windows, wanted worse", s.Verdict, s.Lower, s.Upper, s.Windows)
+		}
+	}
+}
+
+func TestSequentialFalsePositiveRate(t *testing.T) {
+	const runs = 2000
+
+	// the minimum effect is tiny so that targets with no difference are almost never
+	// declared equivalent and the test keeps looking for a difference in every window
+	cfg := testSequentialConfig(t, &SequentialJSON{Metric: "ttfb_p50", MinWindows: 2, MinEffect: 1e-9})
+	rng := rand.New(rand.NewSource(1))
+
+	falsePositives := 0
+	for i := 0; i < runs; i++ {
+		s := runSequential(cfg, rng, 0, 0.1, 100)
+		if s.Verdict == VerdictBetter || s.Verdict == VerdictWorse {
+			falsePositives++
+		}
+	}
+
+	if rate := float64(falsePositives) / runs; rate > cfg.Alpha {
+		t.Errorf("got false positive rate %g, wanted at most %g", rate, cfg.Alpha)
+	}
+}
+
+func TestSequentialErrorRate(t *testing.T) {
+	cfg := testSequentialConfig(t, &SequentialJSON{Metric: "error_rate", MinRequests: 10})
+	st, err := NewSequentialTest("sequential", cfg, false)
+	if err != nil {
+		t.Fatalf("new sequential test: %v", err)
+	}
+
+	now := time.Now()
+	for w := 0; w < 20; w++ {
+		for i := 0; i < 100; i++ {
+			st.Record(&RequestTiming{TargetName: "base", StatusCode: 200})
+			status := 200
+			if i%5 == w%2 {
+				status = 500
+			}
+			st.Record(&RequestTiming{TargetName: "target", StatusCode: status})
+		}
+		// requests during warm up are ignored
+		st.Record(&RequestTiming{TargetName: "target", StatusCode: 500, WarmUp: true})
+		now = now.Add(cfg.Window)
+		st.closeWindow(now)
+	}
+
+	results := st.Results()
+	if len(results) != 1 {
+		t.Fatalf("got %d results, wanted 1", len(results))
+	}
+	r := results[0]
+	if r.Verdict != VerdictWorse {
+		t.Errorf("got verdict %s, wanted worse", r.Verdict)
+	}
+	if math.Abs(r.Difference-0.2) > 1e-9 {
+		t.Errorf("got difference %g, wanted 0.2", r.Difference)
+	}
+	select {
+	case <-st.Decided():
+	default:
+		t.Errorf("decided channel not closed after every target has a verdict")
+	}
+}
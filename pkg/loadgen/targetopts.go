@@ -0,0 +1,87 @@
+package loadgen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+
+	schema "github.com/probe-lab/thunderdome/pkg/exp"
+)
+
+type AuthJSON = schema.AuthJSON
+
+type TLSJSON = schema.TLSJSON
+
+// newTargetHeader returns the headers added to every request sent to a target, including
+// any Authorization header.
+func newTargetHeader(headers map[string]string, aj *AuthJSON) (http.Header, error) {
+	h := make(http.Header, len(headers)+1)
+	for k, v := range headers {
+		h.Set(k, os.ExpandEnv(v))
+	}
+
+	if aj == nil {
+		return h, nil
+	}
+	switch {
+	case aj.Bearer != "" && (aj.Username != "" || aj.Password != ""):
+		return nil, fmt.Errorf("auth must use only one of bearer or basic authentication")
+	case aj.Bearer != "":
+		h.Set("Authorization", "Bearer "+os.ExpandEnv(aj.Bearer))
+	case aj.Username != "":
+		creds := os.ExpandEnv(aj.Username) + ":" + os.ExpandEnv(aj.Password)
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
+	case aj.Password != "":
+		return nil, fmt.Errorf("auth password requires a username")
+	}
+	return h, nil
+}
+
+// newTLSConfig creates the TLS configuration used for connections to a target whose host
+// is hostName. Requests are sent to the addresses the host resolved to, so the server name
+// is always set explicitly rather than being taken from the request's URL, otherwise SNI
+// and certificate verification would use an IP address.
+func newTLSConfig(tj *TLSJSON, hostName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         hostName,
+	}
+	if tj == nil {
+		return cfg, nil
+	}
+
+	if tj.ServerName != "" {
+		cfg.ServerName = tj.ServerName
+	}
+
+	if tj.Verify || tj.CAFile != "" {
+		cfg.InsecureSkipVerify = false
+	}
+
+	if tj.CAFile != "" {
+		pem, err := os.ReadFile(tj.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca file %s", tj.CAFile)
+		}
+	}
+
+	if tj.CertFile != "" || tj.KeyFile != "" {
+		if tj.CertFile == "" || tj.KeyFile == "" {
+			return nil, fmt.Errorf("both cert file and key file must be specified")
+		}
+		cert, err := tls.LoadX509KeyPair(tj.CertFile, tj.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
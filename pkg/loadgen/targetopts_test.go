@@ -0,0 +1,104 @@
+package loadgen
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/probe-lab/thunderdome/pkg/request"
+)
+
+func TestTargetUsesHostNameWithResolvedAddress(t *testing.T) {
+	type seen struct {
+		host       string
+		serverName string
+	}
+	got := make(chan seen, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- seen{host: r.Host, serverName: r.TLS.ServerName}
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("parse server url: %v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		target     TargetJSON
+		header     map[string]string
+		wantHost   string
+		wantServer string
+	}{
+		{
+			name:       "url host",
+			target:     TargetJSON{BaseURL: "https://gateway.example:" + u.Port()},
+			wantHost:   "gateway.example",
+			wantServer: "gateway.example",
+		},
+		{
+			name:       "host override",
+			target:     TargetJSON{BaseURL: "https://gateway.example:" + u.Port(), Host: "ipfs.example"},
+			wantHost:   "ipfs.example",
+			wantServer: "ipfs.example",
+		},
+		{
+			name:       "tls server name",
+			target:     TargetJSON{BaseURL: "https://gateway.example:" + u.Port(), TLS: &TLSJSON{ServerName: "sni.example"}},
+			wantHost:   "gateway.example",
+			wantServer: "sni.example",
+		},
+		{
+			name:       "request host",
+			target:     TargetJSON{BaseURL: "https://gateway.example:" + u.Port()},
+			header:     map[string]string{"Host": "dweb.example"},
+			wantHost:   "dweb.example",
+			wantServer: "gateway.example",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			exp, err := NewExperiment(&ExperimentJSON{
+				Name:           "targetopts",
+				MaxRequestRate: 1,
+				MaxConcurrency: 1,
+				Duration:       -1,
+				Targets:        []*TargetJSON{&tc.target},
+			})
+			if err != nil {
+				t.Fatalf("new experiment: %v", err)
+			}
+			target := exp.Targets[0]
+
+			// requests are sent to the resolved address rather than the host name
+			target.SetAddrs([]string{u.Host})
+
+			req, err := newRequest(context.Background(), target, &request.Request{Method: "GET", URI: "/ipfs/bafy", Header: tc.header})
+			if err != nil {
+				t.Fatalf("new request: %v", err)
+			}
+			if req.URL.Host != u.Host {
+				t.Errorf("got url host %q, wanted resolved address %q", req.URL.Host, u.Host)
+			}
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: target.TLS.Clone()}}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			resp.Body.Close()
+
+			s := <-got
+			if s.host != tc.wantHost {
+				t.Errorf("got host %q, wanted %q", s.host, tc.wantHost)
+			}
+			if s.serverName != tc.wantServer {
+				t.Errorf("got server name %q, wanted %q", s.serverName, tc.wantServer)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package loadgen
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// transferMarks are the amounts of the response body for which the time to receive them
+// is recorded.
+var transferMarks = [...]int64{64 << 10, 1 << 20}
+
+var TransferMarkNames = [len(transferMarks)]string{"64KiB", "1MiB"}
+
+// DefaultStallThreshold is the length of pause while reading a response body after which
+// the transfer is considered to have stalled.
+const DefaultStallThreshold = 5 * time.Second
+
+// TransferStats describes the progress of reading a response body.
+type TransferStats struct {
+	Bytes        int64                             // number of bytes of body read
+	Duration     time.Duration                     // time taken to read the body
+	LongestStall time.Duration                     // longest pause between reads of the body
+	MarkTimes    [len(transferMarks)]time.Duration // time from the start of the request until each mark was received, negative if it was not reached
+	Truncated    bool                              // reading the body was aborted because it exceeded a transfer limit
+}
+
+// TransferLimits bound how much of a response body is read.
+type TransferLimits struct {
+	MaxBytes int64         // maximum number of bytes to read, zero for no limit
+	MaxTime  time.Duration // maximum time to spend reading, zero for no limit
+}
+
+// requestTimeout is the time allowed for a request to complete when reading its body is
+// not limited to a maximum time.
+const requestTimeout = 30 * time.Second
+
+// ClientTimeout returns the time allowed for a request to complete, extended by the
+// maximum time spent reading the body so that a longer limit takes effect.
+func (tl TransferLimits) ClientTimeout() time.Duration {
+	return requestTimeout + tl.MaxTime
+}
+
+// readBody reads and discards the body, sampling the progress of the transfer. start is
+// the time the request was started. If a limit is exceeded abort is called to cancel the
+// request and the transfer is marked as truncated. A byte past the size limit is read so
+// that a body of exactly the limit is not mistaken for a truncated one.
+func readBody(body io.Reader, start time.Time, limits TransferLimits, abort func()) (TransferStats, error) {
+	var ts TransferStats
+	for i := range ts.MarkTimes {
+		ts.MarkTimes[i] = -1
+	}
+
+	var timedOut atomic.Bool
+	if limits.MaxTime > 0 {
+		t := time.AfterFunc(limits.MaxTime, func() {
+			timedOut.Store(true)
+			abort()
+		})
+		defer t.Stop()
+	}
+
+	buf := make([]byte, 32*1024)
+	begin := time.Now()
+	last := begin
+	for {
+		p := buf
+		if limits.MaxBytes > 0 && limits.MaxBytes+1-ts.Bytes < int64(len(p)) {
+			p = p[:limits.MaxBytes+1-ts.Bytes]
+		}
+		n, err := body.Read(p)
+		now := time.Now()
+		if n > 0 {
+			if stall := now.Sub(last); stall > ts.LongestStall {
+				ts.LongestStall = stall
+			}
+			last = now
+			ts.Bytes += int64(n)
+			for i, mark := range transferMarks {
+				if ts.MarkTimes[i] < 0 && ts.Bytes >= mark {
+					ts.MarkTimes[i] = now.Sub(start)
+				}
+			}
+		}
+		if limits.MaxBytes > 0 && ts.Bytes > limits.MaxBytes {
+			abort()
+			ts.Truncated = true
+			ts.Duration = now.Sub(begin)
+			return ts, nil
+		}
+		if err != nil {
+			// a pause before the body failed or ended also counts as a stall
+			if stall := now.Sub(last); stall > ts.LongestStall {
+				ts.LongestStall = stall
+			}
+			ts.Duration = now.Sub(begin)
+			if timedOut.Load() {
+				ts.Truncated = true
+				return ts, nil
+			}
+			if err == io.EOF {
+				return ts, nil
+			}
+			return ts, err
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package loadgen
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestReadBodyMaxBytes(t *testing.T) {
+	testCases := []struct {
+		name      string
+		size      int
+		maxBytes  int64
+		wantBytes int64
+		truncated bool
+	}{
+		{name: "no limit", size: 100000, maxBytes: 0, wantBytes: 100000},
+		{name: "under limit", size: 999, maxBytes: 1000, wantBytes: 999},
+		{name: "exactly limit", size: 1000, maxBytes: 1000, wantBytes: 1000},
+		{name: "one over limit", size: 1001, maxBytes: 1000, wantBytes: 1001, truncated: true},
+		{name: "well over limit", size: 100000, maxBytes: 1000, wantBytes: 1001, truncated: true},
+		{name: "exactly limit larger than buffer", size: 40000, maxBytes: 40000, wantBytes: 40000},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, oneByte := range []bool{false, true} {
+				var r io.Reader = bytes.NewReader(make([]byte, tc.size))
+				if oneByte {
+					r = iotest.OneByteReader(r)
+				}
+
+				aborted := false
+				ts, err := readBody(r, time.Now(), TransferLimits{MaxBytes: tc.maxBytes}, func() { aborted = true })
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if ts.Bytes != tc.wantBytes {
+					t.Errorf("got %d bytes, wanted %d (one byte reads: %v)", ts.Bytes, tc.wantBytes, oneByte)
+				}
+				if ts.Truncated != tc.truncated {
+					t.Errorf("got truncated %v, wanted %v (one byte reads: %v)", ts.Truncated, tc.truncated, oneByte)
+				}
+				if aborted != tc.truncated {
+					t.Errorf("got aborted %v, wanted %v (one byte reads: %v)", aborted, tc.truncated, oneByte)
+				}
+			}
+		})
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	if got := (TransferLimits{}).ClientTimeout(); got != requestTimeout {
+		t.Errorf("got %s without a transfer limit, wanted %s", got, requestTimeout)
+	}
+	if got := (TransferLimits{MaxTime: 2 * time.Minute}).ClientTimeout(); got <= 2*time.Minute {
+		t.Errorf("got %s with a two minute transfer limit, wanted longer than the limit", got)
+	}
+}
@@ -0,0 +1,595 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/probe-lab/thunderdome/pkg/request"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/sync/errgroup"
+)
+
+type Worker struct {
+	Target         *Target
+	ExperimentName string
+	Client         *http.Client
+	PrintFailures  bool
+	WarmUpUntil    time.Time     // requests sent before this time are marked as part of the warm up
+	Stall          time.Duration // length of pause while reading a response body after which the transfer is considered stalled
+	Limits         TransferLimits
+	VerifyRanges   float64       // fraction of partial responses whose bytes are compared with a fetch of the full body
+	Failures       *FailureStore // keeps a sample of failed and anomalous requests, may be nil
+}
+
+func (w *Worker) Run(ctx context.Context, wg *sync.WaitGroup, results chan *RequestTiming) {
+	defer wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d, ok := <-w.Target.Requests:
+			if !ok {
+				return
+			}
+			d.Group.Arrive(ctx)
+			lag := d.Group.Started(time.Now())
+			down := w.Target.Health != nil && w.Target.Health.IsDown()
+			warmUp := time.Now().Before(w.WarmUpUntil)
+			result := w.timeRequest(ctx, d.Request)
+			result.TargetDown = down
+			result.WarmUp = warmUp
+			result.DispatchLag = lag
+			if w.Target.Health != nil {
+				// A failure while reading the body counts against the target's health as
+				// well as connection failures and timeouts, but an error status does not
+				// since the target was able to respond.
+				w.Target.Health.Record(!result.ConnectError && !result.TimeoutError && result.ErrorClass == ErrorNone)
+			}
+
+			// Check context again since it might have been canceled while we were
+			// waiting for request
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			results <- result
+		}
+	}
+}
+
+func (w *Worker) timeRequest(ctx context.Context, r *request.Request) *RequestTiming {
+	req, err := newRequest(ctx, w.Target, r)
+	if err != nil {
+		if w.PrintFailures {
+			fmt.Fprintf(os.Stderr, "%s %s => error %v\n", r.Method, w.Target.BaseURL+r.URI, err)
+		}
+		res := &RequestTiming{
+			ExperimentName: w.ExperimentName,
+			TargetName:     w.Target.Name,
+			TargetGroup:    w.Target.Group,
+			OriginStatus:   r.Status,
+			ConnectError:   true,
+			ErrorClass:     ErrorOther,
+			RPCMethod:      rpcMethod(r),
+		}
+		if w.Failures != nil {
+			w.Failures.Add(newFailureSample(res, failureReason(res), r, nil, time.Now(), err))
+		}
+		return res
+	}
+
+	ctx, span := otel.Tracer("dealgood").Start(req.Context(), "HTTP "+req.Method, trace.WithAttributes(attribute.String("uri", r.URI)))
+	defer span.End()
+
+	prop := otel.GetTextMapPropagator()
+	prop.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	// cancelling the request closes the connection when reading the body is aborted
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	var start, end time.Time
+	var connectTime, ttfb, totalTime time.Duration
+	tracer := &phaseTracer{}
+
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), tracer.ClientTrace()))
+	start = time.Now()
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		totalTime = time.Since(start)
+		if w.PrintFailures {
+			fmt.Fprintf(os.Stderr, "%s %s => error %v\n", req.Method, req.URL, err)
+		}
+		errClass := classifyError(err, false)
+		if os.IsTimeout(err) {
+			res := &RequestTiming{
+				ExperimentName: w.ExperimentName,
+				TargetName:     w.Target.Name,
+				TargetGroup:    w.Target.Group,
+				OriginStatus:   r.Status,
+				TimeoutError:   true,
+				ErrorClass:     errClass,
+				TotalTime:      totalTime,
+				RPCMethod:      rpcMethod(r),
+				Backend:        req.URL.Host,
+			}
+			if w.Failures != nil {
+				w.Failures.Add(newFailureSample(res, failureReason(res), r, req, start, err))
+			}
+			return res
+		}
+		if err := resolveTarget(w.Target, !w.PrintFailures); err != nil {
+			fmt.Fprintf(os.Stderr, "resolve %s => error %v\n", w.Target.RawHostPort, err)
+		}
+
+		res := &RequestTiming{
+			ExperimentName: w.ExperimentName,
+			TargetName:     w.Target.Name,
+			TargetGroup:    w.Target.Group,
+			OriginStatus:   r.Status,
+			ConnectError:   true,
+			ErrorClass:     errClass,
+			TotalTime:      totalTime,
+			RPCMethod:      rpcMethod(r),
+			Backend:        req.URL.Host,
+		}
+		if w.Failures != nil {
+			w.Failures.Add(newFailureSample(res, failureReason(res), r, req, start, err))
+		}
+		return res
+	}
+	defer resp.Body.Close()
+
+	// keep the body of range requests so the response can be checked
+	var ranges []byteRange
+	var rangeBody *cappedBuffer
+	body := io.Reader(resp.Body)
+	if h := req.Header.Get("Range"); h != "" {
+		if ranges, err = parseRangeHeader(h); err == nil {
+			rangeBody = &cappedBuffer{max: maxRangeCapture}
+			body = io.TeeReader(resp.Body, rangeBody)
+		}
+	}
+
+	// keep the body of rpc requests so the response can be validated
+	var rpcBody *cappedBuffer
+	method := rpcMethod(r)
+	if method != "" {
+		rpcBody = &cappedBuffer{max: maxRPCCapture}
+		body = io.TeeReader(body, rpcBody)
+	}
+
+	// keep the start of the body in case the request needs to be captured as a failure
+	var failureBody *prefixBuffer
+	if w.Failures != nil {
+		failureBody = &prefixBuffer{max: w.Failures.bodySize}
+		body = io.TeeReader(body, failureBody)
+	}
+
+	transfer, bodyErr := readBody(body, start, w.Limits, cancel)
+
+	end = time.Now()
+	totalTime = end.Sub(start)
+	phases := tracer.Times(end)
+	if phases[PhaseConnect] > 0 {
+		connectTime = phases[PhaseConnect]
+	}
+	if !tracer.firstByte.IsZero() {
+		ttfb = tracer.firstByte.Sub(start)
+	}
+
+	rangeOutcome := RangeNone
+	if rangeBody != nil && bodyErr == nil && !transfer.Truncated {
+		rangeOutcome = w.checkRange(ctx, r, ranges, resp, rangeBody.Bytes(), transfer.Bytes)
+	}
+
+	var rpcErr error
+	if rpcBody != nil && bodyErr == nil && !transfer.Truncated && resp.StatusCode/100 == 2 {
+		rpcErr = validateRPCResponse(method, resp, rpcBody.Bytes())
+	}
+
+	if w.PrintFailures {
+		if bodyErr != nil {
+			fmt.Fprintf(os.Stderr, "%s %s => %s, error reading body %v\n", req.Method, req.URL, resp.Status, bodyErr)
+		} else if rangeOutcome == RangeInvalid || rangeOutcome == RangeMismatch {
+			fmt.Fprintf(os.Stderr, "%s %s (Range: %s) => %s, %s range response\n", req.Method, req.URL, req.Header.Get("Range"), resp.Status, rangeOutcome)
+		} else if rpcErr != nil {
+			fmt.Fprintf(os.Stderr, "%s %s => %s, invalid rpc response: %v\n", req.Method, req.URL, resp.Status, rpcErr)
+		} else if transfer.Truncated {
+			fmt.Fprintf(os.Stderr, "%s %s => %s, truncated after %d bytes in %s\n", req.Method, req.URL, resp.Status, transfer.Bytes, transfer.Duration)
+		} else if w.Stall > 0 && transfer.LongestStall >= w.Stall {
+			fmt.Fprintf(os.Stderr, "%s %s => %s, transfer stalled for %s\n", req.Method, req.URL, resp.Status, transfer.LongestStall)
+		} else if resp.StatusCode/100 != 2 {
+			fmt.Fprintf(os.Stderr, "%s %s => %s\n", req.Method, req.URL, resp.Status)
+		}
+	}
+
+	res := &RequestTiming{
+		ExperimentName: w.ExperimentName,
+		TargetName:     w.Target.Name,
+		TargetGroup:    w.Target.Group,
+		OriginStatus:   r.Status,
+		StatusCode:     resp.StatusCode,
+		ErrorClass:     classifyError(bodyErr, true),
+		ConnectTime:    connectTime,
+		TTFB:           ttfb,
+		TotalTime:      totalTime,
+		Phases:         phases,
+		Transfer:       transfer,
+		Stalled:        w.Stall > 0 && transfer.LongestStall >= w.Stall,
+		Range:          rangeOutcome,
+		RPCMethod:      method,
+		RPCInvalid:     rpcErr != nil,
+		Backend:        req.URL.Host,
+	}
+
+	if w.Failures != nil {
+		if reason := failureReason(res); reason != "" {
+			err := bodyErr
+			if err == nil {
+				err = rpcErr
+			}
+			if err == nil && (rangeOutcome == RangeInvalid || rangeOutcome == RangeMismatch) {
+				err = fmt.Errorf("%s range response", rangeOutcome)
+			}
+			sample := newFailureSample(res, reason, r, req, start, err)
+			sample.ResponseHeader = resp.Header.Clone()
+			sample.Body = failureBody.buf.String()
+			sample.BodyTruncated = failureBody.overflow
+			w.Failures.Add(sample)
+		}
+	}
+
+	return res
+}
+
+// maxRangeVerify is the largest body that is fetched to verify the bytes of a range response
+const maxRangeVerify = 64 << 20
+
+// checkRange checks the response to a range request and, for a sample of valid partial
+// responses, compares the bytes with a fetch of the full body.
+func (w *Worker) checkRange(ctx context.Context, r *request.Request, ranges []byteRange, resp *http.Response, body []byte, bodyLen int64) RangeOutcome {
+	outcome, parts, size := checkRangeResponse(ranges, resp, body, bodyLen)
+	if outcome != RangePartial || len(parts) == 0 || size == -1 || size > maxRangeVerify {
+		return outcome
+	}
+	if w.VerifyRanges == 0 || rand.Float64() >= w.VerifyRanges {
+		return outcome
+	}
+
+	full := *r
+	full.Header = make(map[string]string, len(r.Header))
+	for k, v := range r.Header {
+		if !strings.EqualFold(k, "Range") {
+			full.Header[k] = v
+		}
+	}
+	req, err := newRequest(ctx, w.Target, &full)
+	if err != nil {
+		return outcome
+	}
+	req = req.WithContext(ctx)
+	fullResp, err := w.Client.Do(req)
+	if err != nil {
+		return outcome
+	}
+	defer fullResp.Body.Close()
+	if fullResp.StatusCode != http.StatusOK {
+		return outcome
+	}
+	data, err := io.ReadAll(io.LimitReader(fullResp.Body, size+1))
+	if err != nil {
+		return outcome
+	}
+	return verifyRangeParts(parts, data)
+}
+
+func newRequest(ctx context.Context, t *Target, r *request.Request) (*http.Request, error) {
+	// Request URIs are sent as they were received so the query is split from the path and
+	// the path keeps its original escaping in RawPath. Paths with invalid escapes are
+	// escaped again as they were before the query was split off.
+	path, query, _ := strings.Cut(r.URI, "?")
+	u := &url.URL{
+		Scheme:   t.URLScheme,
+		Host:     t.HostPort(),
+		Path:     path,
+		RawQuery: query,
+	}
+	if p, err := url.PathUnescape(path); err == nil {
+		u.Path = p
+		u.RawPath = path
+	}
+
+	req := &http.Request{
+		Method:     r.Method,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+
+	if r.Body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(r.Body))
+	}
+
+	for k, v := range r.Header {
+		req.Header.Set(k, v)
+	}
+
+	// The URL holds one of the addresses the target resolved to so the Host header is
+	// always set explicitly to keep virtual hosting working.
+	host := req.Header.Get("Host")
+	// The live request log uses a hostname of backend to refer to the orginal host
+	if host == "backend" || host == "" {
+		host = t.HostName
+		req.Header.Set("Host", t.HostName)
+	}
+	req.Host = host
+
+	for k, v := range t.Header {
+		req.Header[k] = v
+	}
+
+	for _, rule := range t.Rewrites {
+		rule(req)
+	}
+
+	// the base path is added after rewrites so rules match the paths of the original requests
+	if req.URL.RawPath != "" {
+		req.URL.RawPath = (&url.URL{Path: t.BasePath}).EscapedPath() + req.URL.RawPath
+	}
+	req.URL.Path = t.BasePath + req.URL.Path
+
+	return req, nil
+}
+
+// TargetsReady waits until every target has passed its readiness probe
+func TargetsReady(ctx context.Context, targets []*Target, quiet bool, interactive bool, preProbeWaitSeconds int, readyTimeout int) error {
+	if preProbeWaitSeconds > 0 && !interactive {
+		if !quiet {
+			fmt.Printf("waiting %s for targets to be start before probing\n", DurationDesc(preProbeWaitSeconds))
+		}
+		time.Sleep(time.Duration(preProbeWaitSeconds) * time.Second)
+	}
+
+	if readyTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(readyTimeout)*time.Second)
+		defer cancel()
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	for _, target := range targets {
+		target := target // avoid shadowing
+		g.Go(func() error {
+			return targetReady(gctx, target, quiet)
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		if readyTimeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("unable to connect to all targets within %s: %w", DurationDesc(readyTimeout), err)
+		}
+		return err
+	}
+
+	if !quiet {
+		fmt.Printf("all targets ready\n")
+	}
+	return nil
+}
+
+// targetReady probes the target until it has passed the required number of consecutive
+// probes or the context is canceled.
+func targetReady(ctx context.Context, target *Target, quiet bool) error {
+	lastErr := errors.New("no successful probe")
+	successes := 0
+	for {
+		err := resolveTarget(target, quiet)
+		if err == nil {
+			err = probeTarget(ctx, target, target.Probe)
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("target %s: %w", target.Name, lastErr)
+		}
+
+		if err != nil {
+			successes = 0
+			lastErr = err
+			if !quiet {
+				fmt.Printf("ready check failed: target %s: %v\n", target.Name, err)
+			}
+		} else {
+			successes++
+			if successes >= target.Probe.Successes {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("target %s: %w", target.Name, lastErr)
+		case <-time.After(target.Probe.Interval):
+		}
+	}
+}
+
+// probeTarget sends the probe request to the target and reports whether an acceptable
+// response was received.
+func probeTarget(ctx context.Context, target *Target, probe *ProbeConfig) error {
+	tr := &http.Transport{
+		TLSClientConfig:     target.TLS.Clone(),
+		MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+		DisableCompression:  true,
+		DisableKeepAlives:   true,
+	}
+	http2.ConfigureTransport(tr)
+
+	hc := &http.Client{
+		Transport: tr,
+		Timeout:   probe.Timeout,
+	}
+
+	req, err := newRequest(ctx, target, &request.Request{Method: "GET", URI: probe.Path})
+	if err != nil {
+		return fmt.Errorf("new request to target: %w", err)
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if probe.ExpectStatus != 0 && resp.StatusCode != probe.ExpectStatus {
+		return fmt.Errorf("unexpected status %d, wanted %d", resp.StatusCode, probe.ExpectStatus)
+	}
+	return nil
+}
+
+// defaultResolveInterval is the time between refreshing the addresses a target's host
+// resolves to when the experiment does not specify one.
+const defaultResolveInterval = time.Minute
+
+// resolve returns the addresses that name resolves to, either every A record of the host
+// or the addresses of every target of its SRV records. The addresses are sorted so they
+// can be compared.
+func resolve(name string) ([]string, error) {
+	var host, port string
+	var err error
+	if strings.Contains(name, ":") {
+		host, port, err = net.SplitHostPort(name)
+		if err != nil {
+			return nil, fmt.Errorf("split host port: %w", err)
+		}
+	} else {
+		host = name
+		port = "8080" // assume gateway default
+	}
+
+	// Special case localhost
+	if host == "localhost" {
+		return []string{name}, nil
+	}
+
+	// name may already be using a raw IP address
+	if net.ParseIP(host) != nil {
+		return []string{name}, nil
+	}
+
+	// Lookup A record
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		var de *net.DNSError
+		if errors.As(err, &de) {
+			if de.Temporary() {
+				return nil, fmt.Errorf("temporary dns error: %w", de)
+			}
+			if de.Timeout() {
+				return nil, fmt.Errorf("dns timeout: %w", de)
+			}
+		}
+	}
+
+	// Use every IP we got
+	if len(ips) > 0 {
+		addrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+		sort.Strings(addrs)
+		return slices.Compact(addrs), nil
+	}
+
+	// No A record so lookup SRV
+	_, recs, err := net.DefaultResolver.LookupSRV(context.Background(), "", "", host)
+	if err != nil {
+		return nil, fmt.Errorf("lookup srv: %w", err)
+	}
+
+	if len(recs) == 0 {
+		return nil, fmt.Errorf("no srv records found")
+	}
+
+	var addrs []string
+	var lastErr error
+	for _, rec := range recs {
+		host := strings.TrimRight(rec.Target, ".")
+		hostport := net.JoinHostPort(host, strconv.Itoa(int(rec.Port)))
+		// Did we get an IP address
+		if net.ParseIP(host) != nil {
+			addrs = append(addrs, hostport)
+			continue
+		}
+
+		// attempt to resolve
+		recAddrs, err := resolve(hostport)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addrs = append(addrs, recAddrs...)
+	}
+	if len(addrs) == 0 {
+		return nil, lastErr
+	}
+	sort.Strings(addrs)
+	return slices.Compact(addrs), nil
+}
+
+// resolveTarget updates the addresses that requests to the target are balanced across.
+func resolveTarget(target *Target, quiet bool) error {
+	addrs, err := resolve(target.RawHostPort)
+	if err != nil {
+		return fmt.Errorf("unable to resolve target %q: %w", target.RawHostPort, err)
+	}
+	if target.SetAddrs(addrs) && !quiet {
+		fmt.Printf("resolved %s to %s\n", target.RawHostPort, strings.Join(addrs, ", "))
+	}
+
+	return nil
+}
+
+// refreshTarget resolves the target's addresses at every interval until the context is
+// canceled so that requests follow changes to the set of backends behind the target.
+func refreshTarget(ctx context.Context, target *Target, interval time.Duration, quiet bool) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := resolveTarget(target, quiet); err != nil && !quiet {
+				fmt.Fprintf(os.Stderr, "refresh %s => error %v\n", target.RawHostPort, err)
+			}
+		}
+	}
+}
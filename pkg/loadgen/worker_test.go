@@ -0,0 +1,64 @@
+package loadgen
+
+import (
+	"context"
+	"testing"
+
+	"github.com/probe-lab/thunderdome/pkg/request"
+)
+
+func TestNewRequestURI(t *testing.T) {
+	testCases := []struct {
+		name    string
+		baseURL string
+		rewrite []*RewriteRuleJSON
+		uri     string
+		want    string
+	}{
+		{name: "plain path", baseURL: "http://gateway.example", uri: "/ipfs/bafy", want: "/ipfs/bafy"},
+		{name: "query", baseURL: "http://gateway.example", uri: "/ipfs/bafy?format=car&dag-scope=entity", want: "/ipfs/bafy?format=car&dag-scope=entity"},
+		{name: "escaped space", baseURL: "http://gateway.example", uri: "/ipfs/bafy/a%20b", want: "/ipfs/bafy/a%20b"},
+		{name: "escaped slash", baseURL: "http://gateway.example", uri: "/ipfs/bafy/a%2Fb", want: "/ipfs/bafy/a%2Fb"},
+		{name: "escaped question mark", baseURL: "http://gateway.example", uri: "/ipfs/bafy/a%3Fb?format=raw", want: "/ipfs/bafy/a%3Fb?format=raw"},
+		{name: "unescaped space", baseURL: "http://gateway.example", uri: "/ipfs/bafy/a b", want: "/ipfs/bafy/a%20b"},
+		{name: "invalid escape", baseURL: "http://gateway.example", uri: "/ipfs/bafy/a%zzb", want: "/ipfs/bafy/a%25zzb"},
+		{name: "base path", baseURL: "http://gateway.example/gw/", uri: "/ipfs/bafy/a%2Fb?format=car", want: "/gw/ipfs/bafy/a%2Fb?format=car"},
+		{
+			name:    "rewritten path",
+			baseURL: "http://gateway.example",
+			rewrite: []*RewriteRuleJSON{{Action: "rewrite_path", Match: "^/ipns/", Replace: "/ipfs/"}},
+			uri:     "/ipns/bafy/a%20b?format=car",
+			want:    "/ipfs/bafy/a%20b?format=car",
+		},
+		{
+			name:    "rewritten query",
+			baseURL: "http://gateway.example",
+			rewrite: []*RewriteRuleJSON{{Action: "set_query", Name: "format", Value: "raw"}},
+			uri:     "/ipfs/bafy/a%2Fb?format=car",
+			want:    "/ipfs/bafy/a%2Fb?format=raw",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			exp, err := NewExperiment(&ExperimentJSON{
+				Name:           "worker",
+				MaxRequestRate: 1,
+				MaxConcurrency: 1,
+				Duration:       -1,
+				Targets:        []*TargetJSON{{BaseURL: tc.baseURL, Rewrite: tc.rewrite}},
+			})
+			if err != nil {
+				t.Fatalf("new experiment: %v", err)
+			}
+
+			req, err := newRequest(context.Background(), exp.Targets[0], &request.Request{Method: "GET", URI: tc.uri})
+			if err != nil {
+				t.Fatalf("new request: %v", err)
+			}
+			if got := req.URL.RequestURI(); got != tc.want {
+				t.Errorf("got request uri %q, wanted %q", got, tc.want)
+			}
+		})
+	}
+}